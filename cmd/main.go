@@ -2,12 +2,14 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -43,24 +45,61 @@ func main() {
 		log.Fatalf("Failed to create multi-proxy middleware: %v", err)
 	}
 
+	// Exchange user tokens for routes that request audience-specific tokens
+	multiProxyMiddleware.SetTokenExchanger(oidcMiddleware.TokenExchanger())
+	multiProxyMiddleware.SetClientTokenSource(oidcMiddleware.ClientCredentials())
+
+	// Sign identity assertions for upstreams if enabled
+	assertionSigner, err := middleware.NewAssertionSigner(cfg)
+	if err != nil {
+		log.Fatalf("Failed to create gateway token signer: %v", err)
+	}
+	if assertionSigner != nil {
+		multiProxyMiddleware.SetAssertionSigner(assertionSigner)
+	}
+
+	// Start active upstream health checks if enabled
+	var healthChecker *middleware.HealthChecker
+	if cfg.HealthCheckUpstreams {
+		healthChecker = middleware.NewHealthChecker(multiProxyMiddleware)
+		healthChecker.Start()
+		defer healthChecker.Stop()
+	}
+
 	// Create router
 	mux := http.NewServeMux()
 
 	// Health check endpoint
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		status := "healthy"
+		response := map[string]interface{}{
+			"status":    "healthy",
+			"timestamp": time.Now().UTC().Format(time.RFC3339),
+		}
 
-		// Optionally check upstream health if enabled
-		upstreamStatus := ""
-		if cfg.HealthCheckUpstreams {
-			upstreamStatus = `,"upstreams":"not_checked"` // TODO: Implement upstream health checks
+		// Report upstream health if enabled; a route without any healthy
+		// upstream degrades the gateway but does not make it unhealthy
+		if healthChecker != nil {
+			response["upstreams"] = healthChecker.Status()
+			if !healthChecker.Healthy() {
+				response["status"] = "degraded"
+			}
 		}
 
-		fmt.Fprintf(w, `{"status":"%s","timestamp":"%s"%s}`, status, time.Now().UTC().Format(time.RFC3339), upstreamStatus)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(response)
 	})
 
+	// Public keys for verifying gateway tokens
+	if assertionSigner != nil {
+		mux.Handle("/.well-known/jwks.json", assertionSigner.JWKSHandler())
+	}
+
+	// Content Security Policy violation reports
+	if cfg.CSPReportPath != "" {
+		mux.Handle(cfg.CSPReportPath, multiProxyMiddleware.CSPReportHandler())
+	}
+
 	// OIDC callback endpoint
 	mux.HandleFunc("/oidc/callback", oidcMiddleware.HandleCallback)
 
@@ -83,16 +122,38 @@ func main() {
 	})
 	mux.Handle("/auth/userinfo", oidcMiddleware.Handler(userInfoHandler))
 
-	// All other requests go through the multi-proxy with authentication
-	mux.Handle("/", oidcMiddleware.Handler(multiProxyMiddleware.Handler()))
+	// All other requests go through the multi-proxy, with authentication
+	// unless the matching route is public
+	mux.Handle("/", multiProxyMiddleware.WithPublicRoutes(oidcMiddleware.Handler(multiProxyMiddleware.Handler())))
 
 	// Create server
 	server := &http.Server{
-		Addr:         fmt.Sprintf("%s:%s", cfg.Host, cfg.Port),
-		Handler:      loggingMiddleware(mux),
-		ReadTimeout:  30 * time.Second,
-		WriteTimeout: 30 * time.Second,
-		IdleTimeout:  120 * time.Second,
+		Addr:              fmt.Sprintf("%s:%s", cfg.Host, cfg.Port),
+		Handler:           middleware.RequestID(loggingMiddleware(multiProxyMiddleware.SecurityHeaders(multiProxyMiddleware.CORS(mux)))),
+		ReadTimeout:       cfg.ServerReadTimeout,
+		ReadHeaderTimeout: cfg.ServerReadHeaderTimeout,
+		WriteTimeout:      cfg.ServerWriteTimeout,
+		IdleTimeout:       cfg.ServerIdleTimeout,
+	}
+
+	// Create admin server on a separate listener if enabled
+	var adminServer *http.Server
+	if cfg.AdminEnabled {
+		adminHandler := middleware.NewAdminHandler(cfg, sessionStore)
+		adminServer = &http.Server{
+			Addr:         fmt.Sprintf("%s:%s", cfg.AdminHost, cfg.AdminPort),
+			Handler:      loggingMiddleware(adminHandler.Handler()),
+			ReadTimeout:  30 * time.Second,
+			WriteTimeout: 30 * time.Second,
+			IdleTimeout:  120 * time.Second,
+		}
+
+		go func() {
+			log.Printf("Starting admin API on %s:%s", cfg.AdminHost, cfg.AdminPort)
+			if err := adminServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatalf("Admin server failed to start: %v", err)
+			}
+		}()
 	}
 
 	// Start server
@@ -101,7 +162,15 @@ func main() {
 		log.Printf("OIDC Provider: %s", cfg.OIDCProviderURL)
 		log.Printf("Configured %d upstream routes", len(cfg.UpstreamRoutes))
 		for _, route := range cfg.UpstreamRoutes {
-			log.Printf("  Route: %s -> %s (strip: %v)", route.Path, route.UpstreamURL, route.StripPath)
+			if route.Static.Enabled() {
+				log.Printf("  Route: %s -> static files (spa: %v)", route.Path, route.Static.SPA)
+				continue
+			}
+			upstreams := make([]string, 0, len(route.Targets()))
+			for _, target := range route.Targets() {
+				upstreams = append(upstreams, target.URL)
+			}
+			log.Printf("  Route: %s -> %s (strip: %v)", route.Path, strings.Join(upstreams, ", "), route.StripPath)
 		}
 
 		var err error
@@ -125,6 +194,9 @@ func main() {
 
 	log.Println("Shutting down server...")
 	server.Close()
+	if adminServer != nil {
+		adminServer.Close()
+	}
 	log.Println("Server stopped")
 }
 
@@ -139,7 +211,7 @@ func loggingMiddleware(next http.Handler) http.Handler {
 		next.ServeHTTP(wrapper, r)
 
 		duration := time.Since(start)
-		log.Printf("%s %s %d %v %s", r.Method, r.URL.Path, wrapper.statusCode, duration, r.RemoteAddr)
+		log.Printf("%s %s %d %v %s %s", r.Method, r.URL.Path, wrapper.statusCode, duration, r.RemoteAddr, middleware.GetRequestIDFromContext(r.Context()))
 	})
 }
 
@@ -3,8 +3,9 @@ module github.com/ase-compas/compas-auth-proxy
 go 1.20
 
 require (
+	github.com/andybalholm/brotli v1.1.0
+	github.com/gorilla/websocket v1.5.3
+	github.com/klauspost/compress v1.17.4
 	github.com/koding/websocketproxy v0.0.0-20181220232114-7ed82d81a28c
 	gopkg.in/yaml.v3 v3.0.1
 )
-
-require github.com/gorilla/websocket v1.5.3 // indirect
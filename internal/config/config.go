@@ -2,24 +2,254 @@ package config
 
 import (
 	"fmt"
+	"net"
 	"os"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
+// Strategies applied when a user exceeds the concurrent session limit
+const (
+	SessionLimitReject      = "reject"
+	SessionLimitEvictOldest = "evict_oldest"
+)
+
+// Actions taken when a request does not match the client a session is bound to
+const (
+	SessionBindingReject         = "reject"
+	SessionBindingReauthenticate = "reauthenticate"
+)
+
+// Session cookie Secure attribute modes and SameSite values
+const (
+	CookieSecureAuto  = "auto" // Secure when the request arrived via HTTPS
+	CookieSecureTrue  = "true"
+	CookieSecureFalse = "false"
+
+	CookieSameSiteLax    = "lax"
+	CookieSameSiteStrict = "strict"
+	CookieSameSiteNone   = "none"
+
+	CookiePrefixHost   = "__Host-"
+	CookiePrefixSecure = "__Secure-"
+)
+
+// Load balancing strategies for routes with several upstream targets
+const (
+	LoadBalanceRoundRobin       = "round_robin"
+	LoadBalanceLeastConnections = "least_connections"
+	LoadBalanceWeighted         = "weighted"
+	LoadBalanceConsistentHash   = "consistent_hash" // Sticky by authenticated user
+)
+
 // UpstreamRoute represents a routing rule for upstream services
 type UpstreamRoute struct {
-	Path            string `json:"path" yaml:"path"`                         // URL path prefix to match
-	UpstreamURL     string `json:"upstream_url" yaml:"upstream_url"`         // Target upstream URL
-	StripPath       bool   `json:"strip_path" yaml:"strip_path"`             // Whether to strip the path prefix when forwarding
-	EnableWebSocket bool   `json:"enable_websocket" yaml:"enable_websocket"` // Whether to enable WebSocket proxying for this route
+	Path                string                `json:"path" yaml:"path"`                                   // URL path prefix to match
+	PathRegex           string                `json:"path_regex" yaml:"path_regex"`                       // Regular expression the path must also match; named groups become parameters
+	Rewrite             string                `json:"rewrite" yaml:"rewrite"`                             // Template replacing the matched path, e.g. /scl/v2/{type}/{id}
+	Query               QueryRewriteConfig    `json:"query" yaml:"query"`                                 // Query parameters added or removed before forwarding
+	Match               RouteMatchConfig      `json:"match" yaml:"match"`                                 // Additional host, method, header and query predicates
+	Priority            int                   `json:"priority" yaml:"priority"`                           // Routes with a higher priority are matched first
+	Public              bool                  `json:"public" yaml:"public"`                               // Whether the route is served without user authentication
+	UpstreamURL         string                `json:"upstream_url" yaml:"upstream_url"`                   // Target upstream URL
+	Upstreams           []UpstreamTarget      `json:"upstreams" yaml:"upstreams"`                         // Target upstream URLs for load balancing
+	LoadBalancing       string                `json:"load_balancing" yaml:"load_balancing"`               // Strategy used to pick one of the upstreams
+	StripPath           bool                  `json:"strip_path" yaml:"strip_path"`                       // Whether to strip the path prefix when forwarding
+	EnableWebSocket     bool                  `json:"enable_websocket" yaml:"enable_websocket"`           // Whether to enable WebSocket proxying for this route
+	HealthCheck         HealthCheckConfig     `json:"health_check" yaml:"health_check"`                   // Overrides of the global upstream health check settings
+	CircuitBreaker      CircuitBreakerConfig  `json:"circuit_breaker" yaml:"circuit_breaker"`             // Passive health checking of the upstreams
+	Retry               RetryConfig           `json:"retry" yaml:"retry"`                                 // Retry policy for failed upstream requests
+	Timeouts            TimeoutConfig         `json:"timeouts" yaml:"timeouts"`                           // Timeouts for requests to the upstreams
+	TLS                 UpstreamTLSConfig     `json:"tls" yaml:"tls"`                                     // TLS settings for HTTPS and WSS upstreams
+	RequestHeaders      HeaderRulesConfig     `json:"request_headers" yaml:"request_headers"`             // Headers changed before forwarding to the upstream
+	ResponseHeaders     HeaderRulesConfig     `json:"response_headers" yaml:"response_headers"`           // Headers changed before returning the response
+	Identity            IdentityConfig        `json:"identity" yaml:"identity"`                           // How the user identity and tokens are forwarded to the upstreams
+	CORS                CORSConfig            `json:"cors" yaml:"cors"`                                   // Overrides of the global CORS policy
+	SecurityHeaders     SecurityHeadersConfig `json:"security_headers" yaml:"security_headers"`           // Overrides of the global security headers
+	RateLimit           RateLimitConfig       `json:"rate_limit" yaml:"rate_limit"`                       // Overrides of the global rate limit
+	MaxRequestBody      ByteSize              `json:"max_request_body" yaml:"max_request_body"`           // Largest accepted request body, 0 means no limit
+	AllowedContentTypes []string              `json:"allowed_content_types" yaml:"allowed_content_types"` // Media types accepted for request bodies, e.g. application/xml or image/*
+	Compression         CompressionConfig     `json:"compression" yaml:"compression"`                     // Compression of responses by the gateway
+	Cache               RouteCacheConfig      `json:"cache" yaml:"cache"`                                 // Caching of responses in the shared gateway cache
+	Static              StaticConfig          `json:"static" yaml:"static"`                               // Files served by the gateway instead of an upstream
+}
+
+// StaticConfig holds the files served by a static route. Either a directory
+// or the frontend bundle embedded in the binary is served.
+type StaticConfig struct {
+	Dir          string `json:"dir" yaml:"dir"`                     // Directory served
+	Embedded     bool   `json:"embedded" yaml:"embedded"`           // Serve the embedded frontend bundle
+	Index        string `json:"index" yaml:"index"`                 // Index file of directories (default index.html)
+	SPA          bool   `json:"spa" yaml:"spa"`                     // Serve the index for unknown paths without file extension (history API fallback)
+	HashedAssets string `json:"hashed_assets" yaml:"hashed_assets"` // Regular expression matching file names with a content hash, cached as immutable
+	CacheControl string `json:"cache_control" yaml:"cache_control"` // Cache-Control of all other files (default no-cache)
+}
+
+// Enabled reports whether the route serves static files
+func (s StaticConfig) Enabled() bool {
+	return s.Dir != "" || s.Embedded
+}
+
+// RouteMatchConfig holds the request predicates a route matches on in addition
+// to its path. All configured predicates must match.
+type RouteMatchConfig struct {
+	Hosts   []string          `json:"hosts" yaml:"hosts"`     // Host names, "*.example.com" matches any subdomain
+	Methods []string          `json:"methods" yaml:"methods"` // HTTP methods
+	Headers map[string]string `json:"headers" yaml:"headers"` // Required header values, "*" only requires presence
+	Query   map[string]string `json:"query" yaml:"query"`     // Required query parameter values, "*" only requires presence
+}
+
+// QueryRewriteConfig holds the query parameters changed before forwarding
+type QueryRewriteConfig struct {
+	Add    map[string]string `json:"add" yaml:"add"`       // Parameters set on every request; values may use {param} placeholders
+	Remove []string          `json:"remove" yaml:"remove"` // Parameters removed from every request
+}
+
+// PathPlaceholder matches a {name} placeholder in a path, rewrite or query template
+var PathPlaceholder = regexp.MustCompile(`\{(\w+)\}`)
+
+// PathParameters returns the names of the parameters captured by the path
+// template and the path regex of the route
+func (r UpstreamRoute) PathParameters() ([]string, error) {
+	var names []string
+	for _, segment := range strings.Split(r.Path, "/") {
+		if !strings.ContainsAny(segment, "{}") {
+			continue
+		}
+		match := PathPlaceholder.FindStringSubmatch(segment)
+		if match == nil || match[0] != segment {
+			return nil, fmt.Errorf("invalid path segment %q (placeholders must span a whole segment)", segment)
+		}
+		names = append(names, match[1])
+	}
+
+	if r.PathRegex != "" {
+		re, err := regexp.Compile(r.PathRegex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path_regex: %v", err)
+		}
+		for _, name := range re.SubexpNames() {
+			if name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+	return names, nil
+}
+
+// Token forwarding modes for upstream requests
+const (
+	TokenForwardNone        = "none"
+	TokenForwardAccessToken = "access_token"
+	TokenForwardIDToken     = "id_token"
+	TokenForwardExchanged   = "exchanged" // Access token exchanged for the route's audience
+
+	TokenForwardClientCredentials = "client_credentials" // Token of the gateway itself
+)
+
+// IdentityConfig holds how a route forwards the identity of the user. Header
+// names default to the X-Auth-* headers; "-" disables a header.
+type IdentityConfig struct {
+	UserHeader     string            `json:"user_header" yaml:"user_header"`         // Subject (default X-Auth-User)
+	EmailHeader    string            `json:"email_header" yaml:"email_header"`       // Email (default X-Auth-Email)
+	NameHeader     string            `json:"name_header" yaml:"name_header"`         // Full name (default X-Auth-Name)
+	UsernameHeader string            `json:"username_header" yaml:"username_header"` // Preferred username (default X-Auth-Username)
+	Claims         map[string]string `json:"claims" yaml:"claims"`                   // Dot-separated claim path to header name
+	Token          string            `json:"token" yaml:"token"`                     // none, access_token (default), id_token, exchanged or client_credentials
+	TokenHeader    string            `json:"token_header" yaml:"token_header"`       // Header carrying the token (default Authorization with Bearer scheme)
+	Audience       string            `json:"audience" yaml:"audience"`               // Audience requested for exchanged tokens
+	Scopes         []string          `json:"scopes" yaml:"scopes"`                   // Scopes requested for exchanged and client credentials tokens
+	Assertion      AssertionConfig   `json:"assertion" yaml:"assertion"`             // Signed identity assertion issued by the gateway
+}
+
+// AssertionConfig holds the gateway-issued identity assertion (a signed JWT)
+// forwarded by a route
+type AssertionConfig struct {
+	Enabled  bool              `json:"enabled" yaml:"enabled"`
+	Header   string            `json:"header" yaml:"header"`     // Header carrying the JWT (default X-Gateway-Assertion)
+	Audience string            `json:"audience" yaml:"audience"` // aud claim of the JWT
+	Claims   map[string]string `json:"claims" yaml:"claims"`     // JWT claim name to dot-separated user claim path
+}
+
+// HeaderRulesConfig holds header changes of a route. Values may contain
+// ${...} template variables, see HeaderTemplateVariables. Headers are removed
+// first, then set, then added; a set header whose value expands to an empty
+// string is removed.
+type HeaderRulesConfig struct {
+	Set    map[string]string `json:"set" yaml:"set"`       // Headers replaced with the given value
+	Add    map[string]string `json:"add" yaml:"add"`       // Values appended to existing headers
+	Remove []string          `json:"remove" yaml:"remove"` // Headers removed, e.g. Server or X-Powered-By
+}
+
+// HeaderTemplateVariables lists the variables available in header templates
+// besides param.<name> for path parameters
+var HeaderTemplateVariables = []string{
+	"user.sub", "user.email", "user.name", "user.username", "user.roles",
+	"client_ip", "request_id",
+}
+
+// HeaderTemplateVariable matches a ${name} variable in a header template
+var HeaderTemplateVariable = regexp.MustCompile(`\$\{([^}]*)\}`)
+
+// validateHeaderTemplates checks that header templates only use known variables
+func validateHeaderTemplates(rules HeaderRulesConfig, params []string) error {
+	values := make([]string, 0, len(rules.Set)+len(rules.Add))
+	for _, value := range rules.Set {
+		values = append(values, value)
+	}
+	for _, value := range rules.Add {
+		values = append(values, value)
+	}
+
+	for _, value := range values {
+		for _, match := range HeaderTemplateVariable.FindAllStringSubmatch(value, -1) {
+			name := match[1]
+			if param := strings.TrimPrefix(name, "param."); param != name && containsString(params, param) {
+				continue
+			}
+			if !containsString(HeaderTemplateVariables, name) {
+				return fmt.Errorf("unknown header template variable ${%s}", name)
+			}
+		}
+	}
+	return nil
+}
+
+// MaxUpstreamWeight bounds the weight of an upstream target; the consistent
+// hash ring holds a number of nodes proportional to the weight
+const MaxUpstreamWeight = 100
+
+// UpstreamTarget represents a single upstream server of a route
+type UpstreamTarget struct {
+	URL    string `json:"url" yaml:"url"`
+	Weight int    `json:"weight" yaml:"weight"` // Relative weight for the weighted and consistent_hash strategies
+}
+
+// Targets returns the upstream targets of the route, either from the
+// upstreams list or from the single upstream_url
+func (r UpstreamRoute) Targets() []UpstreamTarget {
+	if len(r.Upstreams) > 0 {
+		return r.Upstreams
+	}
+	if r.UpstreamURL != "" {
+		return []UpstreamTarget{{URL: r.UpstreamURL, Weight: 1}}
+	}
+	return nil
 }
 
 // ServerConfig holds server-specific configuration
 type ServerConfig struct {
 	Port string `yaml:"port"`
 	Host string `yaml:"host"`
+
+	ReadTimeout       time.Duration `yaml:"read_timeout"`        // Time to read a whole request including the body; 0 means no limit
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"` // Time to read the request headers
+	WriteTimeout      time.Duration `yaml:"write_timeout"`       // Time to write the response; 0 means no limit
+	IdleTimeout       time.Duration `yaml:"idle_timeout"`        // Time a keep-alive connection may stay idle
 }
 
 // TLSConfig holds TLS-specific configuration
@@ -36,6 +266,7 @@ type OIDCConfig struct {
 	ClientSecret string `yaml:"client_secret"`
 	RedirectURL  string `yaml:"redirect_url"`
 	Scopes       string `yaml:"scopes"`
+	RolesClaim   string `yaml:"roles_claim"` // Dot-separated path of the roles claim in the userinfo response
 }
 
 // SessionConfig holds session management configuration
@@ -43,6 +274,30 @@ type SessionConfig struct {
 	Secret     string `yaml:"secret"`
 	CookieName string `yaml:"cookie_name"`
 	MaxAge     int    `yaml:"max_age"`
+
+	MaxSessionsPerUser int    `yaml:"max_sessions_per_user"` // 0 means unlimited
+	LimitStrategy      string `yaml:"limit_strategy"`        // reject or evict_oldest
+
+	Binding SessionBindingConfig `yaml:"binding"`
+	Cookie  CookieConfig         `yaml:"cookie"`
+}
+
+// CookieConfig holds the attributes of the session cookie
+type CookieConfig struct {
+	Secure   string `yaml:"secure"`    // auto, true or false
+	SameSite string `yaml:"same_site"` // lax, strict or none
+	Domain   string `yaml:"domain"`
+	Path     string `yaml:"path"`
+	Prefix   string `yaml:"prefix"` // "", __Host- or __Secure-
+}
+
+// SessionBindingConfig holds configuration for binding sessions to the client
+type SessionBindingConfig struct {
+	Enabled        bool   `yaml:"enabled"`
+	Mode           string `yaml:"mode"`             // reject or reauthenticate
+	IPv4Prefix     *int   `yaml:"ipv4_prefix"`      // Tolerated IPv4 prefix length, 0 ignores the address
+	IPv6Prefix     *int   `yaml:"ipv6_prefix"`      // Tolerated IPv6 prefix length, 0 ignores the address
+	CheckUserAgent bool   `yaml:"check_user_agent"` // Whether the User-Agent must stay the same
 }
 
 // ProxyConfig holds proxy-specific configuration
@@ -50,9 +305,39 @@ type ProxyConfig struct {
 	Routes []UpstreamRoute `yaml:"routes"`
 }
 
+// CORSConfig holds a CORS policy. On routes, every field that is set
+// overrides the global policy.
+type CORSConfig struct {
+	AllowedOrigins   []string      `json:"allowed_origins" yaml:"allowed_origins"`     // "*", exact origins or "https://*.example.com"
+	AllowedMethods   []string      `json:"allowed_methods" yaml:"allowed_methods"`     // Methods allowed in preflight requests
+	AllowedHeaders   []string      `json:"allowed_headers" yaml:"allowed_headers"`     // Request headers allowed in preflight requests, "*" allows any
+	ExposedHeaders   []string      `json:"exposed_headers" yaml:"exposed_headers"`     // Response headers readable by scripts
+	AllowCredentials *bool         `json:"allow_credentials" yaml:"allow_credentials"` // Defaults to true unless any origin is allowed
+	MaxAge           time.Duration `json:"max_age" yaml:"max_age"`                     // How long browsers cache preflight results
+}
+
+// SecurityHeadersConfig holds the security headers added to responses. On
+// routes, every value that is set overrides the global value; "-" removes the
+// header.
+type SecurityHeadersConfig struct {
+	StrictTransportSecurity   string `json:"strict_transport_security" yaml:"strict_transport_security"`       // Sent on HTTPS requests only
+	ContentSecurityPolicy     string `json:"content_security_policy" yaml:"content_security_policy"`           // May include frame-ancestors
+	CSPReportOnly             *bool  `json:"csp_report_only" yaml:"csp_report_only"`                           // Send Content-Security-Policy-Report-Only instead
+	FrameOptions              string `json:"frame_options" yaml:"frame_options"`                               // X-Frame-Options: DENY or SAMEORIGIN
+	ContentTypeOptions        string `json:"content_type_options" yaml:"content_type_options"`                 // X-Content-Type-Options
+	ReferrerPolicy            string `json:"referrer_policy" yaml:"referrer_policy"`                           // Referrer-Policy
+	PermissionsPolicy         string `json:"permissions_policy" yaml:"permissions_policy"`                     // Permissions-Policy
+	CrossOriginOpenerPolicy   string `json:"cross_origin_opener_policy" yaml:"cross_origin_opener_policy"`     // Cross-Origin-Opener-Policy
+	CrossOriginEmbedderPolicy string `json:"cross_origin_embedder_policy" yaml:"cross_origin_embedder_policy"` // Cross-Origin-Embedder-Policy
+}
+
 // SecurityConfig holds security-specific configuration
 type SecurityConfig struct {
-	AllowedOrigins []string `yaml:"allowed_origins"`
+	AllowedOrigins []string              `yaml:"allowed_origins"`
+	CORS           CORSConfig            `yaml:"cors"`            // CORS policy; cors.allowed_origins takes precedence over allowed_origins
+	Headers        SecurityHeadersConfig `yaml:"headers"`         // Security headers added to all responses
+	CSPReportPath  string                `yaml:"csp_report_path"` // Endpoint logging CSP violation reports, added as report-uri
+	TrustedProxies []string              `yaml:"trusted_proxies"` // CIDRs whose X-Forwarded-* headers are honored
 }
 
 // LoggingConfig holds logging configuration
@@ -63,27 +348,184 @@ type LoggingConfig struct {
 
 // HealthConfig holds health check configuration
 type HealthConfig struct {
-	Enabled        bool `yaml:"enabled"`
-	CheckUpstreams bool `yaml:"check_upstreams"`
+	Enabled           bool `yaml:"enabled"`
+	CheckUpstreams    bool `yaml:"check_upstreams"`
+	HealthCheckConfig `yaml:",inline"`
+}
+
+// Failure classes that can be retried besides 5xx status codes
+const (
+	RetryOnConnectError = "connect_error" // The connection to the upstream could not be established
+	RetryOnTimeout      = "timeout"       // The upstream did not answer in time
+)
+
+// RetryConfig holds the retry policy of a route. Only idempotent requests are
+// retried unless AllowNonIdempotent is set.
+type RetryConfig struct {
+	Attempts           int           `json:"attempts" yaml:"attempts"`                         // Total attempts including the first one; 0 or 1 disables retries
+	Backoff            time.Duration `json:"backoff" yaml:"backoff"`                           // Delay before the first retry, doubled for every further retry
+	MaxBackoff         time.Duration `json:"max_backoff" yaml:"max_backoff"`                   // Upper bound of the delay between retries
+	RetryOn            []string      `json:"retry_on" yaml:"retry_on"`                         // connect_error, timeout and/or 5xx status codes
+	AllowNonIdempotent bool          `json:"allow_non_idempotent" yaml:"allow_non_idempotent"` // Also retry POST and PATCH requests
+	MaxBodySize        ByteSize      `json:"max_body_size" yaml:"max_body_size"`               // Largest request body buffered for replay
+}
+
+// TimeoutConfig holds the timeouts of requests from a route to its upstreams.
+// A zero value means no limit unless a default is documented.
+type TimeoutConfig struct {
+	Dial           time.Duration `json:"dial" yaml:"dial"`                       // Establishing the TCP connection (default 10s)
+	TLSHandshake   time.Duration `json:"tls_handshake" yaml:"tls_handshake"`     // TLS handshake with HTTPS upstreams (default 10s)
+	ResponseHeader time.Duration `json:"response_header" yaml:"response_header"` // Waiting for the response headers after sending the request
+	Idle           time.Duration `json:"idle" yaml:"idle"`                       // Keeping idle upstream connections open (default 90s)
+	Overall        time.Duration `json:"overall" yaml:"overall"`                 // Whole request including the response body; not applied to WebSockets
+}
+
+// Supported minimum TLS versions for upstream connections
+const (
+	TLSVersion10 = "1.0"
+	TLSVersion11 = "1.1"
+	TLSVersion12 = "1.2"
+	TLSVersion13 = "1.3"
+)
+
+// UpstreamTLSConfig holds the TLS settings used when connecting to the
+// upstreams of a route
+type UpstreamTLSConfig struct {
+	CAFile             string `json:"ca_file" yaml:"ca_file"`                           // PEM bundle of CAs trusted in addition to the system roots
+	CertFile           string `json:"cert_file" yaml:"cert_file"`                       // Client certificate for mutual TLS
+	KeyFile            string `json:"key_file" yaml:"key_file"`                         // Private key of the client certificate
+	ServerName         string `json:"server_name" yaml:"server_name"`                   // Overrides the SNI and verified host name
+	MinVersion         string `json:"min_version" yaml:"min_version"`                   // 1.0, 1.1, 1.2 or 1.3 (default 1.2)
+	InsecureSkipVerify bool   `json:"insecure_skip_verify" yaml:"insecure_skip_verify"` // Disables certificate verification
+}
+
+// CircuitBreakerConfig holds the settings of the per-upstream circuit breakers
+// of a route. Failures are connection errors, timeouts and 5xx responses.
+type CircuitBreakerConfig struct {
+	Enabled             bool          `json:"enabled" yaml:"enabled"`
+	ConsecutiveFailures int           `json:"consecutive_failures" yaml:"consecutive_failures"` // Consecutive failures that open the breaker
+	FailureRate         float64       `json:"failure_rate" yaml:"failure_rate"`                 // Failure ratio (0-1) within the window that opens the breaker
+	MinimumRequests     int           `json:"minimum_requests" yaml:"minimum_requests"`         // Requests within the window before the failure rate is evaluated
+	Window              time.Duration `json:"window" yaml:"window"`                             // Length of the window the failure rate is measured over
+	OpenDuration        time.Duration `json:"open_duration" yaml:"open_duration"`               // Time the breaker stays open before probing
+	HalfOpenRequests    int           `json:"half_open_requests" yaml:"half_open_requests"`     // Successful probes required to close the breaker
+}
+
+// HealthCheckConfig holds the settings for actively probing upstream targets
+type HealthCheckConfig struct {
+	Path               string        `json:"path" yaml:"path"`                               // Path probed on each upstream
+	Interval           time.Duration `json:"interval" yaml:"interval"`                       // Time between probes
+	Timeout            time.Duration `json:"timeout" yaml:"timeout"`                         // Timeout of a single probe
+	HealthyThreshold   int           `json:"healthy_threshold" yaml:"healthy_threshold"`     // Consecutive successes to mark a target healthy
+	UnhealthyThreshold int           `json:"unhealthy_threshold" yaml:"unhealthy_threshold"` // Consecutive failures to mark a target unhealthy
+}
+
+// Compression algorithms (content codings)
+const (
+	CompressionBrotli = "br"
+	CompressionZstd   = "zstd"
+	CompressionGzip   = "gzip"
+)
+
+// CompressionConfig holds how the gateway compresses upstream responses that
+// are not compressed yet
+type CompressionConfig struct {
+	Enabled      bool     `json:"enabled" yaml:"enabled"`
+	Algorithms   []string `json:"algorithms" yaml:"algorithms"`       // Supported codings in order of preference (default br, zstd, gzip)
+	MinSize      ByteSize `json:"min_size" yaml:"min_size"`           // Smallest response compressed (default 1KB)
+	ContentTypes []string `json:"content_types" yaml:"content_types"` // Media types compressed, e.g. text/* or application/*+json
+}
+
+// CacheConfig holds the shared HTTP cache of the gateway. Responses are kept
+// in memory and, if a directory is configured, on disk as well.
+type CacheConfig struct {
+	MaxSize      ByteSize        `yaml:"max_size"`       // Memory used by cached responses (default 64MB)
+	MaxEntrySize ByteSize        `yaml:"max_entry_size"` // Largest cached response body (default 10MB)
+	Disk         DiskCacheConfig `yaml:"disk"`
+}
+
+// DiskCacheConfig holds the optional disk tier of the cache
+type DiskCacheConfig struct {
+	Dir     string   `yaml:"dir"`      // Directory of cached responses, disabled if empty
+	MaxSize ByteSize `yaml:"max_size"` // Disk space used by cached responses (default 1GB)
+}
+
+// RouteCacheConfig holds how responses of a route are cached. Responses to
+// requests carrying credentials or cookies are only cached with Authorized.
+type RouteCacheConfig struct {
+	Enabled    bool          `json:"enabled" yaml:"enabled"`
+	Authorized bool          `json:"authorized" yaml:"authorized"`   // Also cache responses to authenticated requests; they must not differ by user
+	DefaultTTL time.Duration `json:"default_ttl" yaml:"default_ttl"` // Freshness of responses without expiration time (default heuristic from Last-Modified)
+}
+
+// Keys requests are rate limited by
+const (
+	RateLimitKeyUser   = "user"    // Subject of the authenticated user, client IP otherwise
+	RateLimitKeyIP     = "ip"      // Client IP
+	RateLimitKeyAPIKey = "api_key" // API key header, client IP otherwise
+)
+
+// RateLimitConfig holds a token bucket rate limit. The global limit is the
+// default of every route; each route has its own buckets.
+type RateLimitConfig struct {
+	Requests     int           `json:"requests" yaml:"requests"`             // Requests allowed per window, 0 disables the limit
+	Window       time.Duration `json:"window" yaml:"window"`                 // Time in which the bucket refills completely (default 1m)
+	Burst        int           `json:"burst" yaml:"burst"`                   // Bucket size (default requests)
+	Key          string        `json:"key" yaml:"key"`                       // user (default), ip or api_key
+	APIKeyHeader string        `json:"api_key_header" yaml:"api_key_header"` // Header carrying the API key (default X-API-Key)
+	Disabled     bool          `json:"disabled" yaml:"disabled"`             // Disables the global limit for a route
+}
+
+// Signing algorithms for gateway-issued tokens
+const (
+	SigningAlgorithmRS256 = "RS256"
+	SigningAlgorithmEdDSA = "EdDSA"
+)
+
+// GatewayTokenConfig holds the key used to sign identity assertions for
+// upstreams. The public key is published at /.well-known/jwks.json.
+type GatewayTokenConfig struct {
+	Enabled   bool          `yaml:"enabled"`
+	Algorithm string        `yaml:"algorithm"` // RS256 or EdDSA
+	KeyFile   string        `yaml:"key_file"`  // PEM private key; a key is generated at startup if empty
+	KeyID     string        `yaml:"key_id"`    // kid header, derived from the public key if empty
+	Issuer    string        `yaml:"issuer"`
+	TTL       time.Duration `yaml:"ttl"` // Lifetime of issued tokens
+}
+
+// AdminConfig holds configuration for the administrative API
+type AdminConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Host    string `yaml:"host"`
+	Port    string `yaml:"port"`
+	Token   string `yaml:"token"`
 }
 
 // YAMLConfig represents the YAML configuration structure
 type YAMLConfig struct {
-	Server   ServerConfig   `yaml:"server"`
-	TLS      TLSConfig      `yaml:"tls"`
-	OIDC     OIDCConfig     `yaml:"oidc"`
-	Session  SessionConfig  `yaml:"session"`
-	Proxy    ProxyConfig    `yaml:"proxy"`
-	Security SecurityConfig `yaml:"security"`
-	Logging  LoggingConfig  `yaml:"logging"`
-	Health   HealthConfig   `yaml:"health"`
+	Server       ServerConfig       `yaml:"server"`
+	TLS          TLSConfig          `yaml:"tls"`
+	OIDC         OIDCConfig         `yaml:"oidc"`
+	Session      SessionConfig      `yaml:"session"`
+	Proxy        ProxyConfig        `yaml:"proxy"`
+	Security     SecurityConfig     `yaml:"security"`
+	Logging      LoggingConfig      `yaml:"logging"`
+	Health       HealthConfig       `yaml:"health"`
+	Admin        AdminConfig        `yaml:"admin"`
+	GatewayToken GatewayTokenConfig `yaml:"gateway_token"`
+	RateLimit    RateLimitConfig    `yaml:"rate_limit"`
+	Cache        CacheConfig        `yaml:"cache"`
 }
 
 // Config holds the application configuration (internal representation)
 type Config struct {
 	// Server configuration
-	Port string
-	Host string
+	Port                    string
+	Host                    string
+	ServerReadTimeout       time.Duration
+	ServerReadHeaderTimeout time.Duration
+	ServerWriteTimeout      time.Duration
+	ServerIdleTimeout       time.Duration
 
 	// OpenID Connect configuration
 	OIDCProviderURL  string
@@ -91,6 +533,7 @@ type Config struct {
 	OIDCClientSecret string
 	OIDCRedirectURL  string
 	OIDCScopes       []string
+	OIDCRolesClaim   string
 
 	// Proxy configuration
 	UpstreamRoutes    []UpstreamRoute // Multi-upstream configuration
@@ -98,11 +541,37 @@ type Config struct {
 	SessionCookieName string
 	SessionMaxAge     int
 
+	// Concurrent session limits
+	SessionMaxPerUser    int
+	SessionLimitStrategy string
+
+	// Session binding configuration
+	SessionBindingEnabled        bool
+	SessionBindingMode           string
+	SessionBindingIPv4Prefix     *int // nil uses the default of 24
+	SessionBindingIPv6Prefix     *int // nil uses the default of 64
+	SessionBindingCheckUserAgent bool
+
+	// Session cookie attributes
+	SessionCookieSecure   string
+	SessionCookieSameSite string
+	SessionCookieDomain   string
+	SessionCookiePath     string
+	SessionCookiePrefix   string
+
 	// Security configuration
-	AllowedOrigins     []string
-	TLSCertFile        string
-	TLSKeyFile         string
-	InsecureSkipVerify bool
+	AllowedOrigins       []string
+	CORSAllowedMethods   []string
+	CORSAllowedHeaders   []string
+	CORSExposedHeaders   []string
+	CORSAllowCredentials *bool
+	CORSMaxAge           time.Duration
+	SecurityHeaders      SecurityHeadersConfig
+	CSPReportPath        string
+	TrustedProxies       []string
+	TLSCertFile          string
+	TLSKeyFile           string
+	InsecureSkipVerify   bool
 
 	// Logging configuration
 	LogLevel  string
@@ -111,6 +580,27 @@ type Config struct {
 	// Health configuration
 	HealthEnabled        bool
 	HealthCheckUpstreams bool
+	HealthCheck          HealthCheckConfig // Defaults for upstream health checks
+
+	// Gateway token (identity assertion) configuration
+	GatewayTokenEnabled   bool
+	GatewayTokenAlgorithm string
+	GatewayTokenKeyFile   string
+	GatewayTokenKeyID     string
+	GatewayTokenIssuer    string
+	GatewayTokenTTL       time.Duration
+
+	// Rate limiting defaults of all routes
+	RateLimit RateLimitConfig
+
+	// Shared response cache used by routes with caching enabled
+	Cache CacheConfig
+
+	// Admin API configuration
+	AdminEnabled bool
+	AdminHost    string
+	AdminPort    string
+	AdminToken   string
 }
 
 // LoadConfig loads configuration from YAML file
@@ -155,24 +645,62 @@ func LoadFromYAML(filepath string) (*Config, error) {
 
 	// Convert YAML config to internal Config structure
 	config := &Config{
-		Port:                 yamlConfig.Server.Port,
-		Host:                 yamlConfig.Server.Host,
-		OIDCProviderURL:      yamlConfig.OIDC.ProviderURL,
-		OIDCClientID:         yamlConfig.OIDC.ClientID,
-		OIDCClientSecret:     yamlConfig.OIDC.ClientSecret,
-		OIDCRedirectURL:      yamlConfig.OIDC.RedirectURL,
-		UpstreamRoutes:       yamlConfig.Proxy.Routes,
-		SessionSecret:        yamlConfig.Session.Secret,
-		SessionCookieName:    yamlConfig.Session.CookieName,
-		SessionMaxAge:        yamlConfig.Session.MaxAge,
-		AllowedOrigins:       yamlConfig.Security.AllowedOrigins,
-		TLSCertFile:          yamlConfig.TLS.CertFile,
-		TLSKeyFile:           yamlConfig.TLS.KeyFile,
-		InsecureSkipVerify:   yamlConfig.TLS.InsecureSkipVerify,
-		LogLevel:             yamlConfig.Logging.Level,
-		LogFormat:            yamlConfig.Logging.Format,
-		HealthEnabled:        yamlConfig.Health.Enabled,
-		HealthCheckUpstreams: yamlConfig.Health.CheckUpstreams,
+		Port:                         yamlConfig.Server.Port,
+		Host:                         yamlConfig.Server.Host,
+		ServerReadTimeout:            yamlConfig.Server.ReadTimeout,
+		ServerReadHeaderTimeout:      yamlConfig.Server.ReadHeaderTimeout,
+		ServerWriteTimeout:           yamlConfig.Server.WriteTimeout,
+		ServerIdleTimeout:            yamlConfig.Server.IdleTimeout,
+		OIDCProviderURL:              yamlConfig.OIDC.ProviderURL,
+		OIDCClientID:                 yamlConfig.OIDC.ClientID,
+		OIDCClientSecret:             yamlConfig.OIDC.ClientSecret,
+		OIDCRedirectURL:              yamlConfig.OIDC.RedirectURL,
+		OIDCRolesClaim:               yamlConfig.OIDC.RolesClaim,
+		UpstreamRoutes:               yamlConfig.Proxy.Routes,
+		SessionSecret:                yamlConfig.Session.Secret,
+		SessionCookieName:            yamlConfig.Session.CookieName,
+		SessionMaxAge:                yamlConfig.Session.MaxAge,
+		SessionMaxPerUser:            yamlConfig.Session.MaxSessionsPerUser,
+		SessionLimitStrategy:         yamlConfig.Session.LimitStrategy,
+		SessionBindingEnabled:        yamlConfig.Session.Binding.Enabled,
+		SessionBindingMode:           yamlConfig.Session.Binding.Mode,
+		SessionBindingIPv4Prefix:     yamlConfig.Session.Binding.IPv4Prefix,
+		SessionBindingIPv6Prefix:     yamlConfig.Session.Binding.IPv6Prefix,
+		SessionBindingCheckUserAgent: yamlConfig.Session.Binding.CheckUserAgent,
+		SessionCookieSecure:          yamlConfig.Session.Cookie.Secure,
+		SessionCookieSameSite:        yamlConfig.Session.Cookie.SameSite,
+		SessionCookieDomain:          yamlConfig.Session.Cookie.Domain,
+		SessionCookiePath:            yamlConfig.Session.Cookie.Path,
+		SessionCookiePrefix:          yamlConfig.Session.Cookie.Prefix,
+		AllowedOrigins:               yamlConfig.Security.AllowedOrigins,
+		TrustedProxies:               yamlConfig.Security.TrustedProxies,
+		CORSAllowedMethods:           yamlConfig.Security.CORS.AllowedMethods,
+		CORSAllowedHeaders:           yamlConfig.Security.CORS.AllowedHeaders,
+		CORSExposedHeaders:           yamlConfig.Security.CORS.ExposedHeaders,
+		CORSAllowCredentials:         yamlConfig.Security.CORS.AllowCredentials,
+		CORSMaxAge:                   yamlConfig.Security.CORS.MaxAge,
+		SecurityHeaders:              yamlConfig.Security.Headers,
+		CSPReportPath:                yamlConfig.Security.CSPReportPath,
+		TLSCertFile:                  yamlConfig.TLS.CertFile,
+		TLSKeyFile:                   yamlConfig.TLS.KeyFile,
+		InsecureSkipVerify:           yamlConfig.TLS.InsecureSkipVerify,
+		LogLevel:                     yamlConfig.Logging.Level,
+		LogFormat:                    yamlConfig.Logging.Format,
+		HealthEnabled:                yamlConfig.Health.Enabled,
+		HealthCheckUpstreams:         yamlConfig.Health.CheckUpstreams,
+		HealthCheck:                  yamlConfig.Health.HealthCheckConfig,
+		RateLimit:                    yamlConfig.RateLimit,
+		Cache:                        yamlConfig.Cache,
+		GatewayTokenEnabled:          yamlConfig.GatewayToken.Enabled,
+		GatewayTokenAlgorithm:        yamlConfig.GatewayToken.Algorithm,
+		GatewayTokenKeyFile:          yamlConfig.GatewayToken.KeyFile,
+		GatewayTokenKeyID:            yamlConfig.GatewayToken.KeyID,
+		GatewayTokenIssuer:           yamlConfig.GatewayToken.Issuer,
+		GatewayTokenTTL:              yamlConfig.GatewayToken.TTL,
+		AdminEnabled:                 yamlConfig.Admin.Enabled,
+		AdminHost:                    yamlConfig.Admin.Host,
+		AdminPort:                    yamlConfig.Admin.Port,
+		AdminToken:                   yamlConfig.Admin.Token,
 	}
 
 	// Parse OIDC scopes
@@ -184,6 +712,11 @@ func LoadFromYAML(filepath string) (*Config, error) {
 		config.OIDCScopes = scopes
 	}
 
+	// Origins of the CORS policy take precedence over security.allowed_origins
+	if len(yamlConfig.Security.CORS.AllowedOrigins) > 0 {
+		config.AllowedOrigins = yamlConfig.Security.CORS.AllowedOrigins
+	}
+
 	// Set defaults for optional fields
 	config.setDefaults()
 
@@ -217,6 +750,9 @@ func (c *Config) applyEnvironmentOverrides() {
 	if val := os.Getenv("LOG_FORMAT"); val != "" {
 		c.LogFormat = val
 	}
+	if val := os.Getenv("ADMIN_TOKEN"); val != "" {
+		c.AdminToken = val
+	}
 }
 
 // setDefaults sets default values for optional configuration fields
@@ -227,24 +763,109 @@ func (c *Config) setDefaults() {
 	if c.Host == "" {
 		c.Host = "0.0.0.0"
 	}
+	if c.ServerReadHeaderTimeout == 0 {
+		c.ServerReadHeaderTimeout = 10 * time.Second
+	}
+	if c.ServerIdleTimeout == 0 {
+		c.ServerIdleTimeout = 120 * time.Second
+	}
 	if c.SessionCookieName == "" {
 		c.SessionCookieName = "compas-session"
 	}
 	if c.SessionMaxAge == 0 {
 		c.SessionMaxAge = 3600
 	}
+	if c.SessionLimitStrategy == "" {
+		c.SessionLimitStrategy = SessionLimitEvictOldest
+	}
+	if c.SessionCookieSecure == "" {
+		c.SessionCookieSecure = CookieSecureAuto
+	}
+	c.SessionCookieSameSite = strings.ToLower(c.SessionCookieSameSite)
+	if c.SessionCookieSameSite == "" {
+		c.SessionCookieSameSite = CookieSameSiteLax
+	}
+	if c.SessionCookiePath == "" {
+		c.SessionCookiePath = "/"
+	}
+	if c.SessionBindingMode == "" {
+		c.SessionBindingMode = SessionBindingReauthenticate
+	}
 	if len(c.OIDCScopes) == 0 {
 		c.OIDCScopes = []string{"openid", "profile", "email"}
 	}
+	if c.OIDCRolesClaim == "" {
+		c.OIDCRolesClaim = "realm_access.roles"
+	}
 	if len(c.AllowedOrigins) == 0 {
 		c.AllowedOrigins = []string{"*"}
 	}
+	if len(c.CORSAllowedMethods) == 0 {
+		c.CORSAllowedMethods = []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"}
+	}
+	if len(c.CORSAllowedHeaders) == 0 {
+		c.CORSAllowedHeaders = []string{"Content-Type", "Authorization", "X-Requested-With"}
+	}
+	if c.CORSMaxAge == 0 {
+		c.CORSMaxAge = 24 * time.Hour
+	}
+	if c.SecurityHeaders.StrictTransportSecurity == "" {
+		c.SecurityHeaders.StrictTransportSecurity = "max-age=31536000; includeSubDomains"
+	}
+	if c.SecurityHeaders.FrameOptions == "" {
+		c.SecurityHeaders.FrameOptions = "SAMEORIGIN"
+	}
+	if c.SecurityHeaders.ContentTypeOptions == "" {
+		c.SecurityHeaders.ContentTypeOptions = "nosniff"
+	}
+	if c.SecurityHeaders.ReferrerPolicy == "" {
+		c.SecurityHeaders.ReferrerPolicy = "strict-origin-when-cross-origin"
+	}
 	if c.LogLevel == "" {
 		c.LogLevel = "info"
 	}
 	if c.LogFormat == "" {
 		c.LogFormat = "text"
 	}
+	if c.HealthCheck.Path == "" {
+		c.HealthCheck.Path = "/"
+	}
+	if c.HealthCheck.Interval == 0 {
+		c.HealthCheck.Interval = 10 * time.Second
+	}
+	if c.HealthCheck.Timeout == 0 {
+		c.HealthCheck.Timeout = 2 * time.Second
+	}
+	if c.HealthCheck.HealthyThreshold == 0 {
+		c.HealthCheck.HealthyThreshold = 2
+	}
+	if c.HealthCheck.UnhealthyThreshold == 0 {
+		c.HealthCheck.UnhealthyThreshold = 3
+	}
+	if c.GatewayTokenAlgorithm == "" {
+		c.GatewayTokenAlgorithm = SigningAlgorithmRS256
+	}
+	if c.GatewayTokenIssuer == "" {
+		c.GatewayTokenIssuer = "compas-auth-proxy"
+	}
+	if c.GatewayTokenTTL == 0 {
+		c.GatewayTokenTTL = 60 * time.Second
+	}
+	if c.Cache.MaxSize == 0 {
+		c.Cache.MaxSize = 64 * Megabyte
+	}
+	if c.Cache.MaxEntrySize == 0 {
+		c.Cache.MaxEntrySize = 10 * Megabyte
+	}
+	if c.Cache.Disk.MaxSize == 0 {
+		c.Cache.Disk.MaxSize = 1 * Gigabyte
+	}
+	if c.AdminHost == "" {
+		c.AdminHost = "127.0.0.1"
+	}
+	if c.AdminPort == "" {
+		c.AdminPort = "9090"
+	}
 }
 
 // validate checks if all required configuration values are set
@@ -263,17 +884,579 @@ func (c *Config) validate() error {
 		}
 	}
 
+	// Validate server timeouts
+	if c.ServerReadTimeout < 0 || c.ServerReadHeaderTimeout < 0 || c.ServerWriteTimeout < 0 || c.ServerIdleTimeout < 0 {
+		return fmt.Errorf("server timeouts must not be negative")
+	}
+
 	// Validate upstream routes
 	if len(c.UpstreamRoutes) == 0 {
 		return fmt.Errorf("no upstream routes configured. Define proxy.routes in YAML configuration")
 	}
 
+	for _, route := range c.UpstreamRoutes {
+		if err := route.validate(); err != nil {
+			return fmt.Errorf("invalid route %s: %v", route.Path, err)
+		}
+	}
+
+	// Validate security headers
+	if err := validateSecurityHeaders(c.SecurityHeaders); err != nil {
+		return fmt.Errorf("invalid security headers: %v", err)
+	}
+	for _, route := range c.UpstreamRoutes {
+		if err := validateSecurityHeaders(route.SecurityHeaders); err != nil {
+			return fmt.Errorf("invalid route %s: security_headers: %v", route.Path, err)
+		}
+	}
+	if c.CSPReportPath != "" && !strings.HasPrefix(c.CSPReportPath, "/") {
+		return fmt.Errorf("security.csp_report_path must start with /")
+	}
+
+	// Validate rate limits
+	if err := validateRateLimit(c.RateLimit); err != nil {
+		return fmt.Errorf("invalid rate_limit: %v", err)
+	}
+	for _, route := range c.UpstreamRoutes {
+		if err := validateRateLimit(c.RateLimitFor(route)); err != nil {
+			return fmt.Errorf("invalid route %s: rate_limit: %v", route.Path, err)
+		}
+	}
+
+	// Validate the response cache
+	if c.Cache.MaxSize < 0 || c.Cache.MaxEntrySize < 0 || c.Cache.Disk.MaxSize < 0 {
+		return fmt.Errorf("invalid cache: sizes must not be negative")
+	}
+
+	// Validate CORS policies
+	if err := validateCORS(c.CORSFor(UpstreamRoute{})); err != nil {
+		return fmt.Errorf("invalid CORS configuration: %v", err)
+	}
+	for _, route := range c.UpstreamRoutes {
+		if err := validateCORS(c.CORSFor(route)); err != nil {
+			return fmt.Errorf("invalid route %s: cors: %v", route.Path, err)
+		}
+	}
+
+	// Validate upstream health checks
+	if c.HealthCheckUpstreams {
+		if c.HealthCheck.Interval < 0 || c.HealthCheck.Timeout < 0 || c.HealthCheck.HealthyThreshold < 0 || c.HealthCheck.UnhealthyThreshold < 0 {
+			return fmt.Errorf("health check interval, timeout and thresholds must not be negative")
+		}
+	}
+
 	// Validate session secret length
 	if len(c.SessionSecret) < 32 {
 		return fmt.Errorf("session secret must be at least 32 characters long")
 	}
 
+	// Validate concurrent session limits
+	if c.SessionMaxPerUser < 0 {
+		return fmt.Errorf("session.max_sessions_per_user must not be negative")
+	}
+	switch c.SessionLimitStrategy {
+	case "", SessionLimitReject, SessionLimitEvictOldest:
+	default:
+		return fmt.Errorf("invalid session.limit_strategy %q (expected %s or %s)", c.SessionLimitStrategy, SessionLimitReject, SessionLimitEvictOldest)
+	}
+
+	// Validate session cookie attributes
+	if err := c.validateSessionCookie(); err != nil {
+		return err
+	}
+
+	// Validate session binding
+	if c.SessionBindingEnabled {
+		switch c.SessionBindingMode {
+		case SessionBindingReject, SessionBindingReauthenticate:
+		default:
+			return fmt.Errorf("invalid session.binding.mode %q (expected %s or %s)", c.SessionBindingMode, SessionBindingReject, SessionBindingReauthenticate)
+		}
+		ipv4Prefix, ipv6Prefix := c.SessionBindingPrefixes()
+		if ipv4Prefix < 0 || ipv4Prefix > 32 {
+			return fmt.Errorf("session.binding.ipv4_prefix must be between 0 and 32")
+		}
+		if ipv6Prefix < 0 || ipv6Prefix > 128 {
+			return fmt.Errorf("session.binding.ipv6_prefix must be between 0 and 128")
+		}
+	}
+
+	// Validate trusted proxies
+	for _, proxy := range c.TrustedProxies {
+		if !strings.Contains(proxy, "/") {
+			if net.ParseIP(strings.TrimSpace(proxy)) == nil {
+				return fmt.Errorf("invalid trusted proxy address %q", proxy)
+			}
+			continue
+		}
+		if _, _, err := net.ParseCIDR(strings.TrimSpace(proxy)); err != nil {
+			return fmt.Errorf("invalid trusted proxy network %q: %v", proxy, err)
+		}
+	}
+
+	// Validate gateway token configuration
+	if c.GatewayTokenEnabled {
+		switch c.GatewayTokenAlgorithm {
+		case SigningAlgorithmRS256, SigningAlgorithmEdDSA:
+		default:
+			return fmt.Errorf("invalid gateway_token.algorithm %q (expected %s or %s)", c.GatewayTokenAlgorithm, SigningAlgorithmRS256, SigningAlgorithmEdDSA)
+		}
+		if c.GatewayTokenTTL < 0 {
+			return fmt.Errorf("gateway_token.ttl must not be negative")
+		}
+	}
+	for _, route := range c.UpstreamRoutes {
+		if route.Identity.Assertion.Enabled && !c.GatewayTokenEnabled {
+			return fmt.Errorf("route %s forwards an identity assertion but gateway_token is not enabled", route.Path)
+		}
+	}
+
+	// Validate admin API configuration
+	if c.AdminEnabled {
+		if len(c.AdminToken) < 32 {
+			return fmt.Errorf("admin token must be at least 32 characters long when the admin API is enabled")
+		}
+		if c.AdminPort == c.Port {
+			return fmt.Errorf("admin API must listen on a different port than the main server")
+		}
+	}
+
 	return nil
 }
 
-// getEnvOrDefault returns the environment variable value or a default value
+// SessionBindingPrefixes returns the IPv4 and IPv6 prefix lengths within which
+// the client address of a bound session may change. An explicit 0 disables the
+// address check for that family.
+func (c *Config) SessionBindingPrefixes() (ipv4 int, ipv6 int) {
+	ipv4, ipv6 = 24, 64
+	if c.SessionBindingIPv4Prefix != nil {
+		ipv4 = *c.SessionBindingIPv4Prefix
+	}
+	if c.SessionBindingIPv6Prefix != nil {
+		ipv6 = *c.SessionBindingIPv6Prefix
+	}
+	return ipv4, ipv6
+}
+
+// HealthCheckFor returns the health check settings of a route, falling back
+// to the global settings for everything the route does not override
+func (c *Config) HealthCheckFor(route UpstreamRoute) HealthCheckConfig {
+	check := c.HealthCheck
+	if route.HealthCheck.Path != "" {
+		check.Path = route.HealthCheck.Path
+	}
+	if route.HealthCheck.Interval > 0 {
+		check.Interval = route.HealthCheck.Interval
+	}
+	if route.HealthCheck.Timeout > 0 {
+		check.Timeout = route.HealthCheck.Timeout
+	}
+	if route.HealthCheck.HealthyThreshold > 0 {
+		check.HealthyThreshold = route.HealthCheck.HealthyThreshold
+	}
+	if route.HealthCheck.UnhealthyThreshold > 0 {
+		check.UnhealthyThreshold = route.HealthCheck.UnhealthyThreshold
+	}
+	return check
+}
+
+// CORSFor returns the CORS policy of a route, falling back to the global
+// policy for everything the route does not override
+func (c *Config) CORSFor(route UpstreamRoute) CORSConfig {
+	policy := CORSConfig{
+		AllowedOrigins:   c.AllowedOrigins,
+		AllowedMethods:   c.CORSAllowedMethods,
+		AllowedHeaders:   c.CORSAllowedHeaders,
+		ExposedHeaders:   c.CORSExposedHeaders,
+		AllowCredentials: c.CORSAllowCredentials,
+		MaxAge:           c.CORSMaxAge,
+	}
+	if len(route.CORS.AllowedOrigins) > 0 {
+		// Credentials default to the origins of the route unless set explicitly
+		policy.AllowedOrigins = route.CORS.AllowedOrigins
+		policy.AllowCredentials = nil
+	}
+	if len(route.CORS.AllowedMethods) > 0 {
+		policy.AllowedMethods = route.CORS.AllowedMethods
+	}
+	if len(route.CORS.AllowedHeaders) > 0 {
+		policy.AllowedHeaders = route.CORS.AllowedHeaders
+	}
+	if len(route.CORS.ExposedHeaders) > 0 {
+		policy.ExposedHeaders = route.CORS.ExposedHeaders
+	}
+	if route.CORS.AllowCredentials != nil {
+		policy.AllowCredentials = route.CORS.AllowCredentials
+	}
+	if route.CORS.MaxAge > 0 {
+		policy.MaxAge = route.CORS.MaxAge
+	}
+	return policy
+}
+
+// RateLimitFor returns the rate limit of a route, falling back to the global
+// limit for everything the route does not override. The limit is disabled if
+// Requests is 0.
+func (c *Config) RateLimitFor(route UpstreamRoute) RateLimitConfig {
+	if route.RateLimit.Disabled {
+		return RateLimitConfig{}
+	}
+	limit := c.RateLimit
+	if route.RateLimit.Requests > 0 {
+		limit.Requests = route.RateLimit.Requests
+		limit.Burst = route.RateLimit.Burst
+	}
+	if route.RateLimit.Window > 0 {
+		limit.Window = route.RateLimit.Window
+	}
+	if route.RateLimit.Burst > 0 {
+		limit.Burst = route.RateLimit.Burst
+	}
+	if route.RateLimit.Key != "" {
+		limit.Key = route.RateLimit.Key
+	}
+	if route.RateLimit.APIKeyHeader != "" {
+		limit.APIKeyHeader = route.RateLimit.APIKeyHeader
+	}
+	return limit
+}
+
+// validateRateLimit checks a rate limit
+func validateRateLimit(limit RateLimitConfig) error {
+	if limit.Requests < 0 || limit.Burst < 0 || limit.Window < 0 {
+		return fmt.Errorf("requests, burst and window must not be negative")
+	}
+	switch limit.Key {
+	case "", RateLimitKeyUser, RateLimitKeyIP, RateLimitKeyAPIKey:
+	default:
+		return fmt.Errorf("invalid key %q (expected user, ip or api_key)", limit.Key)
+	}
+	return nil
+}
+
+// SecurityHeadersFor returns the security headers of a route, falling back to
+// the global headers for everything the route does not override
+func (c *Config) SecurityHeadersFor(route UpstreamRoute) SecurityHeadersConfig {
+	headers := c.SecurityHeaders
+	override := route.SecurityHeaders
+	for _, field := range []struct{ value, override *string }{
+		{&headers.StrictTransportSecurity, &override.StrictTransportSecurity},
+		{&headers.ContentSecurityPolicy, &override.ContentSecurityPolicy},
+		{&headers.FrameOptions, &override.FrameOptions},
+		{&headers.ContentTypeOptions, &override.ContentTypeOptions},
+		{&headers.ReferrerPolicy, &override.ReferrerPolicy},
+		{&headers.PermissionsPolicy, &override.PermissionsPolicy},
+		{&headers.CrossOriginOpenerPolicy, &override.CrossOriginOpenerPolicy},
+		{&headers.CrossOriginEmbedderPolicy, &override.CrossOriginEmbedderPolicy},
+	} {
+		if *field.override != "" {
+			*field.value = *field.override
+		}
+	}
+	if override.CSPReportOnly != nil {
+		headers.CSPReportOnly = override.CSPReportOnly
+	}
+	return headers
+}
+
+// validateSecurityHeaders checks the values of security headers with a fixed
+// set of allowed values
+func validateSecurityHeaders(headers SecurityHeadersConfig) error {
+	allowed := []struct {
+		name   string
+		value  string
+		values []string
+	}{
+		{"frame_options", headers.FrameOptions, []string{"DENY", "SAMEORIGIN"}},
+		{"content_type_options", headers.ContentTypeOptions, []string{"nosniff"}},
+		{"referrer_policy", headers.ReferrerPolicy, []string{"no-referrer", "no-referrer-when-downgrade", "origin", "origin-when-cross-origin", "same-origin", "strict-origin", "strict-origin-when-cross-origin", "unsafe-url"}},
+		{"cross_origin_opener_policy", headers.CrossOriginOpenerPolicy, []string{"unsafe-none", "same-origin-allow-popups", "same-origin", "noopener-allow-popups"}},
+		{"cross_origin_embedder_policy", headers.CrossOriginEmbedderPolicy, []string{"unsafe-none", "require-corp", "credentialless"}},
+	}
+	for _, header := range allowed {
+		if header.value == "" || header.value == "-" {
+			continue
+		}
+		if !containsString(header.values, header.value) {
+			return fmt.Errorf("invalid %s %q (expected one of %s)", header.name, header.value, strings.Join(header.values, ", "))
+		}
+	}
+	return nil
+}
+
+// validateCORS checks a CORS policy. Origins are "*", an origin such as
+// "https://app.example.com", or a pattern with a leading "*." host label; the
+// scheme and port are optional.
+func validateCORS(policy CORSConfig) error {
+	for _, origin := range policy.AllowedOrigins {
+		if origin == "*" {
+			if policy.AllowCredentials != nil && *policy.AllowCredentials {
+				return fmt.Errorf("allow_credentials cannot be used when any origin is allowed")
+			}
+			continue
+		}
+		host := origin
+		if i := strings.Index(host, "://"); i >= 0 {
+			if scheme := host[:i]; scheme == "" || strings.ContainsAny(scheme, "*/:") {
+				return fmt.Errorf("invalid allowed origin %q", origin)
+			}
+			host = host[i+3:]
+		}
+		if host == "" || strings.Contains(host, "/") || strings.Contains(strings.TrimPrefix(host, "*."), "*") || strings.HasPrefix(host, "*.:") {
+			return fmt.Errorf("invalid allowed origin %q", origin)
+		}
+	}
+	for _, method := range policy.AllowedMethods {
+		if method == "" || strings.ContainsAny(method, " ,") {
+			return fmt.Errorf("invalid allowed method %q", method)
+		}
+	}
+	if policy.MaxAge < 0 {
+		return fmt.Errorf("max_age must not be negative")
+	}
+	return nil
+}
+
+// validate checks the configuration of a single upstream route
+func (r UpstreamRoute) validate() error {
+	if r.Path == "" {
+		return fmt.Errorf("path is required")
+	}
+
+	// The regex is matched against the whole path and the matched part is
+	// replaced by the rewrite, so it must match from the start
+	if r.PathRegex != "" && !strings.HasPrefix(r.PathRegex, "^") {
+		return fmt.Errorf("path_regex must start with ^")
+	}
+	params, err := r.PathParameters()
+	if err != nil {
+		return err
+	}
+	if r.Rewrite != "" && !strings.HasPrefix(r.Rewrite, "/") {
+		return fmt.Errorf("rewrite must start with /")
+	}
+	templates := []string{r.Rewrite}
+	for _, value := range r.Query.Add {
+		templates = append(templates, value)
+	}
+	for _, template := range templates {
+		for _, match := range PathPlaceholder.FindAllStringSubmatch(template, -1) {
+			if !containsString(params, match[1]) {
+				return fmt.Errorf("unknown path parameter {%s}", match[1])
+			}
+		}
+	}
+
+	if err := validateHeaderTemplates(r.RequestHeaders, params); err != nil {
+		return fmt.Errorf("request_headers: %v", err)
+	}
+	if err := validateHeaderTemplates(r.ResponseHeaders, params); err != nil {
+		return fmt.Errorf("response_headers: %v", err)
+	}
+
+	switch r.Identity.Token {
+	case "", TokenForwardNone, TokenForwardAccessToken, TokenForwardIDToken, TokenForwardExchanged, TokenForwardClientCredentials:
+	default:
+		return fmt.Errorf("invalid identity.token %q (expected none, access_token, id_token, exchanged or client_credentials)", r.Identity.Token)
+	}
+	if r.Public {
+		switch r.Identity.Token {
+		case TokenForwardIDToken, TokenForwardExchanged:
+			return fmt.Errorf("identity.token %q needs an authenticated user and cannot be used on a public route", r.Identity.Token)
+		}
+		if r.Identity.Assertion.Enabled {
+			return fmt.Errorf("identity.assertion needs an authenticated user and cannot be used on a public route")
+		}
+	}
+	for claim, header := range r.Identity.Claims {
+		if claim == "" || header == "" {
+			return fmt.Errorf("identity.claims entries need a claim and a header name")
+		}
+	}
+
+	for _, algorithm := range r.Compression.Algorithms {
+		switch algorithm {
+		case CompressionBrotli, CompressionZstd, CompressionGzip:
+		default:
+			return fmt.Errorf("invalid compression algorithm %q (expected br, zstd or gzip)", algorithm)
+		}
+	}
+	if r.Compression.MinSize < 0 {
+		return fmt.Errorf("compression.min_size must not be negative")
+	}
+	for _, contentType := range r.Compression.ContentTypes {
+		if parts := strings.Split(contentType, "/"); len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return fmt.Errorf("invalid compression content type %q", contentType)
+		}
+	}
+
+	if r.Cache.DefaultTTL < 0 {
+		return fmt.Errorf("cache.default_ttl must not be negative")
+	}
+
+	if r.MaxRequestBody < 0 {
+		return fmt.Errorf("max_request_body must not be negative")
+	}
+	for _, contentType := range r.AllowedContentTypes {
+		parts := strings.Split(contentType, "/")
+		if len(parts) != 2 || parts[0] == "" || parts[0] == "*" || parts[1] == "" || strings.ContainsAny(contentType, " ;") {
+			return fmt.Errorf("invalid allowed content type %q", contentType)
+		}
+	}
+
+	for _, host := range r.Match.Hosts {
+		if host == "" || strings.Contains(strings.TrimPrefix(host, "*."), "*") {
+			return fmt.Errorf("invalid match host %q (wildcards are only allowed as *.domain)", host)
+		}
+	}
+	for _, method := range r.Match.Methods {
+		if method == "" || strings.ContainsAny(method, " \t/") {
+			return fmt.Errorf("invalid match method %q", method)
+		}
+	}
+
+	if r.Static.Enabled() {
+		if err := r.validateStatic(); err != nil {
+			return err
+		}
+	} else {
+		if r.UpstreamURL != "" && len(r.Upstreams) > 0 {
+			return fmt.Errorf("upstream_url and upstreams are mutually exclusive")
+		}
+		targets := r.Targets()
+		if len(targets) == 0 {
+			return fmt.Errorf("upstream_url, upstreams or static is required")
+		}
+		for _, target := range targets {
+			if target.URL == "" {
+				return fmt.Errorf("upstream url is required")
+			}
+			if target.Weight < 0 || target.Weight > MaxUpstreamWeight {
+				return fmt.Errorf("weight of upstream %s must be between 0 and %d", target.URL, MaxUpstreamWeight)
+			}
+		}
+	}
+
+	if breaker := r.CircuitBreaker; breaker.Enabled {
+		if breaker.FailureRate < 0 || breaker.FailureRate > 1 {
+			return fmt.Errorf("circuit_breaker.failure_rate must be between 0 and 1")
+		}
+		if breaker.ConsecutiveFailures < 0 || breaker.MinimumRequests < 0 || breaker.HalfOpenRequests < 0 ||
+			breaker.Window < 0 || breaker.OpenDuration < 0 {
+			return fmt.Errorf("circuit_breaker settings must not be negative")
+		}
+	}
+
+	if r.Retry.Attempts < 0 || r.Retry.Backoff < 0 || r.Retry.MaxBackoff < 0 || r.Retry.MaxBodySize < 0 {
+		return fmt.Errorf("retry settings must not be negative")
+	}
+	for _, condition := range r.Retry.RetryOn {
+		if condition == RetryOnConnectError || condition == RetryOnTimeout {
+			continue
+		}
+		if status, err := strconv.Atoi(condition); err != nil || status < 500 || status > 599 {
+			return fmt.Errorf("invalid retry.retry_on %q (expected %s, %s or a 5xx status code)", condition, RetryOnConnectError, RetryOnTimeout)
+		}
+	}
+
+	if (r.TLS.CertFile == "") != (r.TLS.KeyFile == "") {
+		return fmt.Errorf("tls.cert_file and tls.key_file must be set together")
+	}
+	switch r.TLS.MinVersion {
+	case "", TLSVersion10, TLSVersion11, TLSVersion12, TLSVersion13:
+	default:
+		return fmt.Errorf("invalid tls.min_version %q (expected 1.0, 1.1, 1.2 or 1.3)", r.TLS.MinVersion)
+	}
+
+	if t := r.Timeouts; t.Dial < 0 || t.TLSHandshake < 0 || t.ResponseHeader < 0 || t.Idle < 0 || t.Overall < 0 {
+		return fmt.Errorf("timeouts must not be negative")
+	}
+
+	switch r.LoadBalancing {
+	case "", LoadBalanceRoundRobin, LoadBalanceLeastConnections, LoadBalanceWeighted, LoadBalanceConsistentHash:
+	default:
+		return fmt.Errorf("invalid load_balancing %q", r.LoadBalancing)
+	}
+
+	return nil
+}
+
+// validateStatic checks the configuration of a static route
+func (r UpstreamRoute) validateStatic() error {
+	if r.Static.Dir != "" && r.Static.Embedded {
+		return fmt.Errorf("static.dir and static.embedded are mutually exclusive")
+	}
+	if r.UpstreamURL != "" || len(r.Upstreams) > 0 || r.EnableWebSocket {
+		return fmt.Errorf("static routes cannot have upstream_url, upstreams or enable_websocket")
+	}
+	if r.Cache.Enabled || r.Compression.Enabled {
+		return fmt.Errorf("static routes cannot use cache or compression (precompressed files are served instead)")
+	}
+	if strings.Contains(r.Static.Index, "/") {
+		return fmt.Errorf("static.index must be a file name")
+	}
+	if r.Static.HashedAssets != "" {
+		if _, err := regexp.Compile(r.Static.HashedAssets); err != nil {
+			return fmt.Errorf("invalid static.hashed_assets: %v", err)
+		}
+	}
+	return nil
+}
+
+// validateSessionCookie checks that the session cookie attributes form a
+// combination browsers will accept
+func (c *Config) validateSessionCookie() error {
+	switch c.SessionCookieSecure {
+	case "", CookieSecureAuto, CookieSecureTrue, CookieSecureFalse:
+	default:
+		return fmt.Errorf("invalid session.cookie.secure %q (expected auto, true or false)", c.SessionCookieSecure)
+	}
+
+	switch c.SessionCookieSameSite {
+	case "", CookieSameSiteLax, CookieSameSiteStrict:
+	case CookieSameSiteNone:
+		// Browsers drop SameSite=None cookies without Secure, which auto would
+		// omit for plain HTTP requests
+		if c.SessionCookieSecure != CookieSecureTrue {
+			return fmt.Errorf("session.cookie.same_site none requires session.cookie.secure true")
+		}
+	default:
+		return fmt.Errorf("invalid session.cookie.same_site %q (expected lax, strict or none)", c.SessionCookieSameSite)
+	}
+
+	switch c.SessionCookiePrefix {
+	case "":
+	case CookiePrefixSecure:
+		if c.SessionCookieSecure != CookieSecureTrue {
+			return fmt.Errorf("session.cookie.prefix %s requires session.cookie.secure true", CookiePrefixSecure)
+		}
+	case CookiePrefixHost:
+		if c.SessionCookieSecure != CookieSecureTrue {
+			return fmt.Errorf("session.cookie.prefix %s requires session.cookie.secure true", CookiePrefixHost)
+		}
+		if c.SessionCookieDomain != "" {
+			return fmt.Errorf("session.cookie.prefix %s does not allow a cookie domain", CookiePrefixHost)
+		}
+		if c.SessionCookiePath != "" && c.SessionCookiePath != "/" {
+			return fmt.Errorf("session.cookie.prefix %s requires cookie path /", CookiePrefixHost)
+		}
+	default:
+		return fmt.Errorf("invalid session.cookie.prefix %q (expected %s or %s)", c.SessionCookiePrefix, CookiePrefixHost, CookiePrefixSecure)
+	}
+
+	if c.SessionCookiePath != "" && !strings.HasPrefix(c.SessionCookiePath, "/") {
+		return fmt.Errorf("session.cookie.path must start with /")
+	}
+
+	return nil
+}
+
+// containsString reports whether value is part of values
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
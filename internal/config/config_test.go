@@ -4,6 +4,7 @@ import (
 	"os"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestLoadFromYAML(t *testing.T) {
@@ -24,6 +25,9 @@ session:
   secret: "test-session-secret-very-long-to-meet-32-char-requirement"
   cookie_name: "test-session"
   max_age: 7200
+  binding:
+    enabled: true
+    ipv4_prefix: 0
 
 proxy:
   routes:
@@ -98,6 +102,11 @@ health:
 	if config.LogFormat != "json" {
 		t.Errorf("Expected log format json, got %s", config.LogFormat)
 	}
+
+	// An explicit prefix of 0 is kept, the unset one gets its default
+	if ipv4Prefix, ipv6Prefix := config.SessionBindingPrefixes(); ipv4Prefix != 0 || ipv6Prefix != 64 {
+		t.Errorf("Expected session binding prefixes 0 and 64, got %d and %d", ipv4Prefix, ipv6Prefix)
+	}
 }
 
 func TestEnvironmentOverrides(t *testing.T) {
@@ -305,4 +314,260 @@ func TestConfigValidation(t *testing.T) {
 	if err == nil {
 		t.Error("Expected validation to fail for short session secret")
 	}
+
+	// Test with invalid session limit strategy
+	config.SessionSecret = "very-long-session-secret-that-meets-minimum-requirements"
+	config.SessionLimitStrategy = "kick_everyone"
+	err = config.validate()
+	if err == nil {
+		t.Error("Expected validation to fail for unknown session limit strategy")
+	}
+
+	// Test with an identity assertion but no gateway token key
+	config.SessionLimitStrategy = ""
+	config.UpstreamRoutes[0].Identity.Assertion.Enabled = true
+	err = config.validate()
+	if err == nil {
+		t.Error("Expected validation to fail for an assertion without gateway_token")
+	}
+
+	// Test with an unknown signing algorithm
+	config.GatewayTokenEnabled = true
+	config.GatewayTokenAlgorithm = "HS256"
+	err = config.validate()
+	if err == nil {
+		t.Error("Expected validation to fail for unknown gateway_token.algorithm")
+	}
+
+	// Test with a negative cache size
+	config.GatewayTokenAlgorithm = SigningAlgorithmRS256
+	config.Cache.Disk.MaxSize = -1
+	err = config.validate()
+	if err == nil {
+		t.Error("Expected validation to fail for negative cache.disk.max_size")
+	}
+}
+
+func TestSessionCookieValidation(t *testing.T) {
+	testCases := []struct {
+		name    string
+		cookie  CookieConfig
+		wantErr bool
+	}{
+		{"defaults", CookieConfig{}, false},
+		{"host prefix", CookieConfig{Secure: "true", Prefix: "__Host-"}, false},
+		{"host prefix with auto secure", CookieConfig{Secure: "auto", Prefix: "__Host-"}, true},
+		{"host prefix with domain", CookieConfig{Secure: "true", Prefix: "__Host-", Domain: "example.com"}, true},
+		{"host prefix with path", CookieConfig{Secure: "true", Prefix: "__Host-", Path: "/app"}, true},
+		{"secure prefix", CookieConfig{Secure: "true", Prefix: "__Secure-", Domain: "example.com"}, false},
+		{"secure prefix without secure", CookieConfig{Secure: "false", Prefix: "__Secure-"}, true},
+		{"same site none without secure", CookieConfig{Secure: "false", SameSite: "None"}, true},
+		{"same site none with auto secure", CookieConfig{Secure: "auto", SameSite: "None"}, true},
+		{"same site none with default secure", CookieConfig{SameSite: "None"}, true},
+		{"same site none", CookieConfig{Secure: "true", SameSite: "None"}, false},
+		{"unknown same site", CookieConfig{SameSite: "sometimes"}, true},
+		{"unknown prefix", CookieConfig{Secure: "true", Prefix: "__Custom-"}, true},
+	}
+
+	for _, tc := range testCases {
+		config := &Config{
+			SessionCookieSecure:   tc.cookie.Secure,
+			SessionCookieSameSite: tc.cookie.SameSite,
+			SessionCookieDomain:   tc.cookie.Domain,
+			SessionCookiePath:     tc.cookie.Path,
+			SessionCookiePrefix:   tc.cookie.Prefix,
+		}
+		config.setDefaults()
+
+		err := config.validateSessionCookie()
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: expected error %v, got %v", tc.name, tc.wantErr, err)
+		}
+	}
+}
+
+func TestRouteValidation(t *testing.T) {
+	testCases := []struct {
+		name  string
+		route UpstreamRoute
+		valid bool
+	}{
+		{"plain prefix", UpstreamRoute{Path: "/api"}, true},
+		{"template rewrite", UpstreamRoute{Path: "/api/v1/scl/{type}/{id}", Rewrite: "/scl/v2/{type}/{id}"}, true},
+		{"regex parameters", UpstreamRoute{Path: "/api", PathRegex: `^/api/(?P<id>\d+)`, Rewrite: "/items/{id}"}, true},
+		{"query parameter template", UpstreamRoute{Path: "/api/{type}", Query: QueryRewriteConfig{Add: map[string]string{"type": "{type}"}}}, true},
+		{"unknown rewrite parameter", UpstreamRoute{Path: "/api/{type}", Rewrite: "/scl/{id}"}, false},
+		{"partial segment placeholder", UpstreamRoute{Path: "/api/v{version}"}, false},
+		{"upstream weights", UpstreamRoute{Path: "/api", Upstreams: []UpstreamTarget{{URL: "http://a", Weight: 100}, {URL: "http://b"}}}, true},
+		{"negative upstream weight", UpstreamRoute{Path: "/api", Upstreams: []UpstreamTarget{{URL: "http://a", Weight: -1}}}, false},
+		{"excessive upstream weight", UpstreamRoute{Path: "/api", Upstreams: []UpstreamTarget{{URL: "http://a", Weight: 1000000}}}, false},
+		{"invalid regex", UpstreamRoute{Path: "/api", PathRegex: "^(unclosed"}, false},
+		{"unanchored regex", UpstreamRoute{Path: "/api", PathRegex: `/(?P<id>\d+)$`, Rewrite: "/items/{id}"}, false},
+		{"relative rewrite", UpstreamRoute{Path: "/api", Rewrite: "scl"}, false},
+		{"header templates", UpstreamRoute{Path: "/api/{id}", RequestHeaders: HeaderRulesConfig{Set: map[string]string{"X-Item": "${param.id}", "X-Roles": "${user.roles}"}}}, true},
+		{"unknown header variable", UpstreamRoute{Path: "/api", ResponseHeaders: HeaderRulesConfig{Add: map[string]string{"X-Id": "${param.id}"}}}, false},
+		{"identity mapping", UpstreamRoute{Path: "/", Identity: IdentityConfig{UserHeader: "X-User", Claims: map[string]string{"groups": "X-Groups"}, Token: TokenForwardIDToken}}, true},
+		{"unknown token mode", UpstreamRoute{Path: "/", Identity: IdentityConfig{Token: "refresh_token"}}, false},
+		{"public client credentials", UpstreamRoute{Path: "/", Public: true, Identity: IdentityConfig{Token: TokenForwardClientCredentials, Scopes: []string{"read"}}}, true},
+		{"public exchanged token", UpstreamRoute{Path: "/", Public: true, Identity: IdentityConfig{Token: TokenForwardExchanged}}, false},
+		{"public identity assertion", UpstreamRoute{Path: "/", Public: true, Identity: IdentityConfig{Assertion: AssertionConfig{Enabled: true}}}, false},
+		{"body limits", UpstreamRoute{Path: "/", MaxRequestBody: 10 * Megabyte, AllowedContentTypes: []string{"application/xml", "image/*"}}, true},
+		{"negative body limit", UpstreamRoute{Path: "/", MaxRequestBody: -1}, false},
+		{"content type without subtype", UpstreamRoute{Path: "/", AllowedContentTypes: []string{"application"}}, false},
+		{"content type with parameters", UpstreamRoute{Path: "/", AllowedContentTypes: []string{"text/xml; charset=utf-8"}}, false},
+		{"compression", UpstreamRoute{Path: "/", Compression: CompressionConfig{Enabled: true, Algorithms: []string{"zstd", "gzip"}, MinSize: 512, ContentTypes: []string{"text/*", "application/*+json"}}}, true},
+		{"unknown compression algorithm", UpstreamRoute{Path: "/", Compression: CompressionConfig{Enabled: true, Algorithms: []string{"deflate"}}}, false},
+		{"negative compression min size", UpstreamRoute{Path: "/", Compression: CompressionConfig{Enabled: true, MinSize: -1}}, false},
+		{"cache", UpstreamRoute{Path: "/", Cache: RouteCacheConfig{Enabled: true, Authorized: true, DefaultTTL: time.Hour}}, true},
+		{"negative cache ttl", UpstreamRoute{Path: "/", Cache: RouteCacheConfig{Enabled: true, DefaultTTL: -time.Second}}, false},
+		{"invalid compression content type", UpstreamRoute{Path: "/", Compression: CompressionConfig{Enabled: true, ContentTypes: []string{"json"}}}, false},
+		{"identity assertion", UpstreamRoute{Path: "/", Identity: IdentityConfig{Assertion: AssertionConfig{Enabled: true, Audience: "backend"}}}, true},
+		{"wildcard host", UpstreamRoute{Path: "/", Match: RouteMatchConfig{Hosts: []string{"*.example.com"}}}, true},
+		{"inner wildcard host", UpstreamRoute{Path: "/", Match: RouteMatchConfig{Hosts: []string{"api.*.com"}}}, false},
+		{"retry on status", UpstreamRoute{Path: "/", Retry: RetryConfig{Attempts: 3, RetryOn: []string{"timeout", "503"}}}, true},
+		{"retry on client error", UpstreamRoute{Path: "/", Retry: RetryConfig{Attempts: 3, RetryOn: []string{"404"}}}, false},
+		{"negative timeout", UpstreamRoute{Path: "/", Timeouts: TimeoutConfig{Dial: -1}}, false},
+		{"client cert without key", UpstreamRoute{Path: "/", TLS: UpstreamTLSConfig{CertFile: "client.pem"}}, false},
+		{"unknown TLS version", UpstreamRoute{Path: "/", TLS: UpstreamTLSConfig{MinVersion: "1.4"}}, false},
+	}
+
+	for _, tc := range testCases {
+		if len(tc.route.Upstreams) == 0 {
+			tc.route.UpstreamURL = "http://backend"
+		}
+		err := tc.route.validate()
+		if tc.valid && err != nil {
+			t.Errorf("%s: expected route to be valid, got %v", tc.name, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("%s: expected validation to fail", tc.name)
+		}
+	}
+}
+
+func TestStaticRouteValidation(t *testing.T) {
+	testCases := []struct {
+		name  string
+		route UpstreamRoute
+		valid bool
+	}{
+		{"static directory", UpstreamRoute{Path: "/", Static: StaticConfig{Dir: "/srv/compas", SPA: true, HashedAssets: `-[A-Za-z0-9]{8}\.`}}, true},
+		{"embedded bundle", UpstreamRoute{Path: "/", Static: StaticConfig{Embedded: true}, Public: true}, true},
+		{"directory and embedded bundle", UpstreamRoute{Path: "/", Static: StaticConfig{Dir: "/srv/compas", Embedded: true}}, false},
+		{"upstream", UpstreamRoute{Path: "/", UpstreamURL: "http://backend", Static: StaticConfig{Dir: "/srv/compas"}}, false},
+		{"websocket", UpstreamRoute{Path: "/", EnableWebSocket: true, Static: StaticConfig{Dir: "/srv/compas"}}, false},
+		{"cache", UpstreamRoute{Path: "/", Static: StaticConfig{Dir: "/srv/compas"}, Cache: RouteCacheConfig{Enabled: true}}, false},
+		{"index with path", UpstreamRoute{Path: "/", Static: StaticConfig{Dir: "/srv/compas", Index: "app/index.html"}}, false},
+		{"invalid hashed assets pattern", UpstreamRoute{Path: "/", Static: StaticConfig{Dir: "/srv/compas", HashedAssets: "("}}, false},
+		{"neither upstream nor static", UpstreamRoute{Path: "/"}, false},
+	}
+
+	for _, tc := range testCases {
+		err := tc.route.validate()
+		if tc.valid && err != nil {
+			t.Errorf("%s: expected route to be valid, got %v", tc.name, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("%s: expected validation to fail", tc.name)
+		}
+	}
+}
+
+func TestCORSValidation(t *testing.T) {
+	allow := true
+	testCases := []struct {
+		name    string
+		policy  CORSConfig
+		wantErr bool
+	}{
+		{"any origin", CORSConfig{AllowedOrigins: []string{"*"}}, false},
+		{"exact and wildcard origins", CORSConfig{AllowedOrigins: []string{"https://app.example.com", "https://*.example.com:8443", "*.compas.org"}}, false},
+		{"credentials with any origin", CORSConfig{AllowedOrigins: []string{"*"}, AllowCredentials: &allow}, true},
+		{"origin with path", CORSConfig{AllowedOrigins: []string{"https://app.example.com/ui"}}, true},
+		{"wildcard inside host", CORSConfig{AllowedOrigins: []string{"https://app.*.example.com"}}, true},
+		{"wildcard scheme", CORSConfig{AllowedOrigins: []string{"*://app.example.com"}}, true},
+		{"invalid method", CORSConfig{AllowedMethods: []string{"GET, POST"}}, true},
+		{"negative max age", CORSConfig{MaxAge: -time.Second}, true},
+	}
+
+	for _, tc := range testCases {
+		err := validateCORS(tc.policy)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: expected error=%v, got %v", tc.name, tc.wantErr, err)
+		}
+	}
+}
+
+func TestCORSForRoute(t *testing.T) {
+	config := &Config{
+		AllowedOrigins:     []string{"https://app.example.com"},
+		CORSAllowedMethods: []string{"GET"},
+		CORSMaxAge:         time.Hour,
+	}
+	policy := config.CORSFor(UpstreamRoute{CORS: CORSConfig{AllowedMethods: []string{"PUT"}, ExposedHeaders: []string{"ETag"}}})
+
+	if len(policy.AllowedOrigins) != 1 || policy.AllowedOrigins[0] != "https://app.example.com" || policy.MaxAge != time.Hour {
+		t.Errorf("Expected global origins and max age, got %+v", policy)
+	}
+	if len(policy.AllowedMethods) != 1 || policy.AllowedMethods[0] != "PUT" || len(policy.ExposedHeaders) != 1 {
+		t.Errorf("Expected route methods and exposed headers, got %+v", policy)
+	}
+}
+
+func TestSecurityHeadersForRoute(t *testing.T) {
+	config := &Config{}
+	config.setDefaults()
+
+	headers := config.SecurityHeadersFor(UpstreamRoute{SecurityHeaders: SecurityHeadersConfig{FrameOptions: "-", ContentSecurityPolicy: "default-src 'self'"}})
+	if headers.FrameOptions != "-" || headers.ContentSecurityPolicy != "default-src 'self'" {
+		t.Errorf("Expected route overrides, got %+v", headers)
+	}
+	if headers.ContentTypeOptions != "nosniff" || headers.ReferrerPolicy != "strict-origin-when-cross-origin" {
+		t.Errorf("Expected global defaults, got %+v", headers)
+	}
+
+	if err := validateSecurityHeaders(SecurityHeadersConfig{FrameOptions: "ALLOW-FROM https://example.com"}); err == nil {
+		t.Error("Expected validation to fail for unsupported frame_options")
+	}
+	if err := validateSecurityHeaders(SecurityHeadersConfig{CrossOriginEmbedderPolicy: "require-corp", ReferrerPolicy: "-"}); err != nil {
+		t.Errorf("Expected valid security headers, got %v", err)
+	}
+}
+
+func TestRateLimitForRoute(t *testing.T) {
+	config := &Config{RateLimit: RateLimitConfig{Requests: 100, Window: time.Minute, Burst: 150, Key: RateLimitKeyUser}}
+
+	limit := config.RateLimitFor(UpstreamRoute{RateLimit: RateLimitConfig{Requests: 10, Key: RateLimitKeyIP}})
+	if limit.Requests != 10 || limit.Burst != 0 || limit.Window != time.Minute || limit.Key != RateLimitKeyIP {
+		t.Errorf("Expected route limit with global window, got %+v", limit)
+	}
+	if limit := config.RateLimitFor(UpstreamRoute{}); limit.Requests != 100 || limit.Burst != 150 {
+		t.Errorf("Expected global limit, got %+v", limit)
+	}
+	if limit := config.RateLimitFor(UpstreamRoute{RateLimit: RateLimitConfig{Disabled: true}}); limit.Requests != 0 {
+		t.Errorf("Expected disabled limit, got %+v", limit)
+	}
+
+	if err := validateRateLimit(RateLimitConfig{Requests: 10, Key: "session"}); err == nil {
+		t.Error("Expected validation to fail for unknown key")
+	}
+	if err := validateRateLimit(RateLimitConfig{Requests: -1}); err == nil {
+		t.Error("Expected validation to fail for negative requests")
+	}
+}
+
+func TestByteSizeString(t *testing.T) {
+	testCases := map[ByteSize]string{
+		0:                   "0B",
+		512:                 "512B",
+		64 * Kilobyte:       "64KB",
+		10 * Megabyte:       "10MB",
+		2 * Gigabyte:        "2GB",
+		Megabyte + Kilobyte: "1025KB",
+	}
+	for size, expected := range testCases {
+		if got := size.String(); got != expected {
+			t.Errorf("Expected %d bytes to format as %s, got %s", int64(size), expected, got)
+		}
+	}
 }
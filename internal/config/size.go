@@ -0,0 +1,79 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ByteSize is a size in bytes that can be written in YAML either as a plain
+// number of bytes or with a binary unit suffix, e.g. 512KB, 10MB or 1GB
+type ByteSize int64
+
+// Byte size units (binary multiples)
+const (
+	Byte     ByteSize = 1
+	Kilobyte          = 1024 * Byte
+	Megabyte          = 1024 * Kilobyte
+	Gigabyte          = 1024 * Megabyte
+)
+
+// UnmarshalYAML implements yaml.Unmarshaler
+func (s *ByteSize) UnmarshalYAML(value *yaml.Node) error {
+	size, err := ParseByteSize(value.Value)
+	if err != nil {
+		return err
+	}
+	*s = size
+	return nil
+}
+
+// ParseByteSize parses a size such as "1048576", "512KB", "10MB" or "1G"
+func ParseByteSize(value string) (ByteSize, error) {
+	value = strings.TrimSpace(value)
+	upper := strings.ToUpper(value)
+
+	units := []struct {
+		suffix     string
+		multiplier ByteSize
+	}{
+		{"GIB", Gigabyte}, {"MIB", Megabyte}, {"KIB", Kilobyte},
+		{"GB", Gigabyte}, {"MB", Megabyte}, {"KB", Kilobyte},
+		{"G", Gigabyte}, {"M", Megabyte}, {"K", Kilobyte},
+		{"B", Byte},
+	}
+
+	multiplier := Byte
+	number := upper
+	for _, unit := range units {
+		if strings.HasSuffix(upper, unit.suffix) {
+			multiplier = unit.multiplier
+			number = strings.TrimSpace(strings.TrimSuffix(upper, unit.suffix))
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return ByteSize(n) * multiplier, nil
+}
+
+// String formats the size with the largest unit that represents it exactly
+func (s ByteSize) String() string {
+	units := []struct {
+		suffix     string
+		multiplier ByteSize
+	}{
+		{"GB", Gigabyte}, {"MB", Megabyte}, {"KB", Kilobyte},
+	}
+	for _, unit := range units {
+		if s != 0 && s%unit.multiplier == 0 {
+			return strconv.FormatInt(int64(s/unit.multiplier), 10) + unit.suffix
+		}
+	}
+	return strconv.FormatInt(int64(s), 10) + "B"
+}
@@ -0,0 +1,211 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ase-compas/compas-auth-proxy/internal/config"
+)
+
+// AdminHandler serves the administrative API for session management
+type AdminHandler struct {
+	config       *config.Config
+	sessionStore SessionStore
+}
+
+// SessionSummary is the admin API representation of a session
+type SessionSummary struct {
+	ID                string    `json:"id"`
+	Sub               string    `json:"sub"`
+	PreferredUsername string    `json:"preferred_username"`
+	Email             string    `json:"email"`
+	CreatedAt         time.Time `json:"created_at"`
+	LastSeen          time.Time `json:"last_seen"`
+	ExpiresAt         time.Time `json:"expires_at"`
+	IPAddress         string    `json:"ip_address"`
+	UserAgent         string    `json:"user_agent"`
+}
+
+// NewAdminHandler creates a new admin API handler
+func NewAdminHandler(cfg *config.Config, sessionStore SessionStore) *AdminHandler {
+	return &AdminHandler{
+		config:       cfg,
+		sessionStore: sessionStore,
+	}
+}
+
+// Handler returns the authenticated admin API handler
+//
+//	GET    /admin/sessions[?sub=<sub>]      list sessions
+//	DELETE /admin/sessions/<id>             revoke a single session
+//	DELETE /admin/users/<sub>/sessions      revoke all sessions of a user
+func (a *AdminHandler) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/sessions", a.handleListSessions)
+	mux.HandleFunc("/admin/sessions/", a.handleRevokeSession)
+	mux.HandleFunc("/admin/users/", a.handleRevokeUserSessions)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.authorized(r) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// authorized checks the bearer token of an admin request
+func (a *AdminHandler) authorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" || a.config.AdminToken == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(a.config.AdminToken)) == 1
+}
+
+// handleListSessions lists all sessions, optionally filtered by subject
+func (a *AdminHandler) handleListSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var entries []SessionEntry
+	var err error
+	if sub := r.URL.Query().Get("sub"); sub != "" {
+		entries, err = a.sessionStore.ListByUser(sub)
+	} else {
+		entries, err = a.sessionStore.List()
+	}
+	if err != nil {
+		log.Printf("Admin: failed to list sessions: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to list sessions")
+		return
+	}
+
+	sessions := make([]SessionSummary, 0, len(entries))
+	for _, entry := range entries {
+		sessions = append(sessions, summarizeSession(entry))
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"sessions": sessions,
+		"count":    len(sessions),
+	})
+}
+
+// handleRevokeSession revokes a single session by its public ID
+func (a *AdminHandler) handleRevokeSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	publicID := strings.TrimPrefix(r.URL.Path, "/admin/sessions/")
+	if publicID == "" || strings.Contains(publicID, "/") {
+		writeJSONError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	entries, err := a.sessionStore.List()
+	if err != nil {
+		log.Printf("Admin: failed to list sessions: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to list sessions")
+		return
+	}
+
+	for _, entry := range entries {
+		if subtle.ConstantTimeCompare([]byte(publicSessionID(entry.ID)), []byte(publicID)) != 1 {
+			continue
+		}
+		if err := a.sessionStore.Delete(entry.ID); err != nil {
+			log.Printf("Admin: failed to revoke session %s: %v", publicID, err)
+			writeJSONError(w, http.StatusInternalServerError, "failed to revoke session")
+			return
+		}
+		log.Printf("Admin: revoked session %s of user %s", publicID, sessionSubject(&entry.Data))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	writeJSONError(w, http.StatusNotFound, "session not found")
+}
+
+// handleRevokeUserSessions revokes all sessions of a subject
+func (a *AdminHandler) handleRevokeUserSessions(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.EscapedPath(), "/admin/users/")
+	if !strings.HasSuffix(rest, "/sessions") {
+		writeJSONError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if r.Method != http.MethodDelete {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	sub, err := url.PathUnescape(strings.TrimSuffix(rest, "/sessions"))
+	if err != nil || sub == "" {
+		writeJSONError(w, http.StatusBadRequest, "invalid subject")
+		return
+	}
+
+	count, err := a.sessionStore.DeleteByUser(sub)
+	if err != nil {
+		log.Printf("Admin: failed to revoke sessions of user %s: %v", sub, err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to revoke sessions")
+		return
+	}
+	log.Printf("Admin: revoked %d sessions of user %s", count, sub)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"sub":     sub,
+		"revoked": count,
+	})
+}
+
+// summarizeSession converts a session entry into its admin API representation
+func summarizeSession(entry SessionEntry) SessionSummary {
+	summary := SessionSummary{
+		ID:        publicSessionID(entry.ID),
+		CreatedAt: entry.Data.CreatedAt,
+		LastSeen:  entry.Data.LastSeen,
+		ExpiresAt: entry.Data.ExpiresAt,
+		IPAddress: entry.Data.IPAddress,
+		UserAgent: entry.Data.UserAgent,
+	}
+	if userInfo := entry.Data.UserInfo; userInfo != nil {
+		summary.Sub = userInfo.Sub
+		summary.PreferredUsername = userInfo.PreferredUsername
+		summary.Email = userInfo.Email
+	}
+	return summary
+}
+
+// publicSessionID derives a stable identifier for a session that does not
+// reveal the session cookie value
+func publicSessionID(sessionID string) string {
+	sum := sha256.Sum256([]byte(sessionID))
+	return hex.EncodeToString(sum[:16])
+}
+
+// writeJSON writes a JSON response with the given status code
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("Failed to encode JSON response: %v", err)
+	}
+}
+
+// writeJSONError writes a JSON error response
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,88 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ase-compas/compas-auth-proxy/internal/config"
+)
+
+const testAdminToken = "admin-token-that-is-long-enough-for-validation"
+
+func TestAdminAPI(t *testing.T) {
+	store := NewMemorySessionStore()
+	defer store.Close()
+
+	now := time.Now()
+	store.Set("session-a", newTestSession("alice", now))
+	store.Set("session-b", newTestSession("alice", now))
+	store.Set("session-c", newTestSession("bob", now))
+
+	handler := NewAdminHandler(&config.Config{AdminToken: testAdminToken}, store).Handler()
+
+	do := func(method, path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Requests without a valid token are rejected
+	if rec := do(http.MethodGet, "/admin/sessions", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without token, got %d", rec.Code)
+	}
+	if rec := do(http.MethodGet, "/admin/sessions", "wrong"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 with wrong token, got %d", rec.Code)
+	}
+	for _, authorization := range []string{testAdminToken, "Basic " + testAdminToken, "bearer" + testAdminToken} {
+		req := httptest.NewRequest(http.MethodGet, "/admin/sessions", nil)
+		req.Header.Set("Authorization", authorization)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("Expected 401 for Authorization %q without Bearer scheme, got %d", authorization, rec.Code)
+		}
+	}
+
+	// Listing does not expose raw session IDs
+	rec := do(http.MethodGet, "/admin/sessions?sub=alice", testAdminToken)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200 listing sessions, got %d", rec.Code)
+	}
+	var list struct {
+		Sessions []SessionSummary `json:"sessions"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&list); err != nil {
+		t.Fatalf("Failed to decode session list: %v", err)
+	}
+	if len(list.Sessions) != 2 {
+		t.Fatalf("Expected 2 sessions for alice, got %d", len(list.Sessions))
+	}
+	for _, session := range list.Sessions {
+		if session.ID == "session-a" || session.ID == "session-b" {
+			t.Errorf("Admin API leaked raw session ID %s", session.ID)
+		}
+	}
+
+	// Revoke a single session by its public ID
+	if rec := do(http.MethodDelete, "/admin/sessions/"+publicSessionID("session-c"), testAdminToken); rec.Code != http.StatusNoContent {
+		t.Errorf("Expected 204 revoking session, got %d", rec.Code)
+	}
+	if rec := do(http.MethodDelete, "/admin/sessions/unknown", testAdminToken); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 revoking unknown session, got %d", rec.Code)
+	}
+
+	// Revoke all sessions of a user
+	if rec := do(http.MethodDelete, "/admin/users/alice/sessions", testAdminToken); rec.Code != http.StatusOK {
+		t.Errorf("Expected 200 revoking user sessions, got %d", rec.Code)
+	}
+	if store.Size() != 0 {
+		t.Errorf("Expected all sessions to be revoked, %d remaining", store.Size())
+	}
+}
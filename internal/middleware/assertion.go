@@ -0,0 +1,215 @@
+package middleware
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/ase-compas/compas-auth-proxy/internal/config"
+)
+
+// errAssertionSignerUnavailable is returned when a route forwards an identity
+// assertion but no signer has been configured
+var errAssertionSignerUnavailable = errors.New("gateway token signing is not configured")
+
+// AssertionSigner issues short-lived JWTs asserting the identity of the
+// authenticated user to upstreams
+type AssertionSigner struct {
+	algorithm string
+	keyID     string
+	issuer    string
+	ttl       time.Duration
+	key       crypto.Signer
+	now       func() time.Time
+}
+
+// NewAssertionSigner creates the signer for gateway tokens. It returns nil if
+// gateway tokens are disabled.
+func NewAssertionSigner(cfg *config.Config) (*AssertionSigner, error) {
+	if !cfg.GatewayTokenEnabled {
+		return nil, nil
+	}
+
+	var key crypto.Signer
+	var err error
+	if cfg.GatewayTokenKeyFile != "" {
+		key, err = loadSigningKey(cfg.GatewayTokenKeyFile)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		log.Printf("WARNING: No gateway_token.key_file configured, generating an ephemeral %s signing key", cfg.GatewayTokenAlgorithm)
+		key, err = generateSigningKey(cfg.GatewayTokenAlgorithm)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch key.(type) {
+	case *rsa.PrivateKey:
+		if cfg.GatewayTokenAlgorithm != config.SigningAlgorithmRS256 {
+			return nil, fmt.Errorf("gateway token key is an RSA key but algorithm is %s", cfg.GatewayTokenAlgorithm)
+		}
+	case ed25519.PrivateKey:
+		if cfg.GatewayTokenAlgorithm != config.SigningAlgorithmEdDSA {
+			return nil, fmt.Errorf("gateway token key is an Ed25519 key but algorithm is %s", cfg.GatewayTokenAlgorithm)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported gateway token key type %T", key)
+	}
+
+	keyID := cfg.GatewayTokenKeyID
+	if keyID == "" {
+		der, err := x509.MarshalPKIXPublicKey(key.Public())
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode gateway token public key: %w", err)
+		}
+		sum := sha256.Sum256(der)
+		keyID = base64.RawURLEncoding.EncodeToString(sum[:16])
+	}
+
+	return &AssertionSigner{
+		algorithm: cfg.GatewayTokenAlgorithm,
+		keyID:     keyID,
+		issuer:    cfg.GatewayTokenIssuer,
+		ttl:       cfg.GatewayTokenTTL,
+		key:       key,
+		now:       time.Now,
+	}, nil
+}
+
+// loadSigningKey reads a PEM encoded PKCS#8 or PKCS#1 private key
+func loadSigningKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read gateway token key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in gateway token key %s", path)
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse gateway token key: %w", err)
+		}
+		return key, nil
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse gateway token key: %w", err)
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported gateway token key type %T", key)
+		}
+		return signer, nil
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q in gateway token key %s", block.Type, path)
+	}
+}
+
+// generateSigningKey creates a new key for the algorithm
+func generateSigningKey(algorithm string) (crypto.Signer, error) {
+	if algorithm == config.SigningAlgorithmEdDSA {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	}
+	return rsa.GenerateKey(rand.Reader, 2048)
+}
+
+// Sign issues a token with the given claims. The issuer, issue time, expiry
+// and token ID are added by the signer.
+func (s *AssertionSigner) Sign(claims map[string]interface{}) (string, error) {
+	jti, err := randomToken(16)
+	if err != nil {
+		return "", err
+	}
+	now := s.now()
+
+	payload := make(map[string]interface{}, len(claims)+5)
+	for name, value := range claims {
+		payload[name] = value
+	}
+	payload["iss"] = s.issuer
+	payload["iat"] = now.Unix()
+	payload["nbf"] = now.Unix()
+	payload["exp"] = now.Add(s.ttl).Unix()
+	payload["jti"] = jti
+
+	header, err := json.Marshal(map[string]string{"alg": s.algorithm, "typ": "JWT", "kid": s.keyID})
+	if err != nil {
+		return "", err
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(body)
+
+	var signature []byte
+	switch key := s.key.(type) {
+	case *rsa.PrivateKey:
+		digest := sha256.Sum256([]byte(signingInput))
+		signature, err = rsa.SignPKCS1v15(nil, key, crypto.SHA256, digest[:])
+		if err != nil {
+			return "", fmt.Errorf("failed to sign gateway token: %w", err)
+		}
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(key, []byte(signingInput))
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// jwk is the JSON Web Key representation of a public key
+type jwk struct {
+	KeyType   string `json:"kty"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+}
+
+// publicJWK returns the public key of the signer as a JWK
+func (s *AssertionSigner) publicJWK() jwk {
+	key := jwk{Use: "sig", Algorithm: s.algorithm, KeyID: s.keyID}
+	switch public := s.key.Public().(type) {
+	case *rsa.PublicKey:
+		key.KeyType = "RSA"
+		key.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+		key.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+	case ed25519.PublicKey:
+		key.KeyType = "OKP"
+		key.Curve = "Ed25519"
+		key.X = base64.RawURLEncoding.EncodeToString(public)
+	}
+	return key
+}
+
+// JWKSHandler serves the public key set used to verify gateway tokens
+func (s *AssertionSigner) JWKSHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []jwk{s.publicJWK()}})
+	})
+}
@@ -0,0 +1,163 @@
+package middleware
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ase-compas/compas-auth-proxy/internal/config"
+)
+
+// verifyAssertion checks the signature of a token against the JWKS document
+// and returns its claims
+func verifyAssertion(t *testing.T, token string, jwks []byte) map[string]interface{} {
+	t.Helper()
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(jwks, &set); err != nil || len(set.Keys) != 1 {
+		t.Fatalf("Invalid JWKS document %s: %v", jwks, err)
+	}
+	key := set.Keys[0]
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("Expected a JWT with three parts, got %q", token)
+	}
+	var header map[string]string
+	headerData, _ := base64.RawURLEncoding.DecodeString(parts[0])
+	json.Unmarshal(headerData, &header)
+	if header["alg"] != key.Algorithm || header["kid"] != key.KeyID {
+		t.Fatalf("Token header %v does not match key %+v", header, key)
+	}
+
+	signingInput := []byte(parts[0] + "." + parts[1])
+	signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	switch key.KeyType {
+	case "RSA":
+		n, _ := base64.RawURLEncoding.DecodeString(key.N)
+		e, _ := base64.RawURLEncoding.DecodeString(key.E)
+		public := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		digest := sha256.Sum256(signingInput)
+		if err := rsa.VerifyPKCS1v15(public, crypto.SHA256, digest[:], signature); err != nil {
+			t.Fatalf("Invalid RS256 signature: %v", err)
+		}
+	case "OKP":
+		x, _ := base64.RawURLEncoding.DecodeString(key.X)
+		if !ed25519.Verify(ed25519.PublicKey(x), signingInput, signature) {
+			t.Fatalf("Invalid EdDSA signature")
+		}
+	default:
+		t.Fatalf("Unexpected key type %q", key.KeyType)
+	}
+
+	var claims map[string]interface{}
+	payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		t.Fatalf("Invalid token payload: %v", err)
+	}
+	return claims
+}
+
+func TestIdentityAssertion(t *testing.T) {
+	var received http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+	}))
+	defer backend.Close()
+
+	for _, algorithm := range []string{config.SigningAlgorithmRS256, config.SigningAlgorithmEdDSA} {
+		cfg := &config.Config{
+			GatewayTokenEnabled:   true,
+			GatewayTokenAlgorithm: algorithm,
+			GatewayTokenIssuer:    "compas-gateway",
+			GatewayTokenTTL:       time.Minute,
+			UpstreamRoutes: []config.UpstreamRoute{{
+				Path:        "/api",
+				UpstreamURL: backend.URL,
+				Identity: config.IdentityConfig{
+					Assertion: config.AssertionConfig{
+						Enabled:  true,
+						Header:   "X-Compas-Identity",
+						Audience: "scl-service",
+						Claims:   map[string]string{"roles": "realm_access.roles", "tenant": "tenant"},
+					},
+				},
+			}},
+		}
+		signer, err := NewAssertionSigner(cfg)
+		if err != nil {
+			t.Fatalf("%s: failed to create signer: %v", algorithm, err)
+		}
+		middleware, err := NewMultiProxyMiddleware(cfg)
+		if err != nil {
+			t.Fatalf("%s: failed to create middleware: %v", algorithm, err)
+		}
+		middleware.SetAssertionSigner(signer)
+
+		req := httptest.NewRequest("GET", "/api/data", nil)
+		req.Header.Set("X-Compas-Identity", "spoofed")
+		req = req.WithContext(SetUserInContext(req.Context(), &UserInfo{
+			Sub: "user-1",
+			Claims: map[string]interface{}{
+				"realm_access": map[string]interface{}{"roles": []interface{}{"admin"}},
+			},
+		}))
+
+		received = nil
+		rec := httptest.NewRecorder()
+		middleware.Handler().ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: expected status 200, got %d", algorithm, rec.Code)
+		}
+
+		jwks := httptest.NewRecorder()
+		signer.JWKSHandler().ServeHTTP(jwks, httptest.NewRequest("GET", "/.well-known/jwks.json", nil))
+
+		claims := verifyAssertion(t, received.Get("X-Compas-Identity"), jwks.Body.Bytes())
+		if claims["sub"] != "user-1" || claims["aud"] != "scl-service" || claims["iss"] != "compas-gateway" {
+			t.Errorf("%s: unexpected claims %v", algorithm, claims)
+		}
+		if roles, _ := claims["roles"].([]interface{}); len(roles) != 1 || roles[0] != "admin" {
+			t.Errorf("%s: expected roles claim [admin], got %v", algorithm, claims["roles"])
+		}
+		if _, ok := claims["tenant"]; ok {
+			t.Errorf("%s: expected missing claim to be omitted, got %v", algorithm, claims["tenant"])
+		}
+		if exp, _ := claims["exp"].(float64); exp-claims["iat"].(float64) != 60 {
+			t.Errorf("%s: expected a lifetime of 60s, got exp %v iat %v", algorithm, claims["exp"], claims["iat"])
+		}
+	}
+}
+
+func TestIdentityAssertionWithoutSigner(t *testing.T) {
+	middleware, err := NewMultiProxyMiddleware(&config.Config{
+		UpstreamRoutes: []config.UpstreamRoute{{
+			Path:        "/api",
+			UpstreamURL: "http://backend",
+			Identity:    config.IdentityConfig{Assertion: config.AssertionConfig{Enabled: true}},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "/api/data", nil)
+	req = req.WithContext(SetUserInContext(req.Context(), &UserInfo{Sub: "user-1"}))
+	rec := httptest.NewRecorder()
+	middleware.Handler().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("Expected status 500 without a signer, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,278 @@
+package middleware
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ase-compas/compas-auth-proxy/internal/config"
+)
+
+// Target represents a single upstream server of a route
+type Target struct {
+	URL    *url.URL
+	Weight int
+
+	active        int64 // in-flight requests and open WebSocket connections
+	currentWeight int   // smooth weighted round-robin state, guarded by the balancer
+	health        targetHealth
+	breaker       *circuitBreaker
+}
+
+// acquire marks the start of a request to the target
+func (t *Target) acquire() {
+	atomic.AddInt64(&t.active, 1)
+}
+
+// release marks the end of a request to the target
+func (t *Target) release() {
+	atomic.AddInt64(&t.active, -1)
+}
+
+// ActiveConnections returns the number of in-flight requests to the target
+func (t *Target) ActiveConnections() int64 {
+	return atomic.LoadInt64(&t.active)
+}
+
+// Balancer picks one target out of a list of candidates
+type Balancer interface {
+	Pick(key string, candidates []*Target) *Target
+}
+
+// UpstreamPool holds the upstream targets of a route and the strategy used to
+// distribute requests between them
+type UpstreamPool struct {
+	targets        []*Target
+	balancer       Balancer
+	trustedProxies *TrustedProxies
+}
+
+// NewUpstreamPool creates the upstream pool for a route
+func NewUpstreamPool(route config.UpstreamRoute, trustedProxies *TrustedProxies) (*UpstreamPool, error) {
+	pool := &UpstreamPool{trustedProxies: trustedProxies}
+
+	for _, targetConfig := range route.Targets() {
+		targetURL, err := url.Parse(targetConfig.URL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid upstream URL %s: %v", targetConfig.URL, err)
+		}
+		if targetURL.Scheme == "" || targetURL.Host == "" {
+			return nil, fmt.Errorf("invalid upstream URL %s: scheme and host are required", targetConfig.URL)
+		}
+
+		weight := targetConfig.Weight
+		if weight == 0 {
+			weight = 1
+		}
+		pool.targets = append(pool.targets, &Target{
+			URL:     targetURL,
+			Weight:  weight,
+			breaker: newCircuitBreaker(targetURL.String(), route.CircuitBreaker),
+		})
+	}
+	if len(pool.targets) == 0 {
+		return nil, fmt.Errorf("route %s has no upstream targets", route.Path)
+	}
+
+	switch route.LoadBalancing {
+	case config.LoadBalanceLeastConnections:
+		pool.balancer = &leastConnectionsBalancer{}
+	case config.LoadBalanceWeighted:
+		pool.balancer = &weightedBalancer{}
+	case config.LoadBalanceConsistentHash:
+		pool.balancer = newConsistentHashBalancer(pool.targets)
+	default:
+		pool.balancer = &roundRobinBalancer{}
+	}
+
+	return pool, nil
+}
+
+// Targets returns all targets of the pool
+func (p *UpstreamPool) Targets() []*Target {
+	return p.targets
+}
+
+// Pick selects a target for the request, skipping unhealthy, short-circuited
+// and excluded targets. It returns nil if no target is available.
+func (p *UpstreamPool) Pick(r *http.Request, exclude []*Target) *Target {
+	candidates := make([]*Target, 0, len(p.targets))
+	for _, target := range p.targets {
+		if target.Healthy() && target.breaker.available() && !containsTarget(exclude, target) {
+			candidates = append(candidates, target)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	if len(candidates) == 1 {
+		return candidates[0]
+	}
+	return p.balancer.Pick(p.balancingKey(r), candidates)
+}
+
+// Acquire picks a target for the request and claims permission from its
+// circuit breaker. The returned generation must be reported back to the
+// breaker once the outcome of the request is known.
+func (p *UpstreamPool) Acquire(r *http.Request, exclude []*Target) (*Target, uint64, error) {
+	for {
+		target := p.Pick(r, exclude)
+		if target == nil {
+			return nil, 0, p.unavailableError()
+		}
+		if generation, ok := target.breaker.allow(); ok {
+			return target, generation, nil
+		}
+		// Lost the race for a half-open probe slot, try another target
+		exclude = append(exclude, target)
+	}
+}
+
+// unavailableError explains why no target could be picked
+func (p *UpstreamPool) unavailableError() error {
+	var retryAfter time.Duration
+	for _, target := range p.targets {
+		if wait := target.breaker.retryAfter(); wait > 0 && (retryAfter == 0 || wait < retryAfter) {
+			retryAfter = wait
+		}
+	}
+	if retryAfter > 0 {
+		return &CircuitOpenError{RetryAfter: retryAfter}
+	}
+	return errNoUpstreamAvailable
+}
+
+// String returns the upstream URLs of the pool
+func (p *UpstreamPool) String() string {
+	urls := make([]string, 0, len(p.targets))
+	for _, target := range p.targets {
+		urls = append(urls, target.URL.String())
+	}
+	return strings.Join(urls, ", ")
+}
+
+// balancingKey identifies the client of a request for sticky balancing:
+// the authenticated user, or the client IP for anonymous requests
+func (p *UpstreamPool) balancingKey(r *http.Request) string {
+	if userInfo := GetUserFromContext(r.Context()); userInfo != nil && userInfo.Sub != "" {
+		return userInfo.Sub
+	}
+	return p.trustedProxies.ClientIP(r)
+}
+
+// containsTarget reports whether target is part of targets
+func containsTarget(targets []*Target, target *Target) bool {
+	for _, t := range targets {
+		if t == target {
+			return true
+		}
+	}
+	return false
+}
+
+// roundRobinBalancer cycles through the candidates
+type roundRobinBalancer struct {
+	counter uint64
+}
+
+func (b *roundRobinBalancer) Pick(_ string, candidates []*Target) *Target {
+	n := atomic.AddUint64(&b.counter, 1) - 1
+	return candidates[n%uint64(len(candidates))]
+}
+
+// leastConnectionsBalancer picks the candidate with the fewest in-flight
+// requests, rotating between candidates with equal load
+type leastConnectionsBalancer struct {
+	counter uint64
+}
+
+func (b *leastConnectionsBalancer) Pick(_ string, candidates []*Target) *Target {
+	offset := int(atomic.AddUint64(&b.counter, 1) % uint64(len(candidates)))
+
+	var best *Target
+	for i := range candidates {
+		target := candidates[(offset+i)%len(candidates)]
+		if best == nil || target.ActiveConnections() < best.ActiveConnections() {
+			best = target
+		}
+	}
+	return best
+}
+
+// weightedBalancer implements smooth weighted round-robin
+type weightedBalancer struct {
+	mu sync.Mutex
+}
+
+func (b *weightedBalancer) Pick(_ string, candidates []*Target) *Target {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	total := 0
+	var best *Target
+	for _, target := range candidates {
+		target.currentWeight += target.Weight
+		total += target.Weight
+		if best == nil || target.currentWeight > best.currentWeight {
+			best = target
+		}
+	}
+	best.currentWeight -= total
+	return best
+}
+
+// consistentHashBalancer maps a key onto a hash ring so that the same user is
+// sent to the same target as long as it is available
+type consistentHashBalancer struct {
+	ring []ringNode
+}
+
+type ringNode struct {
+	hash   uint32
+	target *Target
+}
+
+// virtualNodes is the number of ring positions per unit of target weight
+const virtualNodes = 100
+
+func newConsistentHashBalancer(targets []*Target) *consistentHashBalancer {
+	b := &consistentHashBalancer{}
+	for _, target := range targets {
+		for i := 0; i < virtualNodes*target.Weight; i++ {
+			b.ring = append(b.ring, ringNode{
+				hash:   hashKey(target.URL.String() + "#" + strconv.Itoa(i)),
+				target: target,
+			})
+		}
+	}
+	sort.Slice(b.ring, func(i, j int) bool { return b.ring[i].hash < b.ring[j].hash })
+	return b
+}
+
+func (b *consistentHashBalancer) Pick(key string, candidates []*Target) *Target {
+	hash := hashKey(key)
+	start := sort.Search(len(b.ring), func(i int) bool { return b.ring[i].hash >= hash })
+
+	// Walk the ring clockwise until a candidate is found
+	for i := 0; i < len(b.ring); i++ {
+		node := b.ring[(start+i)%len(b.ring)]
+		if containsTarget(candidates, node.target) {
+			return node.target
+		}
+	}
+	return candidates[0]
+}
+
+// hashKey hashes a string onto the ring
+func hashKey(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
@@ -0,0 +1,134 @@
+package middleware
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ase-compas/compas-auth-proxy/internal/config"
+)
+
+func newTestPool(t *testing.T, strategy string, targets ...config.UpstreamTarget) *UpstreamPool {
+	pool, err := NewUpstreamPool(config.UpstreamRoute{Path: "/", Upstreams: targets, LoadBalancing: strategy}, nil)
+	if err != nil {
+		t.Fatalf("Failed to create pool: %v", err)
+	}
+	return pool
+}
+
+func pickCounts(pool *UpstreamPool, n int, user string) map[string]int {
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		req := httptest.NewRequest("GET", "/", nil)
+		if user != "" {
+			req = req.WithContext(SetUserInContext(req.Context(), &UserInfo{Sub: user}))
+		}
+		counts[pool.Pick(req, nil).URL.Host]++
+	}
+	return counts
+}
+
+func TestRoundRobinBalancer(t *testing.T) {
+	pool := newTestPool(t, config.LoadBalanceRoundRobin,
+		config.UpstreamTarget{URL: "http://a:80"}, config.UpstreamTarget{URL: "http://b:80"}, config.UpstreamTarget{URL: "http://c:80"})
+
+	counts := pickCounts(pool, 30, "")
+	for _, host := range []string{"a:80", "b:80", "c:80"} {
+		if counts[host] != 10 {
+			t.Errorf("Expected 10 requests to %s, got %d", host, counts[host])
+		}
+	}
+}
+
+func TestWeightedBalancer(t *testing.T) {
+	pool := newTestPool(t, config.LoadBalanceWeighted,
+		config.UpstreamTarget{URL: "http://a:80", Weight: 3}, config.UpstreamTarget{URL: "http://b:80", Weight: 1})
+
+	counts := pickCounts(pool, 40, "")
+	if counts["a:80"] != 30 || counts["b:80"] != 10 {
+		t.Errorf("Expected 30/10 split, got %v", counts)
+	}
+}
+
+func TestLeastConnectionsBalancer(t *testing.T) {
+	pool := newTestPool(t, config.LoadBalanceLeastConnections,
+		config.UpstreamTarget{URL: "http://a:80"}, config.UpstreamTarget{URL: "http://b:80"})
+
+	busy := pool.Targets()[0]
+	busy.acquire()
+	defer busy.release()
+
+	counts := pickCounts(pool, 10, "")
+	if counts["b:80"] != 10 {
+		t.Errorf("Expected all requests to the idle target, got %v", counts)
+	}
+}
+
+func TestConsistentHashBalancer(t *testing.T) {
+	pool := newTestPool(t, config.LoadBalanceConsistentHash,
+		config.UpstreamTarget{URL: "http://a:80"}, config.UpstreamTarget{URL: "http://b:80"}, config.UpstreamTarget{URL: "http://c:80"})
+
+	used := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		user := fmt.Sprintf("user-%d", i)
+		counts := pickCounts(pool, 5, user)
+		if len(counts) != 1 {
+			t.Errorf("Expected %s to stick to one target, got %v", user, counts)
+		}
+		for host := range counts {
+			used[host] = true
+		}
+	}
+	if len(used) < 2 {
+		t.Errorf("Expected users to be spread over several targets, got %v", used)
+	}
+
+	// Excluding the user's target moves the user to another one
+	req := httptest.NewRequest("GET", "/", nil)
+	req = req.WithContext(SetUserInContext(req.Context(), &UserInfo{Sub: "user-1"}))
+	first := pool.Pick(req, nil)
+	if second := pool.Pick(req, []*Target{first}); second == nil || second == first {
+		t.Errorf("Expected a different target when the preferred one is excluded")
+	}
+}
+
+func TestProxyLoadBalancing(t *testing.T) {
+	newBackend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "%s %s", name, r.URL.Path)
+		}))
+	}
+	backendA, backendB := newBackend("a"), newBackend("b")
+	defer backendA.Close()
+	defer backendB.Close()
+
+	middleware, err := NewMultiProxyMiddleware(&config.Config{
+		UpstreamRoutes: []config.UpstreamRoute{{
+			Path:      "/api/scl",
+			StripPath: true,
+			Upstreams: []config.UpstreamTarget{{URL: backendA.URL}, {URL: backendB.URL + "/base"}},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+
+	bodies := make(map[string]int)
+	for i := 0; i < 4; i++ {
+		rec := httptest.NewRecorder()
+		middleware.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/api/scl/files", nil))
+		body, _ := io.ReadAll(rec.Body)
+		bodies[string(body)]++
+	}
+
+	if bodies["a /files"] != 2 || bodies["b /base/files"] != 2 {
+		t.Errorf("Expected requests to alternate between upstreams, got %v", bodies)
+	}
+	for _, target := range middleware.routes[0].Upstreams.Targets() {
+		if target.ActiveConnections() != 0 {
+			t.Errorf("Expected no active connections to %s after requests completed", target.URL)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package middleware
+
+import (
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/ase-compas/compas-auth-proxy/internal/config"
+)
+
+// bodyPolicy restricts the size and media type of request bodies of a route
+type bodyPolicy struct {
+	maxSize      config.ByteSize // 0 means no limit
+	contentTypes []string        // Allowed media types, "type/*" matches any subtype
+}
+
+// newBodyPolicy creates the body policy of a route, or nil if the route
+// accepts any body
+func newBodyPolicy(route config.UpstreamRoute) *bodyPolicy {
+	if route.MaxRequestBody <= 0 && len(route.AllowedContentTypes) == 0 {
+		return nil
+	}
+	p := &bodyPolicy{maxSize: route.MaxRequestBody}
+	for _, contentType := range route.AllowedContentTypes {
+		p.contentTypes = append(p.contentTypes, strings.ToLower(contentType))
+	}
+	return p
+}
+
+// check rejects requests whose body is known to violate the policy and limits
+// the body of all others. Bodies of unknown length are cut off while they are
+// streamed to the upstream, which is answered by the proxy error handler.
+func (p *bodyPolicy) check(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	hasBody := r.ContentLength > 0 || r.ContentLength == -1
+	if !hasBody {
+		return r, true
+	}
+
+	if len(p.contentTypes) > 0 {
+		contentType := r.Header.Get("Content-Type")
+		if !p.allowsContentType(contentType) {
+			log.Printf("Rejected content type %q for %s %s", contentType, r.Method, r.URL.Path)
+			msg := fmt.Sprintf("Unsupported Media Type: content type %q is not allowed, expected one of %s", contentType, strings.Join(p.contentTypes, ", "))
+			http.Error(w, msg, http.StatusUnsupportedMediaType)
+			return nil, false
+		}
+	}
+
+	if p.maxSize > 0 {
+		if r.ContentLength > int64(p.maxSize) {
+			log.Printf("Rejected request body of %d bytes for %s %s", r.ContentLength, r.Method, r.URL.Path)
+			writeBodyTooLarge(w, p.maxSize)
+			return nil, false
+		}
+		limited := r.WithContext(r.Context())
+		limited.Body = http.MaxBytesReader(w, r.Body, int64(p.maxSize))
+		r = limited
+	}
+	return r, true
+}
+
+// allowsContentType reports whether the media type of the Content-Type header
+// is allowed
+func (p *bodyPolicy) allowsContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range p.contentTypes {
+		if allowed == mediaType {
+			return true
+		}
+		if prefix := strings.TrimSuffix(allowed, "*"); prefix != allowed && strings.HasPrefix(mediaType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeBodyTooLarge answers a request whose body exceeds the limit of the route
+func writeBodyTooLarge(w http.ResponseWriter, maxSize config.ByteSize) {
+	msg := fmt.Sprintf("Request Entity Too Large: the request body exceeds the limit of %s for this route", maxSize)
+	http.Error(w, msg, http.StatusRequestEntityTooLarge)
+}
@@ -0,0 +1,81 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ase-compas/compas-auth-proxy/internal/config"
+)
+
+func TestRequestBodyPolicy(t *testing.T) {
+	var received int
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		received = len(data)
+	}))
+	defer backend.Close()
+
+	middleware, err := NewMultiProxyMiddleware(&config.Config{
+		UpstreamRoutes: []config.UpstreamRoute{
+			{Path: "/api/scl", UpstreamURL: backend.URL, MaxRequestBody: 1 * config.Megabyte, AllowedContentTypes: []string{"application/xml", "text/*"}},
+			{Path: "/api", UpstreamURL: backend.URL, MaxRequestBody: 16},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+
+	testCases := []struct {
+		name        string
+		method      string
+		path        string
+		body        string
+		contentType string
+		chunked     bool
+		status      int
+		message     string
+	}{
+		{"large SCL file", "POST", "/api/scl/files", strings.Repeat("x", 64*1024), "application/xml; charset=utf-8", false, http.StatusOK, ""},
+		{"wildcard content type", "POST", "/api/scl/files", "<SCL/>", "text/xml", false, http.StatusOK, ""},
+		{"disallowed content type", "POST", "/api/scl/files", "{}", "application/json", false, http.StatusUnsupportedMediaType, `content type "application/json" is not allowed`},
+		{"missing content type", "POST", "/api/scl/files", "<SCL/>", "", false, http.StatusUnsupportedMediaType, "not allowed"},
+		{"request without body", "GET", "/api/scl/files", "", "", false, http.StatusOK, ""},
+		{"body within limit", "POST", "/api/data", "small body", "application/json", false, http.StatusOK, ""},
+		{"content length above limit", "POST", "/api/data", strings.Repeat("x", 17), "application/json", false, http.StatusRequestEntityTooLarge, "exceeds the limit of 16B"},
+		{"chunked body above limit", "POST", "/api/data", strings.Repeat("x", 1024), "application/json", true, http.StatusRequestEntityTooLarge, "exceeds the limit of 16B"},
+		{"chunked body within limit", "POST", "/api/data", "chunked", "application/json", true, http.StatusOK, ""},
+	}
+
+	for _, tc := range testCases {
+		var body io.Reader
+		if tc.body != "" {
+			body = strings.NewReader(tc.body)
+		}
+		req := httptest.NewRequest(tc.method, tc.path, body)
+		if tc.contentType != "" {
+			req.Header.Set("Content-Type", tc.contentType)
+		}
+		if tc.chunked {
+			req.ContentLength = -1
+			req.Body = io.NopCloser(req.Body)
+		}
+
+		received = -1
+		rec := httptest.NewRecorder()
+		middleware.Handler().ServeHTTP(rec, req)
+
+		if rec.Code != tc.status {
+			t.Errorf("%s: expected status %d, got %d (%s)", tc.name, tc.status, rec.Code, rec.Body.String())
+			continue
+		}
+		if !strings.Contains(rec.Body.String(), tc.message) {
+			t.Errorf("%s: expected message containing %q, got %q", tc.name, tc.message, rec.Body.String())
+		}
+		if tc.status == http.StatusOK && received != len(tc.body) {
+			t.Errorf("%s: expected upstream to receive %d bytes, got %d", tc.name, len(tc.body), received)
+		}
+	}
+}
@@ -0,0 +1,555 @@
+package middleware
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ase-compas/compas-auth-proxy/internal/config"
+)
+
+// cacheStatusName identifies the gateway in Cache-Status headers (RFC 9211)
+const cacheStatusName = "compas-auth-proxy"
+
+// maxHeuristicLifetime limits the freshness derived from Last-Modified
+const maxHeuristicLifetime = 24 * time.Hour
+
+// heuristicallyCacheable are the status codes that may be cached without
+// explicit freshness information (RFC 9110, section 15.1)
+var heuristicallyCacheable = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+// notModifiedHeaders are the stored headers sent with 304 responses
+var notModifiedHeaders = []string{"Cache-Control", "Content-Location", "Date", "ETag", "Expires", "Last-Modified", "Vary"}
+
+// cachePolicy caches the responses of a route in the shared cache of the
+// gateway following RFC 9111
+type cachePolicy struct {
+	store        cacheStore
+	maxEntrySize int64
+	authorized   bool          // Whether responses to requests with credentials are stored
+	defaultTTL   time.Duration // Freshness of responses without explicit expiration time
+	now          func() time.Time
+}
+
+// newCachePolicy creates the cache policy of a route, or nil if the route is
+// not cached
+func newCachePolicy(cfg config.RouteCacheConfig, store cacheStore, maxEntrySize config.ByteSize) *cachePolicy {
+	if !cfg.Enabled || store == nil {
+		return nil
+	}
+	p := &cachePolicy{
+		store:        store,
+		maxEntrySize: int64(maxEntrySize),
+		authorized:   cfg.Authorized,
+		defaultTTL:   cfg.DefaultTTL,
+		now:          time.Now,
+	}
+	if p.maxEntrySize == 0 {
+		p.maxEntrySize = int64(10 * config.Megabyte)
+	}
+	return p
+}
+
+// cacheLookup carries the outcome of the cache lookup of a request to the
+// handling of the upstream response
+type cacheLookup struct {
+	request     *http.Request // Request received by the gateway
+	key         string
+	forward     string      // Why the request was forwarded, see RFC 9211
+	noStore     bool        // Whether the response must not be stored
+	stale       *cacheEntry // Stale entry revalidated by the request
+	requestTime time.Time
+}
+
+// cacheKey returns the key of the responses to the request
+func cacheKey(r *http.Request) string {
+	return strings.ToLower(r.Host) + r.URL.RequestURI()
+}
+
+// serve answers the request from the cache if it holds a fresh response.
+// Otherwise the returned request carries the lookup used to store or
+// revalidate the upstream response. Cached responses are completed by finish
+// like upstream responses.
+func (p *cachePolicy) serve(w http.ResponseWriter, r *http.Request, finish func(*http.Response) error) (*http.Request, bool) {
+	lookup := &cacheLookup{request: r, key: cacheKey(r), requestTime: p.now()}
+	forward := func(reason string) (*http.Request, bool) {
+		lookup.forward = reason
+		return r.WithContext(setCacheLookupInContext(r.Context(), lookup)), false
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return forward("method")
+	}
+	directives := parseCacheControl(r.Header)
+	if _, ok := directives["no-store"]; ok || r.Header.Get("Range") != "" {
+		lookup.noStore = true
+		return forward("bypass")
+	}
+
+	entry := p.store.get(lookup.key)
+	if entry == nil {
+		return forward("uri-miss")
+	}
+	if !entry.matchesVary(r.Header) {
+		return forward("vary-miss")
+	}
+
+	now := p.now()
+	age := entry.age(now)
+	lifetime := p.freshnessLifetime(entry)
+	if age < lifetime && requestAcceptsAge(r.Header, directives, age, lifetime) {
+		resp := entry.response(r, age)
+		if notModified(r.Header, entry.Header) {
+			resp = entry.notModified(r, age)
+		}
+		resp.Header.Add("Cache-Status", cacheStatusName+"; hit; ttl="+strconv.Itoa(int((lifetime-age).Seconds())))
+		if err := finish(resp); err != nil {
+			resp.Body.Close()
+			return forward("miss")
+		}
+		writeResponse(w, resp)
+		return r, true
+	}
+
+	// Revalidate the stale response unless the client validates its own copy
+	if r.Method == http.MethodGet && !hasConditionals(r.Header) {
+		etag, lastModified := entry.Header.Get("ETag"), entry.Header.Get("Last-Modified")
+		if etag != "" || lastModified != "" {
+			lookup.stale = entry
+			revalidation := r.Clone(r.Context())
+			if etag != "" {
+				revalidation.Header.Set("If-None-Match", etag)
+			} else {
+				revalidation.Header.Set("If-Modified-Since", lastModified)
+			}
+			r = revalidation
+		}
+	}
+	return forward("stale")
+}
+
+// update stores, refreshes or invalidates cached responses based on the
+// upstream response to a request looked up in the cache
+func (p *cachePolicy) update(resp *http.Response) {
+	lookup := getCacheLookupFromContext(resp.Request.Context())
+	if lookup == nil {
+		return
+	}
+	status := cacheStatusName + "; fwd=" + lookup.forward + "; fwd-status=" + strconv.Itoa(resp.StatusCode)
+
+	switch lookup.request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+	default:
+		// Unsafe methods invalidate the responses of the affected resources
+		if resp.StatusCode < 400 {
+			p.invalidate(lookup.request, resp.Header)
+		}
+		return
+	}
+
+	if lookup.stale != nil && resp.StatusCode == http.StatusNotModified {
+		// The stale response is valid again
+		entry := lookup.stale.revalidated(resp.Header, lookup.requestTime, p.now())
+		p.store.set(entry)
+		resp.Body.Close()
+		*resp = *entry.response(lookup.request, entry.age(p.now()))
+		resp.Header.Add("Cache-Status", status)
+		return
+	}
+
+	if lookup.request.Method == http.MethodGet && !lookup.noStore && p.storable(resp, lookup) {
+		entry := &cacheEntry{
+			Key:          lookup.key,
+			StatusCode:   resp.StatusCode,
+			Header:       resp.Header.Clone(),
+			Vary:         varyValues(resp.Header, lookup.request.Header),
+			RequestTime:  lookup.requestTime,
+			ResponseTime: p.now(),
+		}
+		resp.Body = &cachingBody{
+			ReadCloser: resp.Body,
+			limit:      p.maxEntrySize,
+			done: func(body []byte) {
+				entry.Body = body
+				entry.Header.Set("Content-Length", strconv.Itoa(len(body)))
+				p.store.set(entry)
+			},
+		}
+		status += "; stored"
+	}
+	resp.Header.Add("Cache-Status", status)
+}
+
+// storable reports whether the response may be stored (RFC 9111, section 3)
+func (p *cachePolicy) storable(resp *http.Response, lookup *cacheLookup) bool {
+	directives := parseCacheControl(resp.Header)
+	if _, ok := directives["no-store"]; ok {
+		return false
+	}
+	if _, ok := directives["private"]; ok {
+		return false
+	}
+	if resp.Header.Get("Set-Cookie") != "" || resp.Header.Get("Vary") == "*" {
+		return false
+	}
+	if !p.authorized && hasCredentials(lookup.request.Header) {
+		return false
+	}
+	if resp.ContentLength > p.maxEntrySize {
+		return false
+	}
+
+	_, explicit := directives["max-age"]
+	if _, ok := directives["s-maxage"]; ok {
+		explicit = true
+	}
+	if _, ok := directives["public"]; ok {
+		explicit = true
+	}
+	if resp.Header.Get("Expires") != "" {
+		explicit = true
+	}
+	if !explicit && !heuristicallyCacheable[resp.StatusCode] {
+		return false
+	}
+
+	// Responses that are never fresh are only useful with validators
+	entry := &cacheEntry{StatusCode: resp.StatusCode, Header: resp.Header}
+	if p.freshnessLifetime(entry) <= 0 && resp.Header.Get("ETag") == "" && resp.Header.Get("Last-Modified") == "" {
+		return false
+	}
+	return true
+}
+
+// invalidate removes the responses of the request URI and of the URIs in the
+// Location and Content-Location headers of the same host
+func (p *cachePolicy) invalidate(r *http.Request, header http.Header) {
+	p.store.delete(cacheKey(r))
+	for _, name := range []string{"Location", "Content-Location"} {
+		value := header.Get(name)
+		if value == "" {
+			continue
+		}
+		u, err := r.URL.Parse(value)
+		if err != nil || (u.Host != "" && !strings.EqualFold(u.Host, r.Host)) {
+			continue
+		}
+		p.store.delete(strings.ToLower(r.Host) + u.RequestURI())
+	}
+}
+
+// freshnessLifetime returns how long the response is fresh after it was
+// generated (RFC 9111, section 4.2.1)
+func (p *cachePolicy) freshnessLifetime(entry *cacheEntry) time.Duration {
+	directives := parseCacheControl(entry.Header)
+	if _, ok := directives["no-cache"]; ok {
+		return 0
+	}
+	if seconds, ok := directives["s-maxage"]; ok {
+		return parseDeltaSeconds(seconds)
+	}
+	if seconds, ok := directives["max-age"]; ok {
+		return parseDeltaSeconds(seconds)
+	}
+	date := entry.date()
+	if expires := entry.Header.Get("Expires"); expires != "" {
+		t, err := http.ParseTime(expires)
+		if err != nil || !t.After(date) {
+			return 0
+		}
+		return t.Sub(date)
+	}
+
+	if !heuristicallyCacheable[entry.StatusCode] {
+		return 0
+	}
+	if p.defaultTTL > 0 {
+		return p.defaultTTL
+	}
+	if lastModified, err := http.ParseTime(entry.Header.Get("Last-Modified")); err == nil && lastModified.Before(date) {
+		lifetime := date.Sub(lastModified) / 10
+		if lifetime > maxHeuristicLifetime {
+			lifetime = maxHeuristicLifetime
+		}
+		return lifetime
+	}
+	return 0
+}
+
+// date returns the Date of the response, or when it was received
+func (e *cacheEntry) date() time.Time {
+	if date, err := http.ParseTime(e.Header.Get("Date")); err == nil {
+		return date
+	}
+	return e.ResponseTime
+}
+
+// age returns the current age of the response (RFC 9111, section 4.2.3)
+func (e *cacheEntry) age(now time.Time) time.Duration {
+	apparentAge := e.ResponseTime.Sub(e.date())
+	if apparentAge < 0 {
+		apparentAge = 0
+	}
+	correctedAge := parseDeltaSeconds(e.Header.Get("Age")) + e.ResponseTime.Sub(e.RequestTime)
+	if correctedAge < apparentAge {
+		correctedAge = apparentAge
+	}
+	return correctedAge + now.Sub(e.ResponseTime)
+}
+
+// matchesVary reports whether the request selects the stored response
+func (e *cacheEntry) matchesVary(header http.Header) bool {
+	for name, value := range e.Vary {
+		if normalizeHeaderValue(header.Values(name)) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// response returns the stored response for the request
+func (e *cacheEntry) response(r *http.Request, age time.Duration) *http.Response {
+	header := e.Header.Clone()
+	header.Set("Age", strconv.Itoa(int(age.Seconds())))
+	return &http.Response{
+		Status:        strconv.Itoa(e.StatusCode) + " " + http.StatusText(e.StatusCode),
+		StatusCode:    e.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(e.Body)),
+		ContentLength: int64(len(e.Body)),
+		Request:       r,
+	}
+}
+
+// notModified returns a 304 response for a client whose copy is still valid
+func (e *cacheEntry) notModified(r *http.Request, age time.Duration) *http.Response {
+	resp := e.response(r, age)
+	resp.Status = "304 Not Modified"
+	resp.StatusCode = http.StatusNotModified
+	resp.Header = make(http.Header)
+	for _, name := range notModifiedHeaders {
+		if values := e.Header.Values(name); len(values) > 0 {
+			resp.Header[name] = values
+		}
+	}
+	resp.Header.Set("Age", strconv.Itoa(int(age.Seconds())))
+	resp.Body = http.NoBody
+	resp.ContentLength = 0
+	return resp
+}
+
+// revalidated returns the entry updated with the headers of a 304 response
+// (RFC 9111, section 4.3.4)
+func (e *cacheEntry) revalidated(header http.Header, requestTime, responseTime time.Time) *cacheEntry {
+	updated := *e
+	updated.Header = e.Header.Clone()
+	for name, values := range header {
+		switch name {
+		case "Content-Length", "Set-Cookie", "Cache-Status":
+			continue
+		}
+		updated.Header[name] = values
+	}
+	if header.Get("Age") == "" {
+		updated.Header.Del("Age")
+	}
+	updated.RequestTime = requestTime
+	updated.ResponseTime = responseTime
+	return &updated
+}
+
+// cachingBody passes an upstream body through and stores it once it has been
+// read completely. Bodies above the limit are not stored.
+type cachingBody struct {
+	io.ReadCloser
+	buf      bytes.Buffer
+	limit    int64
+	overflow bool
+	done     func(body []byte)
+}
+
+func (b *cachingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if !b.overflow {
+		b.buf.Write(p[:n])
+		if int64(b.buf.Len()) > b.limit {
+			b.overflow = true
+			b.buf = bytes.Buffer{}
+		}
+	}
+	if err == io.EOF && !b.overflow && b.done != nil {
+		b.done(b.buf.Bytes())
+		b.done = nil
+	}
+	return n, err
+}
+
+// parseCacheControl parses the Cache-Control header into lower case
+// directives and their unquoted arguments
+func parseCacheControl(header http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, value := range header.Values("Cache-Control") {
+		for len(value) > 0 {
+			var directive string
+			directive, value = nextDirective(value)
+			name, arg, _ := strings.Cut(directive, "=")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name != "" {
+				directives[name] = strings.Trim(strings.TrimSpace(arg), `"`)
+			}
+		}
+	}
+	return directives
+}
+
+// nextDirective splits the first directive off a Cache-Control value, keeping
+// commas in quoted arguments
+func nextDirective(value string) (string, string) {
+	quoted := false
+	for i, c := range value {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == ',' && !quoted:
+			return value[:i], value[i+1:]
+		}
+	}
+	return value, ""
+}
+
+// parseDeltaSeconds parses a number of seconds, treating invalid values as 0
+func parseDeltaSeconds(value string) time.Duration {
+	seconds, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	if seconds > int64(maxDuration/time.Second) {
+		return maxDuration
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// maxDuration is the largest representable duration
+const maxDuration = time.Duration(1<<63 - 1)
+
+// requestAcceptsAge reports whether the request accepts a cached response of
+// the age (RFC 9111, section 5.2.1)
+func requestAcceptsAge(header http.Header, directives map[string]string, age, lifetime time.Duration) bool {
+	if _, ok := directives["no-cache"]; ok {
+		return false
+	}
+	if len(directives) == 0 && strings.Contains(strings.ToLower(header.Get("Pragma")), "no-cache") {
+		return false
+	}
+	if maxAge, ok := directives["max-age"]; ok && age > parseDeltaSeconds(maxAge) {
+		return false
+	}
+	if minFresh, ok := directives["min-fresh"]; ok && lifetime-age < parseDeltaSeconds(minFresh) {
+		return false
+	}
+	return true
+}
+
+// hasCredentials reports whether the request carries credentials or cookies
+// that may personalize the response
+func hasCredentials(header http.Header) bool {
+	return header.Get("Authorization") != "" || header.Get("Cookie") != ""
+}
+
+// hasConditionals reports whether the request is conditional
+func hasConditionals(header http.Header) bool {
+	return header.Get("If-None-Match") != "" || header.Get("If-Modified-Since") != ""
+}
+
+// notModified reports whether a conditional request matches the stored
+// response (RFC 9110, section 13.2.2)
+func notModified(request, stored http.Header) bool {
+	if ifNoneMatch := request.Get("If-None-Match"); ifNoneMatch != "" {
+		etag := strings.TrimPrefix(stored.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range strings.Split(ifNoneMatch, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+
+	ifModifiedSince, err := http.ParseTime(request.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(stored.Get("Last-Modified"))
+	return err == nil && !lastModified.After(ifModifiedSince)
+}
+
+// varyValues returns the values of the request headers named by the Vary
+// header of the response
+func varyValues(response, request http.Header) map[string]string {
+	var values map[string]string
+	for _, vary := range response.Values("Vary") {
+		for _, name := range strings.Split(vary, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			}
+			if values == nil {
+				values = make(map[string]string)
+			}
+			values[name] = normalizeHeaderValue(request.Values(name))
+		}
+	}
+	return values
+}
+
+// normalizeHeaderValue combines header values for comparison
+func normalizeHeaderValue(values []string) string {
+	parts := make([]string, 0, len(values))
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				parts = append(parts, part)
+			}
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// writeResponse writes a response produced by the gateway itself
+func writeResponse(w http.ResponseWriter, resp *http.Response) {
+	defer resp.Body.Close()
+	for name, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+	}
+	hasBody := resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotModified
+	if hasBody && resp.ContentLength >= 0 && resp.Header.Get("Content-Length") == "" {
+		w.Header().Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	}
+	w.WriteHeader(resp.StatusCode)
+	if hasBody && (resp.Request == nil || resp.Request.Method != http.MethodHead) {
+		io.Copy(w, resp.Body)
+	}
+}
@@ -0,0 +1,372 @@
+package middleware
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ase-compas/compas-auth-proxy/internal/config"
+)
+
+func TestResponseCache(t *testing.T) {
+	var mu sync.Mutex
+	requests := make(map[string]int)
+	var lastIfNoneMatch string
+	now := time.Now()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.Method+" "+r.URL.Path]++
+		count := requests[r.Method+" "+r.URL.Path]
+		if r.URL.Path == "/schemas/etag.xsd" {
+			lastIfNoneMatch = r.Header.Get("If-None-Match")
+		}
+		// Follow the clock of the cache
+		w.Header().Set("Date", now.UTC().Format(http.TimeFormat))
+		mu.Unlock()
+
+		switch r.URL.Path {
+		case "/app.js":
+			w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		case "/schemas/scl.xsd":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("ETag", `"scl-v1"`)
+		case "/schemas/etag.xsd":
+			w.Header().Set("Cache-Control", "max-age=10")
+			w.Header().Set("ETag", `"etag-v1"`)
+			if r.Header.Get("If-None-Match") == `"etag-v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		case "/schemas/no-store.xsd":
+			w.Header().Set("Cache-Control", "no-store")
+		case "/schemas/private.xsd":
+			w.Header().Set("Cache-Control", "private, max-age=60")
+		case "/schemas/cookie.xsd":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Set-Cookie", "id=1")
+		case "/schemas/lang.xsd":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Vary", "Accept-Language")
+		case "/schemas/heuristic.xsd":
+			w.Header().Set("Last-Modified", time.Now().Add(-100*time.Hour).UTC().Format(http.TimeFormat))
+		case "/schemas/large.xsd":
+			w.Header().Set("Cache-Control", "max-age=60")
+			io.WriteString(w, strings.Repeat("x", 2048))
+			return
+		}
+		if r.Method != http.MethodHead {
+			fmt.Fprintf(w, "%s %s #%d", r.URL.Path, r.Header.Get("Accept-Language"), count)
+		}
+	}))
+	defer backend.Close()
+
+	middleware, err := NewMultiProxyMiddleware(&config.Config{
+		Cache: config.CacheConfig{MaxEntrySize: 1024},
+		UpstreamRoutes: []config.UpstreamRoute{
+			{Path: "/bundles", UpstreamURL: backend.URL, StripPath: true, Cache: config.RouteCacheConfig{Enabled: true, Authorized: true}},
+			{Path: "/schemas", UpstreamURL: backend.URL, Cache: config.RouteCacheConfig{Enabled: true}},
+			{Path: "/", UpstreamURL: backend.URL},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+	for _, route := range middleware.routes {
+		if route.cache != nil {
+			route.cache.now = func() time.Time {
+				mu.Lock()
+				defer mu.Unlock()
+				return now
+			}
+		}
+	}
+	advance := func(d time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		now = now.Add(d)
+	}
+
+	send := func(method, path string, header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		for name, value := range header {
+			req.Header.Set(name, value)
+		}
+		rec := httptest.NewRecorder()
+		middleware.Handler().ServeHTTP(rec, req)
+		return rec
+	}
+	upstreamRequests := func(method, path string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return requests[method+" "+path]
+	}
+
+	// A fresh response is served from the cache
+	first := send("GET", "/schemas/scl.xsd", nil)
+	if status := first.Header().Get("Cache-Status"); !strings.Contains(status, "fwd=uri-miss") || !strings.Contains(status, "stored") {
+		t.Errorf("Expected stored miss, got Cache-Status %q", status)
+	}
+	advance(5 * time.Second)
+	second := send("GET", "/schemas/scl.xsd", nil)
+	if second.Body.String() != first.Body.String() || upstreamRequests("GET", "/schemas/scl.xsd") != 1 {
+		t.Errorf("Expected cached response, got %q after %d upstream requests", second.Body.String(), upstreamRequests("GET", "/schemas/scl.xsd"))
+	}
+	if status := second.Header().Get("Cache-Status"); !strings.Contains(status, "hit") {
+		t.Errorf("Expected hit, got Cache-Status %q", status)
+	}
+	if age := second.Header().Get("Age"); age != "5" {
+		t.Errorf("Expected Age 5, got %q", age)
+	}
+	if length := second.Header().Get("Content-Length"); length != fmt.Sprint(len(first.Body.String())) {
+		t.Errorf("Expected Content-Length %d, got %q", len(first.Body.String()), length)
+	}
+
+	// HEAD requests are answered from the stored GET response
+	if head := send("HEAD", "/schemas/scl.xsd", nil); head.Body.Len() != 0 || upstreamRequests("HEAD", "/schemas/scl.xsd") != 0 {
+		t.Errorf("Expected HEAD to be served from the cache without a body")
+	}
+
+	// Conditional requests matching the stored response get 304
+	if rec := send("GET", "/schemas/scl.xsd", map[string]string{"If-None-Match": `W/"scl-v1"`}); rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+		t.Errorf("Expected 304 for matching If-None-Match, got %d", rec.Code)
+	}
+
+	// Request directives force a request to the upstream
+	send("GET", "/schemas/scl.xsd", map[string]string{"Cache-Control": "no-cache"})
+	advance(2 * time.Second)
+	send("GET", "/schemas/scl.xsd", map[string]string{"Cache-Control": "max-age=1"})
+	if count := upstreamRequests("GET", "/schemas/scl.xsd"); count != 3 {
+		t.Errorf("Expected no-cache and max-age=1 to reach the upstream, got %d upstream requests", count)
+	}
+
+	// Stale responses are revalidated with their ETag
+	send("GET", "/schemas/etag.xsd", nil)
+	advance(20 * time.Second)
+	rec := send("GET", "/schemas/etag.xsd", nil)
+	if lastIfNoneMatch != `"etag-v1"` {
+		t.Errorf("Expected revalidation with If-None-Match, got %q", lastIfNoneMatch)
+	}
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "#1") || !strings.Contains(rec.Header().Get("Cache-Status"), "fwd=stale; fwd-status=304") {
+		t.Errorf("Expected revalidated cached response, got %d %q (%s)", rec.Code, rec.Body.String(), rec.Header().Get("Cache-Status"))
+	}
+	if rec := send("GET", "/schemas/etag.xsd", nil); !strings.Contains(rec.Header().Get("Cache-Status"), "hit") {
+		t.Errorf("Expected the revalidated response to be fresh again, got %q", rec.Header().Get("Cache-Status"))
+	}
+
+	// Responses that must not be shared are not stored
+	for _, tc := range []struct {
+		name   string
+		path   string
+		header map[string]string
+	}{
+		{"no-store", "/schemas/no-store.xsd", nil},
+		{"private", "/schemas/private.xsd", nil},
+		{"Set-Cookie", "/schemas/cookie.xsd", nil},
+		{"Authorization", "/schemas/scl-auth.xsd", map[string]string{"Authorization": "Bearer token", "Cache-Control": "no-cache"}},
+		{"Cookie", "/schemas/scl-cookie.xsd", map[string]string{"Cookie": "compas-session=abc"}},
+		{"above entry size", "/schemas/large.xsd", nil},
+	} {
+		send("GET", tc.path, tc.header)
+		send("GET", tc.path, tc.header)
+		if count := upstreamRequests("GET", tc.path); count != 2 {
+			t.Errorf("%s: expected response not to be cached, got %d upstream requests", tc.name, count)
+		}
+	}
+
+	// Routes may cache responses to authenticated requests
+	send("GET", "/bundles/app.js", map[string]string{"Cookie": "compas-session=abc"})
+	send("GET", "/bundles/app.js", map[string]string{"Cookie": "compas-session=def"})
+	if count := upstreamRequests("GET", "/app.js"); count != 1 {
+		t.Errorf("Expected authorized route to cache responses, got %d upstream requests", count)
+	}
+
+	// Responses are selected by the request headers named by Vary
+	send("GET", "/schemas/lang.xsd", map[string]string{"Accept-Language": "de"})
+	if rec := send("GET", "/schemas/lang.xsd", map[string]string{"Accept-Language": "en"}); !strings.Contains(rec.Body.String(), " en ") {
+		t.Errorf("Expected response for another language, got %q", rec.Body.String())
+	}
+	if rec := send("GET", "/schemas/lang.xsd", map[string]string{"Accept-Language": "en"}); !strings.Contains(rec.Header().Get("Cache-Status"), "hit") {
+		t.Errorf("Expected hit for the same language, got %q", rec.Header().Get("Cache-Status"))
+	}
+
+	// Freshness is derived from Last-Modified without explicit expiration
+	send("GET", "/schemas/heuristic.xsd", nil)
+	if rec := send("GET", "/schemas/heuristic.xsd", nil); !strings.Contains(rec.Header().Get("Cache-Status"), "hit") {
+		t.Errorf("Expected heuristic freshness, got %q", rec.Header().Get("Cache-Status"))
+	}
+
+	// Unsafe methods invalidate the stored response
+	send("PUT", "/schemas/heuristic.xsd", nil)
+	if rec := send("GET", "/schemas/heuristic.xsd", nil); !strings.Contains(rec.Header().Get("Cache-Status"), "fwd=uri-miss") {
+		t.Errorf("Expected invalidated response, got %q", rec.Header().Get("Cache-Status"))
+	}
+
+	// Routes without caching are not affected
+	send("GET", "/other", nil)
+	if rec := send("GET", "/other", nil); rec.Header().Get("Cache-Status") != "" || upstreamRequests("GET", "/other") != 2 {
+		t.Error("Expected route without caching to bypass the cache")
+	}
+}
+
+func TestFreshnessLifetime(t *testing.T) {
+	policy := newCachePolicy(config.RouteCacheConfig{Enabled: true}, newMemoryCache(1024), 0)
+	date := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name     string
+		status   int
+		header   map[string]string
+		expected time.Duration
+	}{
+		{"max-age", 200, map[string]string{"Cache-Control": "public, max-age=300"}, 5 * time.Minute},
+		{"s-maxage wins", 200, map[string]string{"Cache-Control": "max-age=300, s-maxage=60"}, time.Minute},
+		{"no-cache", 200, map[string]string{"Cache-Control": "no-cache, max-age=300"}, 0},
+		{"quoted argument", 200, map[string]string{"Cache-Control": `no-cache="Set-Cookie, X-Foo"`}, 0},
+		{"expires", 200, map[string]string{"Expires": date.Add(time.Hour).Format(http.TimeFormat)}, time.Hour},
+		{"invalid expires", 200, map[string]string{"Expires": "0"}, 0},
+		{"heuristic", 200, map[string]string{"Last-Modified": date.Add(-10 * time.Hour).Format(http.TimeFormat)}, time.Hour},
+		{"heuristic limit", 200, map[string]string{"Last-Modified": date.Add(-1000 * time.Hour).Format(http.TimeFormat)}, 24 * time.Hour},
+		{"not heuristically cacheable", 500, map[string]string{"Last-Modified": date.Add(-10 * time.Hour).Format(http.TimeFormat)}, 0},
+		{"no freshness information", 200, nil, 0},
+	}
+
+	for _, tc := range testCases {
+		entry := &cacheEntry{StatusCode: tc.status, Header: http.Header{"Date": {date.Format(http.TimeFormat)}}}
+		for name, value := range tc.header {
+			entry.Header.Set(name, value)
+		}
+		if lifetime := policy.freshnessLifetime(entry); lifetime != tc.expected {
+			t.Errorf("%s: expected lifetime %v, got %v", tc.name, tc.expected, lifetime)
+		}
+	}
+
+	policy.defaultTTL = 10 * time.Minute
+	entry := &cacheEntry{StatusCode: 200, Header: http.Header{"Date": {date.Format(http.TimeFormat)}}}
+	if lifetime := policy.freshnessLifetime(entry); lifetime != 10*time.Minute {
+		t.Errorf("Expected default TTL, got %v", lifetime)
+	}
+}
+
+func TestCacheEntryAge(t *testing.T) {
+	date := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	entry := &cacheEntry{
+		Header:       http.Header{"Date": {date.Format(http.TimeFormat)}, "Age": {"30"}},
+		RequestTime:  date.Add(time.Second),
+		ResponseTime: date.Add(3 * time.Second),
+	}
+	// Age 30 plus 2s response delay plus 10s in the cache
+	if age := entry.age(date.Add(13 * time.Second)); age != 42*time.Second {
+		t.Errorf("Expected age 42s, got %v", age)
+	}
+}
+
+func TestMemoryCacheEviction(t *testing.T) {
+	cache := newMemoryCache(100)
+	entry := func(key string, size int) *cacheEntry {
+		return &cacheEntry{Key: key, Body: make([]byte, size-len(key))}
+	}
+
+	cache.set(entry("a", 40))
+	cache.set(entry("b", 40))
+	cache.get("a")
+	cache.set(entry("c", 40))
+	if cache.get("b") != nil {
+		t.Error("Expected least recently used entry to be evicted")
+	}
+	if cache.get("a") == nil || cache.get("c") == nil {
+		t.Error("Expected recently used entries to be kept")
+	}
+
+	cache.set(entry("huge", 200))
+	if cache.get("huge") != nil || cache.get("a") == nil {
+		t.Error("Expected entries larger than the cache to be skipped")
+	}
+
+	cache.delete("a")
+	if cache.get("a") != nil {
+		t.Error("Expected deleted entry to be removed")
+	}
+}
+
+func TestDiskCache(t *testing.T) {
+	dir := t.TempDir()
+	store, err := newCacheStore(config.CacheConfig{Disk: config.DiskCacheConfig{Dir: dir, MaxSize: 64 * config.Kilobyte}})
+	if err != nil {
+		t.Fatalf("Failed to create cache: %v", err)
+	}
+	store.set(&cacheEntry{
+		Key:        "example.com/schemas/scl.xsd",
+		StatusCode: 200,
+		Header:     http.Header{"Etag": {`"v1"`}},
+		Body:       []byte("<schema/>"),
+		Vary:       map[string]string{"Accept-Language": "de"},
+	})
+	store.(*tieredCache).disk.flush()
+
+	// Entries survive a restart
+	reopened, err := newCacheStore(config.CacheConfig{Disk: config.DiskCacheConfig{Dir: dir, MaxSize: 64 * config.Kilobyte}})
+	if err != nil {
+		t.Fatalf("Failed to reopen cache: %v", err)
+	}
+	entry := reopened.get("example.com/schemas/scl.xsd")
+	if entry == nil || string(entry.Body) != "<schema/>" || entry.Header.Get("ETag") != `"v1"` || entry.Vary["Accept-Language"] != "de" {
+		t.Fatalf("Expected entry to be loaded from disk, got %+v", entry)
+	}
+	if reopened.get("example.com/other") != nil {
+		t.Error("Expected miss for unknown key")
+	}
+
+	reopened.delete("example.com/schemas/scl.xsd")
+	if reopened.get("example.com/schemas/scl.xsd") != nil {
+		t.Error("Expected deleted entry to be removed from memory and disk")
+	}
+
+	// The disk size limit evicts the oldest files
+	disk, err := newDiskCache(t.TempDir(), 2048)
+	if err != nil {
+		t.Fatalf("Failed to create disk cache: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		disk.set(&cacheEntry{Key: fmt.Sprint("key", i), Body: make([]byte, 800)})
+	}
+	disk.flush()
+	if disk.get("key0") != nil || disk.get("key2") == nil {
+		t.Error("Expected the oldest entry to be evicted from disk")
+	}
+
+	// Queued entries are served until they are written, and entries deleted
+	// while queued are never written
+	queue := &diskCache{
+		dir:     t.TempDir(),
+		index:   newLRUIndex(2048),
+		pending: make(map[string]*cacheEntry),
+		writes:  make(chan *cacheEntry, 1),
+	}
+	queue.set(&cacheEntry{Key: "deleted", Body: []byte("deleted")})
+	if entry := queue.get("deleted"); entry == nil || string(entry.Body) != "deleted" {
+		t.Errorf("Expected queued entry to be served, got %+v", entry)
+	}
+	queue.delete("deleted")
+	queue.write(<-queue.writes)
+	if queue.get("deleted") != nil {
+		t.Error("Expected entry deleted while queued not to be written")
+	}
+	if _, err := os.Stat(filepath.Join(queue.dir, queue.fileName("deleted"))); err == nil {
+		t.Error("Expected no file for the deleted entry")
+	}
+
+	// Entries are not stored on disk when the queue is full
+	queue.set(&cacheEntry{Key: "first", Body: []byte("first")})
+	queue.set(&cacheEntry{Key: "second", Body: []byte("second")})
+	queue.write(<-queue.writes)
+	if queue.get("first") == nil || queue.get("second") != nil {
+		t.Error("Expected only the entry fitting into the queue to be written")
+	}
+}
@@ -0,0 +1,415 @@
+package middleware
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ase-compas/compas-auth-proxy/internal/config"
+)
+
+// cacheEntry is a stored response. Fields are exported for the disk encoding.
+type cacheEntry struct {
+	Key          string
+	StatusCode   int
+	Header       http.Header
+	Body         []byte
+	Vary         map[string]string // Values of the request headers named by Vary
+	RequestTime  time.Time         // When the request was sent to the upstream
+	ResponseTime time.Time         // When the response was received
+}
+
+// size estimates the memory used by the entry
+func (e *cacheEntry) size() int64 {
+	size := int64(len(e.Key) + len(e.Body))
+	for name, values := range e.Header {
+		size += int64(len(name))
+		for _, value := range values {
+			size += int64(len(value))
+		}
+	}
+	return size
+}
+
+// cacheStore keeps cached responses by key
+type cacheStore interface {
+	get(key string) *cacheEntry
+	set(entry *cacheEntry)
+	delete(key string)
+}
+
+// newCacheStore creates the memory cache and, if a directory is configured,
+// the disk cache behind it
+func newCacheStore(cfg config.CacheConfig) (cacheStore, error) {
+	maxSize := int64(cfg.MaxSize)
+	if maxSize == 0 {
+		maxSize = int64(64 * config.Megabyte)
+	}
+	memory := newMemoryCache(maxSize)
+	if cfg.Disk.Dir == "" {
+		return memory, nil
+	}
+
+	diskSize := int64(cfg.Disk.MaxSize)
+	if diskSize == 0 {
+		diskSize = int64(config.Gigabyte)
+	}
+	disk, err := newDiskCache(cfg.Disk.Dir, diskSize)
+	if err != nil {
+		return nil, err
+	}
+	return &tieredCache{memory: memory, disk: disk}, nil
+}
+
+// lruItem is an item tracked by an lruIndex
+type lruItem struct {
+	key  string
+	size int64
+}
+
+// lruIndex tracks the size and recency of cached items and decides which items
+// are evicted
+type lruIndex struct {
+	maxSize int64
+	size    int64
+	order   *list.List // Most recently used first
+	items   map[string]*list.Element
+}
+
+// newLRUIndex creates an index holding items of at most maxSize bytes in total
+func newLRUIndex(maxSize int64) *lruIndex {
+	return &lruIndex{maxSize: maxSize, order: list.New(), items: make(map[string]*list.Element)}
+}
+
+// touch marks the item as recently used and reports whether it exists
+func (l *lruIndex) touch(key string) bool {
+	element, ok := l.items[key]
+	if ok {
+		l.order.MoveToFront(element)
+	}
+	return ok
+}
+
+// add adds or replaces an item and returns the keys of the items evicted to
+// make room for it. Items larger than the index are not added.
+func (l *lruIndex) add(key string, size int64) (bool, []string) {
+	l.remove(key)
+	if size > l.maxSize {
+		return false, nil
+	}
+	l.items[key] = l.order.PushFront(&lruItem{key: key, size: size})
+	l.size += size
+
+	var evicted []string
+	for l.size > l.maxSize {
+		oldest := l.order.Back().Value.(*lruItem)
+		l.remove(oldest.key)
+		evicted = append(evicted, oldest.key)
+	}
+	return true, evicted
+}
+
+// remove removes an item and reports whether it existed
+func (l *lruIndex) remove(key string) bool {
+	element, ok := l.items[key]
+	if !ok {
+		return false
+	}
+	l.order.Remove(element)
+	delete(l.items, key)
+	l.size -= element.Value.(*lruItem).size
+	return true
+}
+
+// memoryCache keeps the most recently used responses in memory
+type memoryCache struct {
+	mu      sync.Mutex
+	index   *lruIndex
+	entries map[string]*cacheEntry
+}
+
+// newMemoryCache creates a memory cache holding at most maxSize bytes
+func newMemoryCache(maxSize int64) *memoryCache {
+	return &memoryCache{index: newLRUIndex(maxSize), entries: make(map[string]*cacheEntry)}
+}
+
+func (c *memoryCache) get(key string) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.index.touch(key) {
+		return nil
+	}
+	return c.entries[key]
+}
+
+func (c *memoryCache) set(entry *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	added, evicted := c.index.add(entry.Key, entry.size())
+	for _, key := range evicted {
+		delete(c.entries, key)
+	}
+	if added {
+		c.entries[entry.Key] = entry
+	} else {
+		delete(c.entries, entry.Key)
+	}
+}
+
+func (c *memoryCache) delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.index.remove(key)
+	delete(c.entries, key)
+}
+
+// diskCacheSuffix is the file name suffix of cached responses on disk
+const diskCacheSuffix = ".cache"
+
+// diskCacheQueueSize bounds the number of entries waiting to be written to
+// disk; entries are dropped from the disk cache when the queue is full
+const diskCacheQueueSize = 32
+
+// diskCache keeps responses as files in a directory. Files are named by the
+// hash of their key; the index is rebuilt from the directory at startup.
+// Entries are written in the background so storing a response never waits
+// for the disk.
+type diskCache struct {
+	dir     string
+	mu      sync.Mutex
+	index   *lruIndex              // Keyed by file name
+	pending map[string]*cacheEntry // Entries queued for writing by file name
+	writes  chan *cacheEntry
+	queued  sync.WaitGroup
+}
+
+// newDiskCache opens the cache in the directory, creating it if needed
+func newDiskCache(dir string, maxSize int64) (*diskCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	type cachedFile struct {
+		name    string
+		size    int64
+		modTime time.Time
+	}
+	var cached []cachedFile
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		if !strings.HasSuffix(file.Name(), diskCacheSuffix) {
+			// Remove files left over from interrupted writes
+			os.Remove(filepath.Join(dir, file.Name()))
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+		cached = append(cached, cachedFile{name: file.Name(), size: info.Size(), modTime: info.ModTime()})
+	}
+
+	// Add the oldest files first so they are evicted first
+	sort.Slice(cached, func(i, j int) bool { return cached[i].modTime.Before(cached[j].modTime) })
+	c := &diskCache{
+		dir:     dir,
+		index:   newLRUIndex(maxSize),
+		pending: make(map[string]*cacheEntry),
+		writes:  make(chan *cacheEntry, diskCacheQueueSize),
+	}
+	for _, file := range cached {
+		added, evicted := c.index.add(file.name, file.size)
+		if !added {
+			evicted = append(evicted, file.name)
+		}
+		for _, name := range evicted {
+			os.Remove(filepath.Join(dir, name))
+		}
+	}
+
+	go c.writeQueued()
+	return c, nil
+}
+
+// fileName returns the name of the file storing the key
+func (c *diskCache) fileName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:]) + diskCacheSuffix
+}
+
+func (c *diskCache) get(key string) *cacheEntry {
+	name := c.fileName(key)
+	c.mu.Lock()
+	if entry := c.pending[name]; entry != nil {
+		c.mu.Unlock()
+		return entry
+	}
+	exists := c.index.touch(name)
+	c.mu.Unlock()
+	if !exists {
+		return nil
+	}
+
+	data, err := os.ReadFile(filepath.Join(c.dir, name))
+	if err != nil {
+		return nil
+	}
+	var entry cacheEntry
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&entry); err != nil {
+		log.Printf("Removing unreadable cache file %s: %v", name, err)
+		c.delete(key)
+		return nil
+	}
+	if entry.Key != key {
+		return nil
+	}
+	return &entry
+}
+
+// set queues the entry for writing in the background
+func (c *diskCache) set(entry *cacheEntry) {
+	name := c.fileName(entry.Key)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.queued.Add(1)
+	select {
+	case c.writes <- entry:
+		c.pending[name] = entry
+	default:
+		// An older version of the entry must not outlive the new one
+		c.queued.Done()
+		delete(c.pending, name)
+		if c.index.remove(name) {
+			os.Remove(filepath.Join(c.dir, name))
+		}
+		log.Printf("Disk cache write queue is full, not storing %s on disk", entry.Key)
+	}
+}
+
+// writeQueued writes queued entries until the process exits
+func (c *diskCache) writeQueued() {
+	for entry := range c.writes {
+		c.write(entry)
+		c.queued.Done()
+	}
+}
+
+// flush waits until all queued entries are written
+func (c *diskCache) flush() {
+	c.queued.Wait()
+}
+
+// write stores an entry in its file unless it was deleted or replaced while
+// it was queued
+func (c *diskCache) write(entry *cacheEntry) {
+	name := c.fileName(entry.Key)
+	tmpName, size, err := c.writeTemp(entry)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	current := c.pending[name] == entry
+	if current {
+		delete(c.pending, name)
+	}
+	if err != nil {
+		log.Printf("Failed to write cache entry %s: %v", entry.Key, err)
+		return
+	}
+	if !current {
+		os.Remove(tmpName)
+		return
+	}
+
+	added, evicted := c.index.add(name, size)
+	if !added {
+		os.Remove(tmpName)
+		os.Remove(filepath.Join(c.dir, name))
+		return
+	}
+	if err := os.Rename(tmpName, filepath.Join(c.dir, name)); err != nil {
+		os.Remove(tmpName)
+		c.index.remove(name)
+		log.Printf("Failed to write cache entry %s: %v", entry.Key, err)
+	}
+	for _, evictedName := range evicted {
+		os.Remove(filepath.Join(c.dir, evictedName))
+	}
+}
+
+// writeTemp encodes an entry into a temporary file, so readers never see
+// partial files, and returns its name and size
+func (c *diskCache) writeTemp(entry *cacheEntry) (string, int64, error) {
+	var data bytes.Buffer
+	if err := gob.NewEncoder(&data).Encode(entry); err != nil {
+		return "", 0, err
+	}
+
+	tmp, err := os.CreateTemp(c.dir, "*.tmp")
+	if err != nil {
+		return "", 0, err
+	}
+	_, err = tmp.Write(data.Bytes())
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", 0, err
+	}
+	return tmp.Name(), int64(data.Len()), nil
+}
+
+func (c *diskCache) delete(key string) {
+	name := c.fileName(key)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pending, name)
+	if c.index.remove(name) {
+		os.Remove(filepath.Join(c.dir, name))
+	}
+}
+
+// tieredCache keeps responses in memory and on disk. Responses only found on
+// disk are loaded into memory again.
+type tieredCache struct {
+	memory *memoryCache
+	disk   *diskCache
+}
+
+func (c *tieredCache) get(key string) *cacheEntry {
+	if entry := c.memory.get(key); entry != nil {
+		return entry
+	}
+	entry := c.disk.get(key)
+	if entry != nil {
+		c.memory.set(entry)
+	}
+	return entry
+}
+
+func (c *tieredCache) set(entry *cacheEntry) {
+	c.memory.set(entry)
+	c.disk.set(entry)
+}
+
+func (c *tieredCache) delete(key string) {
+	c.memory.delete(key)
+	c.disk.delete(key)
+}
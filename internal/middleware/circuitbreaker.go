@@ -0,0 +1,229 @@
+package middleware
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/ase-compas/compas-auth-proxy/internal/config"
+)
+
+// CircuitOpenError is returned when all upstream targets of a route are
+// short-circuited by their breakers
+type CircuitOpenError struct {
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("circuit breaker open, retry after %v", e.RetryAfter)
+}
+
+// RetryAfterSeconds returns the Retry-After value in whole seconds
+func (e *CircuitOpenError) RetryAfterSeconds() int {
+	return int(math.Ceil(e.RetryAfter.Seconds()))
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// circuitBreaker tracks the outcomes of requests to a single upstream target.
+// A nil breaker always allows requests.
+type circuitBreaker struct {
+	name   string
+	config config.CircuitBreakerConfig
+	now    func() time.Time
+
+	mu          sync.Mutex
+	state       breakerState
+	generation  uint64 // incremented on every state change
+	openUntil   time.Time
+	windowStart time.Time
+	requests    int
+	failures    int
+	consecutive int
+
+	halfOpenInFlight  int
+	halfOpenSuccesses int
+}
+
+// newCircuitBreaker creates a breaker, filling in defaults for unset settings
+func newCircuitBreaker(name string, cfg config.CircuitBreakerConfig) *circuitBreaker {
+	if !cfg.Enabled {
+		return nil
+	}
+	if cfg.ConsecutiveFailures == 0 {
+		cfg.ConsecutiveFailures = 5
+	}
+	if cfg.FailureRate == 0 {
+		cfg.FailureRate = 0.5
+	}
+	if cfg.MinimumRequests == 0 {
+		cfg.MinimumRequests = 20
+	}
+	if cfg.Window == 0 {
+		cfg.Window = 30 * time.Second
+	}
+	if cfg.OpenDuration == 0 {
+		cfg.OpenDuration = 30 * time.Second
+	}
+	if cfg.HalfOpenRequests == 0 {
+		cfg.HalfOpenRequests = 1
+	}
+	return &circuitBreaker{name: name, config: cfg, now: time.Now}
+}
+
+// available reports whether the breaker would currently let a request through
+func (b *circuitBreaker) available() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		return !b.now().Before(b.openUntil)
+	case breakerHalfOpen:
+		return b.halfOpenInFlight < b.config.HalfOpenRequests-b.halfOpenSuccesses
+	default:
+		return true
+	}
+}
+
+// allow claims permission for a request. The returned generation must be
+// passed to record or ignore once the outcome is known.
+func (b *circuitBreaker) allow() (uint64, bool) {
+	if b == nil {
+		return 0, true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	switch b.state {
+	case breakerOpen:
+		if now.Before(b.openUntil) {
+			return 0, false
+		}
+		b.transition(breakerHalfOpen)
+		fallthrough
+	case breakerHalfOpen:
+		if b.halfOpenInFlight >= b.config.HalfOpenRequests-b.halfOpenSuccesses {
+			return 0, false
+		}
+		b.halfOpenInFlight++
+	default:
+		if now.Sub(b.windowStart) >= b.config.Window {
+			b.windowStart = now
+			b.requests = 0
+			b.failures = 0
+		}
+	}
+	return b.generation, true
+}
+
+// record reports the outcome of a request allowed in the given generation
+func (b *circuitBreaker) record(generation uint64, success bool) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// Outcomes of requests started before the last state change are stale
+	if generation != b.generation {
+		return
+	}
+
+	switch b.state {
+	case breakerHalfOpen:
+		b.halfOpenInFlight--
+		if !success {
+			b.trip()
+			return
+		}
+		b.halfOpenSuccesses++
+		if b.halfOpenSuccesses >= b.config.HalfOpenRequests {
+			b.transition(breakerClosed)
+		}
+	case breakerClosed:
+		b.requests++
+		if success {
+			b.consecutive = 0
+		} else {
+			b.failures++
+			b.consecutive++
+		}
+		if b.consecutive >= b.config.ConsecutiveFailures ||
+			(b.requests >= b.config.MinimumRequests && float64(b.failures)/float64(b.requests) >= b.config.FailureRate) {
+			b.trip()
+		}
+	}
+}
+
+// ignore releases a request without counting its outcome, e.g. when the client
+// went away before the upstream answered
+func (b *circuitBreaker) ignore(generation uint64) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if generation == b.generation && b.state == breakerHalfOpen {
+		b.halfOpenInFlight--
+	}
+}
+
+// retryAfter returns how long the breaker stays open
+func (b *circuitBreaker) retryAfter() time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state != breakerOpen {
+		return 0
+	}
+	return b.openUntil.Sub(b.now())
+}
+
+// trip opens the breaker; the caller must hold the lock
+func (b *circuitBreaker) trip() {
+	b.transition(breakerOpen)
+	b.openUntil = b.now().Add(b.config.OpenDuration)
+}
+
+// transition moves the breaker into a new state; the caller must hold the lock
+func (b *circuitBreaker) transition(state breakerState) {
+	if b.state != state {
+		log.Printf("Circuit breaker for %s changed from %s to %s", b.name, b.state, state)
+	}
+	b.state = state
+	b.generation++
+	b.windowStart = b.now()
+	b.requests = 0
+	b.failures = 0
+	b.consecutive = 0
+	b.halfOpenInFlight = 0
+	b.halfOpenSuccesses = 0
+}
@@ -0,0 +1,125 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ase-compas/compas-auth-proxy/internal/config"
+)
+
+func newTestBreaker(cfg config.CircuitBreakerConfig) (*circuitBreaker, *time.Time) {
+	now := time.Now()
+	cfg.Enabled = true
+	breaker := newCircuitBreaker("test", cfg)
+	breaker.now = func() time.Time { return now }
+	return breaker, &now
+}
+
+func TestCircuitBreakerLifecycle(t *testing.T) {
+	breaker, now := newTestBreaker(config.CircuitBreakerConfig{
+		ConsecutiveFailures: 3,
+		OpenDuration:        10 * time.Second,
+		HalfOpenRequests:    1,
+	})
+
+	for i := 0; i < 3; i++ {
+		generation, ok := breaker.allow()
+		if !ok {
+			t.Fatalf("Expected request %d to be allowed while closed", i)
+		}
+		breaker.record(generation, false)
+	}
+	if _, ok := breaker.allow(); ok {
+		t.Fatal("Expected breaker to open after consecutive failures")
+	}
+	if wait := breaker.retryAfter(); wait != 10*time.Second {
+		t.Errorf("Expected retry after 10s, got %v", wait)
+	}
+
+	// After the open duration a single probe is let through
+	*now = now.Add(10 * time.Second)
+	probe, ok := breaker.allow()
+	if !ok {
+		t.Fatal("Expected half-open probe to be allowed")
+	}
+	if _, ok := breaker.allow(); ok {
+		t.Error("Expected only one concurrent half-open probe")
+	}
+
+	// A failed probe opens the breaker again
+	breaker.record(probe, false)
+	if breaker.available() {
+		t.Fatal("Expected failed probe to reopen the breaker")
+	}
+
+	*now = now.Add(10 * time.Second)
+	probe, _ = breaker.allow()
+	breaker.record(probe, true)
+	if breaker.state != breakerClosed {
+		t.Errorf("Expected successful probe to close the breaker, got %s", breaker.state)
+	}
+}
+
+func TestCircuitBreakerFailureRate(t *testing.T) {
+	breaker, _ := newTestBreaker(config.CircuitBreakerConfig{
+		ConsecutiveFailures: 100,
+		FailureRate:         0.5,
+		MinimumRequests:     10,
+	})
+
+	// Alternate successes and failures: never consecutive, but 50% failures
+	for i := 0; i < 10; i++ {
+		generation, ok := breaker.allow()
+		if !ok {
+			t.Fatalf("Expected request %d to be allowed", i)
+		}
+		breaker.record(generation, i%2 == 1)
+	}
+	if breaker.state != breakerOpen {
+		t.Errorf("Expected breaker to open at the failure rate, got %s", breaker.state)
+	}
+}
+
+func TestCircuitBreakerFastFail(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer backend.Close()
+
+	middleware, err := NewMultiProxyMiddleware(&config.Config{
+		UpstreamRoutes: []config.UpstreamRoute{{
+			Path:        "/api/location",
+			UpstreamURL: backend.URL,
+			CircuitBreaker: config.CircuitBreakerConfig{
+				Enabled:             true,
+				ConsecutiveFailures: 2,
+				OpenDuration:        30 * time.Second,
+			},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+
+	serve := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		middleware.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/api/location/1", nil))
+		return rec
+	}
+
+	for i := 0; i < 2; i++ {
+		if rec := serve(); rec.Code != http.StatusInternalServerError {
+			t.Fatalf("Expected upstream 500 to be passed through, got %d", rec.Code)
+		}
+	}
+
+	rec := serve()
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected 503 while breaker is open, got %d", rec.Code)
+	}
+	if rec.Header().Get("Retry-After") != "30" {
+		t.Errorf("Expected Retry-After 30, got %q", rec.Header().Get("Retry-After"))
+	}
+}
@@ -0,0 +1,131 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errClientCredentialsUnavailable is returned when a route forwards client
+// credentials tokens but no token source has been configured
+var errClientCredentialsUnavailable = errors.New("client credentials are not configured")
+
+// ClientTokenSource provides tokens issued to the gateway itself
+type ClientTokenSource interface {
+	ClientToken(ctx context.Context, scopes []string) (string, error)
+}
+
+// clientToken is a cached client credentials token
+type clientToken struct {
+	token     string
+	expiresAt time.Time
+	renewAt   time.Time
+	renewing  bool
+}
+
+// ClientCredentialsClient obtains client_credentials tokens from the OIDC
+// provider. Tokens are cached per scope set and renewed in the background once
+// most of their lifetime has passed, so requests rarely wait for the provider.
+type ClientCredentialsClient struct {
+	httpClient    *http.Client
+	tokenEndpoint string
+	clientID      string
+	clientSecret  string
+	now           func() time.Time
+
+	mu     sync.Mutex
+	tokens map[string]*clientToken
+}
+
+// ClientCredentials returns a client credentials token source using the
+// provider and client credentials of the middleware
+func (m *OIDCMiddleware) ClientCredentials() *ClientCredentialsClient {
+	return &ClientCredentialsClient{
+		httpClient:    m.httpClient,
+		tokenEndpoint: m.providerConfig.TokenEndpoint,
+		clientID:      m.config.OIDCClientID,
+		clientSecret:  m.config.OIDCClientSecret,
+		now:           time.Now,
+		tokens:        make(map[string]*clientToken),
+	}
+}
+
+// ClientToken returns a token of the gateway for the scopes
+func (c *ClientCredentialsClient) ClientToken(ctx context.Context, scopes []string) (string, error) {
+	key := scopeKey(scopes)
+	now := c.now()
+
+	c.mu.Lock()
+	cached := c.tokens[key]
+	if cached != nil && now.Before(cached.expiresAt) {
+		if !now.Before(cached.renewAt) && !cached.renewing {
+			// Renew proactively while the current token is still valid
+			cached.renewing = true
+			go c.renew(key, scopes)
+		}
+		token := cached.token
+		c.mu.Unlock()
+		return token, nil
+	}
+	c.mu.Unlock()
+
+	return c.fetch(ctx, key, scopes)
+}
+
+// renew replaces a cached token that is about to expire
+func (c *ClientCredentialsClient) renew(key string, scopes []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if _, err := c.fetch(ctx, key, scopes); err != nil {
+		log.Printf("Failed to renew client credentials token: %v", err)
+		c.mu.Lock()
+		if cached := c.tokens[key]; cached != nil {
+			cached.renewing = false
+		}
+		c.mu.Unlock()
+	}
+}
+
+// fetch requests a new token and caches it
+func (c *ClientCredentialsClient) fetch(ctx context.Context, key string, scopes []string) (string, error) {
+	data := url.Values{}
+	data.Set("grant_type", "client_credentials")
+	data.Set("client_id", c.clientID)
+	data.Set("client_secret", c.clientSecret)
+	if len(scopes) > 0 {
+		data.Set("scope", strings.Join(scopes, " "))
+	}
+
+	tokenResp, err := requestToken(ctx, c.httpClient, c.tokenEndpoint, data)
+	if err != nil {
+		return "", fmt.Errorf("client credentials request failed: %w", err)
+	}
+
+	if tokenResp.ExpiresIn > 0 {
+		lifetime := time.Duration(tokenResp.ExpiresIn) * time.Second
+		now := c.now()
+		c.mu.Lock()
+		c.tokens[key] = &clientToken{
+			token:     tokenResp.AccessToken,
+			expiresAt: now.Add(lifetime - lifetime/10),
+			renewAt:   now.Add(lifetime * 3 / 4),
+		}
+		c.mu.Unlock()
+	}
+	return tokenResp.AccessToken, nil
+}
+
+// scopeKey identifies a scope set independent of the order of the scopes
+func scopeKey(scopes []string) string {
+	sorted := append([]string(nil), scopes...)
+	sort.Strings(sorted)
+	return strings.Join(sorted, " ")
+}
@@ -0,0 +1,77 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ase-compas/compas-auth-proxy/internal/config"
+)
+
+func TestClientCredentialsTokens(t *testing.T) {
+	var requests int32
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&requests, 1)
+		r.ParseForm()
+		if r.Form.Get("grant_type") != "client_credentials" || r.Form.Get("client_secret") != "secret" {
+			t.Errorf("Unexpected client credentials request: %v", r.Form)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": fmt.Sprintf("gateway-token-%d", n),
+			"expires_in":   100,
+		})
+	}))
+	defer provider.Close()
+
+	oidc := &OIDCMiddleware{
+		config:         &config.Config{OIDCClientID: "gateway", OIDCClientSecret: "secret"},
+		httpClient:     provider.Client(),
+		providerConfig: &ProviderConfig{TokenEndpoint: provider.URL},
+	}
+	source := oidc.ClientCredentials()
+	var now atomic.Value
+	now.Store(time.Now())
+	source.now = func() time.Time { return now.Load().(time.Time) }
+
+	token, err := source.ClientToken(context.Background(), []string{"scl:read", "location:read"})
+	if err != nil || token != "gateway-token-1" {
+		t.Fatalf("Expected a new token, got %q (%v)", token, err)
+	}
+
+	// Cached regardless of the order of the scopes
+	if token, _ := source.ClientToken(context.Background(), []string{"location:read", "scl:read"}); token != "gateway-token-1" {
+		t.Errorf("Expected cached token, got %q", token)
+	}
+
+	// Renewed in the background once most of the lifetime has passed
+	now.Store(now.Load().(time.Time).Add(80 * time.Second))
+	if token, _ := source.ClientToken(context.Background(), []string{"scl:read", "location:read"}); token != "gateway-token-1" {
+		t.Errorf("Expected the still valid token during renewal, got %q", token)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		token, _ := source.ClientToken(context.Background(), []string{"scl:read", "location:read"})
+		if token == "gateway-token-2" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected renewed token, got %q", token)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("Expected 2 token requests, got %d", n)
+	}
+}
+
+// fakeClientTokens returns a token derived from the requested scopes
+type fakeClientTokens struct{}
+
+func (fakeClientTokens) ClientToken(ctx context.Context, scopes []string) (string, error) {
+	return "client-" + scopeKey(scopes), nil
+}
@@ -0,0 +1,134 @@
+package middleware
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// TrustedProxies determines the originating client of requests that were
+// forwarded by known reverse proxies (e.g. a Kubernetes ingress)
+type TrustedProxies struct {
+	networks []*net.IPNet
+}
+
+// NewTrustedProxies creates a trusted proxy set from a list of CIDRs or IP addresses
+func NewTrustedProxies(cidrs []string) (*TrustedProxies, error) {
+	trusted := &TrustedProxies{}
+	for _, cidr := range cidrs {
+		network, err := parseNetwork(cidr)
+		if err != nil {
+			return nil, err
+		}
+		trusted.networks = append(trusted.networks, network)
+	}
+	return trusted, nil
+}
+
+// parseNetwork parses a CIDR or a single IP address into a network
+func parseNetwork(value string) (*net.IPNet, error) {
+	value = strings.TrimSpace(value)
+	if !strings.Contains(value, "/") {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid trusted proxy address %q", value)
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 8 * net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+
+	_, network, err := net.ParseCIDR(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trusted proxy network %q: %v", value, err)
+	}
+	return network, nil
+}
+
+// IsTrusted reports whether the given IP address belongs to a trusted proxy
+func (t *TrustedProxies) IsTrusted(ip string) bool {
+	if t == nil {
+		return false
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range t.networks {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the IP address of the client that originated the request.
+// X-Forwarded-For is only honored when the request was received from a
+// trusted proxy; the rightmost untrusted address is taken as the client.
+func (t *TrustedProxies) ClientIP(r *http.Request) string {
+	ip := remoteIP(r)
+	if !t.IsTrusted(ip) {
+		return ip
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(forwarded[i])
+		if hop == "" || net.ParseIP(hop) == nil {
+			break
+		}
+		ip = hop
+		if !t.IsTrusted(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// IsHTTPS reports whether the client used HTTPS, either directly or via a
+// trusted TLS-terminating proxy that set X-Forwarded-Proto
+func (t *TrustedProxies) IsHTTPS(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	if !t.IsTrusted(remoteIP(r)) {
+		return false
+	}
+
+	// The first entry is the protocol the client connected with
+	proto := strings.Split(r.Header.Get("X-Forwarded-Proto"), ",")[0]
+	return strings.EqualFold(strings.TrimSpace(proto), "https")
+}
+
+// remoteIP returns the IP address of the connected peer
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// sameNetwork reports whether two IP addresses share the given prefix length
+// (ipv4Prefix for IPv4 addresses, ipv6Prefix for IPv6 addresses)
+func sameNetwork(a, b string, ipv4Prefix, ipv6Prefix int) bool {
+	ipA, ipB := net.ParseIP(a), net.ParseIP(b)
+	if ipA == nil || ipB == nil {
+		return a == b
+	}
+
+	if v4A, v4B := ipA.To4(), ipB.To4(); v4A != nil || v4B != nil {
+		if v4A == nil || v4B == nil {
+			return false
+		}
+		mask := net.CIDRMask(ipv4Prefix, 8*net.IPv4len)
+		return v4A.Mask(mask).Equal(v4B.Mask(mask))
+	}
+
+	mask := net.CIDRMask(ipv6Prefix, 8*net.IPv6len)
+	return ipA.Mask(mask).Equal(ipB.Mask(mask))
+}
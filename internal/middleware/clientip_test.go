@@ -0,0 +1,64 @@
+package middleware
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted, err := NewTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1"})
+	if err != nil {
+		t.Fatalf("Failed to parse trusted proxies: %v", err)
+	}
+
+	testCases := []struct {
+		remoteAddr   string
+		forwardedFor string
+		expectedIP   string
+	}{
+		{"203.0.113.7:1234", "", "203.0.113.7"},
+		// Untrusted peers cannot spoof their address
+		{"203.0.113.7:1234", "198.51.100.1", "203.0.113.7"},
+		{"10.1.2.3:1234", "198.51.100.1", "198.51.100.1"},
+		// Trusted hops are skipped from the right
+		{"10.1.2.3:1234", "198.51.100.1, 192.168.1.1", "198.51.100.1"},
+		// Client-supplied entries left of the first untrusted hop are ignored
+		{"10.1.2.3:1234", "1.1.1.1, 198.51.100.1, 10.9.9.9", "198.51.100.1"},
+		{"10.1.2.3:1234", "garbage", "10.1.2.3"},
+	}
+
+	for _, tc := range testCases {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tc.remoteAddr
+		if tc.forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", tc.forwardedFor)
+		}
+
+		if ip := trusted.ClientIP(req); ip != tc.expectedIP {
+			t.Errorf("ClientIP(%s, %q): expected %s, got %s", tc.remoteAddr, tc.forwardedFor, tc.expectedIP, ip)
+		}
+	}
+
+	if _, err := NewTrustedProxies([]string{"not-an-ip"}); err == nil {
+		t.Error("Expected invalid trusted proxy to be rejected")
+	}
+}
+
+func TestSameNetwork(t *testing.T) {
+	testCases := []struct {
+		a, b     string
+		expected bool
+	}{
+		{"198.51.100.1", "198.51.100.200", true},
+		{"198.51.100.1", "198.51.101.1", false},
+		{"2001:db8:1:1::1", "2001:db8:1:1::ffff", true},
+		{"2001:db8:1:1::1", "2001:db8:1:2::1", false},
+		{"198.51.100.1", "2001:db8::1", false},
+	}
+
+	for _, tc := range testCases {
+		if result := sameNetwork(tc.a, tc.b, 24, 64); result != tc.expected {
+			t.Errorf("sameNetwork(%s, %s): expected %v, got %v", tc.a, tc.b, tc.expected, result)
+		}
+	}
+}
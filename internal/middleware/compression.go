@@ -0,0 +1,232 @@
+package middleware
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/ase-compas/compas-auth-proxy/internal/config"
+	"github.com/klauspost/compress/zstd"
+)
+
+// defaultCompressionTypes are the media types compressed when none are
+// configured
+var defaultCompressionTypes = []string{
+	"text/*",
+	"application/json",
+	"application/*+json",
+	"application/xml",
+	"application/*+xml",
+	"application/javascript",
+	"image/svg+xml",
+}
+
+// streamingContentTypes are never compressed because compression buffers
+// data that the client expects immediately
+var streamingContentTypes = []string{
+	"text/event-stream",
+	"application/x-ndjson",
+	"application/grpc",
+}
+
+// compressionPolicy compresses upstream responses of a route
+type compressionPolicy struct {
+	algorithms   []string
+	minSize      int64
+	contentTypes []string
+}
+
+// newCompressionPolicy creates the compression policy of a route, or nil if
+// compression is disabled
+func newCompressionPolicy(cfg config.CompressionConfig) *compressionPolicy {
+	if !cfg.Enabled {
+		return nil
+	}
+	p := &compressionPolicy{
+		algorithms:   cfg.Algorithms,
+		minSize:      int64(cfg.MinSize),
+		contentTypes: cfg.ContentTypes,
+	}
+	if len(p.algorithms) == 0 {
+		p.algorithms = []string{config.CompressionBrotli, config.CompressionZstd, config.CompressionGzip}
+	}
+	if p.minSize == 0 {
+		p.minSize = int64(config.Kilobyte)
+	}
+	if len(p.contentTypes) == 0 {
+		p.contentTypes = defaultCompressionTypes
+	}
+	return p
+}
+
+// negotiate returns the preferred coding of the route accepted by the
+// Accept-Encoding header, or "" if the response is sent uncompressed
+func (p *compressionPolicy) negotiate(acceptEncoding string) string {
+	return negotiateEncoding(acceptEncoding, p.algorithms)
+}
+
+// negotiateEncoding returns the coding accepted by the Accept-Encoding header
+// out of the supported codings, or "" if none is accepted. Codings with a
+// higher quality win; ties are broken by the order of the supported codings.
+func negotiateEncoding(acceptEncoding string, codings []string) string {
+	qualities := make(map[string]float64)
+	wildcard := -1.0
+	for _, entry := range strings.Split(acceptEncoding, ",") {
+		coding, quality := parseAcceptEncoding(entry)
+		if coding == "*" {
+			wildcard = quality
+		} else if coding != "" {
+			qualities[coding] = quality
+		}
+	}
+
+	best, bestQuality := "", 0.0
+	for _, coding := range codings {
+		quality, ok := qualities[coding]
+		if !ok {
+			quality = wildcard
+		}
+		if quality > bestQuality {
+			best, bestQuality = coding, quality
+		}
+	}
+	return best
+}
+
+// parseAcceptEncoding parses a single Accept-Encoding entry such as "br;q=0.8"
+func parseAcceptEncoding(entry string) (string, float64) {
+	parts := strings.Split(entry, ";")
+	coding := strings.ToLower(strings.TrimSpace(parts[0]))
+	quality := 1.0
+	for _, param := range parts[1:] {
+		name, value, found := strings.Cut(strings.TrimSpace(param), "=")
+		if found && strings.EqualFold(name, "q") {
+			q, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return "", 0
+			}
+			quality = q
+		}
+	}
+	return coding, quality
+}
+
+// compressible reports whether the response may be compressed by the gateway
+func (p *compressionPolicy) compressible(resp *http.Response) bool {
+	req := resp.Request
+	switch {
+	case req.Method == http.MethodHead,
+		req.Header.Get("Upgrade") != "",
+		resp.StatusCode < 200,
+		resp.StatusCode == http.StatusNoContent,
+		resp.StatusCode == http.StatusNotModified,
+		resp.StatusCode == http.StatusPartialContent:
+		return false
+	}
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "" && !strings.EqualFold(encoding, "identity") {
+		return false
+	}
+	if strings.Contains(strings.ToLower(resp.Header.Get("Cache-Control")), "no-transform") {
+		return false
+	}
+	if resp.ContentLength >= 0 && resp.ContentLength < p.minSize {
+		return false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	for _, streaming := range streamingContentTypes {
+		if strings.HasPrefix(mediaType, streaming) {
+			return false
+		}
+	}
+	for _, pattern := range p.contentTypes {
+		if mediaTypeMatches(pattern, mediaType) {
+			return true
+		}
+	}
+	return false
+}
+
+// mediaTypeMatches matches a media type against a pattern such as
+// "text/html", "text/*" or "application/*+json"
+func mediaTypeMatches(pattern, mediaType string) bool {
+	pattern = strings.ToLower(pattern)
+	if pattern == mediaType {
+		return true
+	}
+	prefix, suffix, found := strings.Cut(pattern, "*")
+	return found && len(mediaType) >= len(prefix)+len(suffix) &&
+		strings.HasPrefix(mediaType, prefix) && strings.HasSuffix(mediaType, suffix)
+}
+
+// apply compresses the response body if the client accepts a supported coding
+// and the response qualifies. The body is compressed while it is streamed.
+func (p *compressionPolicy) apply(resp *http.Response) {
+	// The response differs by Accept-Encoding whether or not it is compressed
+	resp.Header.Add("Vary", "Accept-Encoding")
+
+	if !p.compressible(resp) {
+		return
+	}
+	coding := p.negotiate(resp.Request.Header.Get("Accept-Encoding"))
+	if coding == "" {
+		return
+	}
+
+	resp.Body = newCompressedBody(resp.Body, coding)
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+	resp.Header.Del("Accept-Ranges")
+	resp.Header.Set("Content-Encoding", coding)
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		// The compressed representation is not byte-identical
+		resp.Header.Set("ETag", "W/"+etag)
+	}
+}
+
+// compressedBody streams the compressed form of an upstream body
+type compressedBody struct {
+	*io.PipeReader
+	source io.ReadCloser
+}
+
+// newCompressedBody compresses source with the coding in the background
+func newCompressedBody(source io.ReadCloser, coding string) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		encoder, err := newEncoder(pw, coding)
+		if err == nil {
+			_, err = io.Copy(encoder, source)
+			if closeErr := encoder.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		pw.CloseWithError(err)
+	}()
+	return &compressedBody{PipeReader: pr, source: source}
+}
+
+// Close stops the compression and closes the upstream body
+func (b *compressedBody) Close() error {
+	b.PipeReader.Close()
+	return b.source.Close()
+}
+
+// newEncoder creates a compressing writer for the coding
+func newEncoder(w io.Writer, coding string) (io.WriteCloser, error) {
+	switch coding {
+	case config.CompressionBrotli:
+		return brotli.NewWriterLevel(w, 5), nil
+	case config.CompressionZstd:
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	default:
+		return gzip.NewWriterLevel(w, gzip.DefaultCompression)
+	}
+}
@@ -0,0 +1,196 @@
+package middleware
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/ase-compas/compas-auth-proxy/internal/config"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestNegotiateCompression(t *testing.T) {
+	policy := newCompressionPolicy(config.CompressionConfig{Enabled: true})
+
+	testCases := []struct {
+		acceptEncoding string
+		expected       string
+	}{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"gzip, deflate, br", "br"},
+		{"gzip, zstd", "zstd"},
+		{"br;q=0.5, gzip", "gzip"},
+		{"br;q=0, gzip;q=0", ""},
+		{"*", "br"},
+		{"*;q=0.5, gzip", "gzip"},
+		{"identity", ""},
+		{"GZIP", "gzip"},
+		{"br;q=invalid, gzip;q=0.1", "gzip"},
+	}
+
+	for _, tc := range testCases {
+		if coding := policy.negotiate(tc.acceptEncoding); coding != tc.expected {
+			t.Errorf("Accept-Encoding %q: expected %q, got %q", tc.acceptEncoding, tc.expected, coding)
+		}
+	}
+
+	gzipOnly := newCompressionPolicy(config.CompressionConfig{Enabled: true, Algorithms: []string{"gzip"}})
+	if coding := gzipOnly.negotiate("br, gzip;q=0.5"); coding != "gzip" {
+		t.Errorf("Expected gzip for a route supporting only gzip, got %q", coding)
+	}
+}
+
+func TestResponseCompression(t *testing.T) {
+	large := strings.Repeat("compressible content ", 200)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/small":
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"ok":true}`)
+		case "/api/image":
+			w.Header().Set("Content-Type", "image/png")
+			io.WriteString(w, large)
+		case "/api/encoded":
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			io.WriteString(gz, large)
+			gz.Close()
+		case "/api/events":
+			w.Header().Set("Content-Type", "text/event-stream")
+			io.WriteString(w, large)
+		case "/api/no-transform":
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Cache-Control", "no-transform")
+			io.WriteString(w, large)
+		default:
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Header().Set("ETag", `"v1"`)
+			w.Header().Set("Accept-Ranges", "bytes")
+			io.WriteString(w, large)
+		}
+	}))
+	defer backend.Close()
+
+	middleware, err := NewMultiProxyMiddleware(&config.Config{
+		UpstreamRoutes: []config.UpstreamRoute{
+			{Path: "/plain", UpstreamURL: backend.URL, StripPath: true},
+			{Path: "/", UpstreamURL: backend.URL, Compression: config.CompressionConfig{Enabled: true}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+
+	testCases := []struct {
+		name           string
+		method         string
+		path           string
+		acceptEncoding string
+		expected       string // Expected Content-Encoding
+	}{
+		{"brotli", "GET", "/api/page", "gzip, deflate, br", "br"},
+		{"zstd", "GET", "/api/page", "zstd", "zstd"},
+		{"gzip", "GET", "/api/page", "gzip", "gzip"},
+		{"not accepted", "GET", "/api/page", "", ""},
+		{"below minimum size", "GET", "/api/small", "gzip", ""},
+		{"content type not allowed", "GET", "/api/image", "gzip", ""},
+		{"already encoded", "GET", "/api/encoded", "br, gzip", "gzip"},
+		{"event stream", "GET", "/api/events", "gzip", ""},
+		{"no-transform", "GET", "/api/no-transform", "gzip", ""},
+		{"HEAD request", "HEAD", "/api/page", "gzip", ""},
+		{"route without compression", "GET", "/plain/api/page", "gzip", ""},
+	}
+
+	for _, tc := range testCases {
+		req := httptest.NewRequest(tc.method, tc.path, nil)
+		if tc.acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", tc.acceptEncoding)
+		}
+		rec := httptest.NewRecorder()
+		middleware.Handler().ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Errorf("%s: expected status 200, got %d", tc.name, rec.Code)
+			continue
+		}
+		if encoding := rec.Header().Get("Content-Encoding"); encoding != tc.expected {
+			t.Errorf("%s: expected Content-Encoding %q, got %q", tc.name, tc.expected, encoding)
+			continue
+		}
+		if tc.expected == "" || tc.path == "/api/encoded" {
+			continue
+		}
+
+		if body := decompress(t, tc.expected, rec.Body); body != large {
+			t.Errorf("%s: decompressed body does not match the upstream body", tc.name)
+		}
+		if rec.Header().Get("Content-Length") != "" {
+			t.Errorf("%s: expected Content-Length to be removed", tc.name)
+		}
+		if rec.Header().Get("Accept-Ranges") != "" {
+			t.Errorf("%s: expected Accept-Ranges to be removed", tc.name)
+		}
+		if etag := rec.Header().Get("ETag"); etag != `W/"v1"` {
+			t.Errorf("%s: expected weak ETag, got %q", tc.name, etag)
+		}
+		if vary := rec.Header().Values("Vary"); len(vary) == 0 || vary[len(vary)-1] != "Accept-Encoding" {
+			t.Errorf("%s: expected Vary: Accept-Encoding, got %v", tc.name, vary)
+		}
+	}
+}
+
+func TestCompressionSkipsUpgrades(t *testing.T) {
+	policy := newCompressionPolicy(config.CompressionConfig{Enabled: true})
+	req := httptest.NewRequest("GET", "/ws", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+
+	for _, status := range []int{http.StatusSwitchingProtocols, http.StatusOK} {
+		resp := &http.Response{
+			StatusCode:    status,
+			Header:        http.Header{"Content-Type": {"text/plain"}},
+			Body:          io.NopCloser(strings.NewReader(strings.Repeat("x", 4096))),
+			ContentLength: -1,
+			Request:       req,
+		}
+		policy.apply(resp)
+		if encoding := resp.Header.Get("Content-Encoding"); encoding != "" {
+			t.Errorf("Status %d: expected upgrade response to stay uncompressed, got %q", status, encoding)
+		}
+	}
+}
+
+// decompress decodes a response body compressed with the coding
+func decompress(t *testing.T, coding string, body io.Reader) string {
+	t.Helper()
+	var reader io.Reader
+	switch coding {
+	case "br":
+		reader = brotli.NewReader(body)
+	case "zstd":
+		decoder, err := zstd.NewReader(body)
+		if err != nil {
+			t.Fatalf("Failed to create zstd decoder: %v", err)
+		}
+		defer decoder.Close()
+		reader = decoder
+	default:
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			t.Fatalf("Failed to create gzip reader: %v", err)
+		}
+		reader = gz
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("Failed to decompress %s body: %v", coding, err)
+	}
+	return string(data)
+}
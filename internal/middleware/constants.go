@@ -1,6 +1,9 @@
 package middleware
 
-import "context"
+import (
+	"context"
+	"net/http"
+)
 
 // Context keys for storing values in request context
 type contextKey string
@@ -11,6 +14,30 @@ const (
 
 	// ContextKeyAccessToken is the context key for storing the access token
 	ContextKeyAccessToken contextKey = "access_token"
+
+	// ContextKeyIDToken is the context key for storing the ID token
+	ContextKeyIDToken contextKey = "id_token"
+
+	// contextKeyUpstreamTarget is the context key for the upstream target selected for a request
+	contextKeyUpstreamTarget contextKey = "upstream_target"
+
+	// contextKeyRequestID is the context key for the ID of a request
+	contextKeyRequestID contextKey = "request_id"
+
+	// contextKeyRouteParams is the context key for the path parameters of the matched route
+	contextKeyRouteParams contextKey = "route_params"
+
+	// contextKeyUpstreamToken is the context key for the token forwarded to the upstream
+	contextKeyUpstreamToken contextKey = "upstream_token"
+
+	// contextKeyAssertion is the context key for the identity assertion forwarded to the upstream
+	contextKeyAssertion contextKey = "assertion"
+
+	// contextKeyGatewayHeader is the context key for the response header the gateway writes to
+	contextKeyGatewayHeader contextKey = "gateway_header"
+
+	// contextKeyCacheLookup is the context key for the cache lookup of a request
+	contextKeyCacheLookup contextKey = "cache_lookup"
 )
 
 // Helper functions for context operations
@@ -44,3 +71,107 @@ func GetAccessTokenFromContext(ctx context.Context) string {
 	}
 	return ""
 }
+
+// SetIDTokenInContext adds the ID token to the context
+func SetIDTokenInContext(ctx context.Context, idToken string) context.Context {
+	return context.WithValue(ctx, ContextKeyIDToken, idToken)
+}
+
+// GetIDTokenFromContext retrieves the ID token from the context
+func GetIDTokenFromContext(ctx context.Context) string {
+	if token, ok := ctx.Value(ContextKeyIDToken).(string); ok {
+		return token
+	}
+	return ""
+}
+
+// setUpstreamTargetInContext adds the selected upstream target to the context
+func setUpstreamTargetInContext(ctx context.Context, target *Target) context.Context {
+	return context.WithValue(ctx, contextKeyUpstreamTarget, target)
+}
+
+// getUpstreamTargetFromContext retrieves the selected upstream target from the context
+func getUpstreamTargetFromContext(ctx context.Context) *Target {
+	if target, ok := ctx.Value(contextKeyUpstreamTarget).(*Target); ok {
+		return target
+	}
+	return nil
+}
+
+// setRequestIDInContext adds the request ID to the context
+func setRequestIDInContext(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, contextKeyRequestID, requestID)
+}
+
+// GetRequestIDFromContext retrieves the request ID from the context
+func GetRequestIDFromContext(ctx context.Context) string {
+	if requestID, ok := ctx.Value(contextKeyRequestID).(string); ok {
+		return requestID
+	}
+	return ""
+}
+
+// setRouteParamsInContext adds the path parameters of the matched route to the context
+func setRouteParamsInContext(ctx context.Context, params map[string]string) context.Context {
+	return context.WithValue(ctx, contextKeyRouteParams, params)
+}
+
+// GetRouteParamsFromContext retrieves the path parameters of the matched route from the context
+func GetRouteParamsFromContext(ctx context.Context) map[string]string {
+	if params, ok := ctx.Value(contextKeyRouteParams).(map[string]string); ok {
+		return params
+	}
+	return nil
+}
+
+// setUpstreamTokenInContext adds the token forwarded to the upstream to the context
+func setUpstreamTokenInContext(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, contextKeyUpstreamToken, token)
+}
+
+// getUpstreamTokenFromContext retrieves the token forwarded to the upstream from the context
+func getUpstreamTokenFromContext(ctx context.Context) string {
+	if token, ok := ctx.Value(contextKeyUpstreamToken).(string); ok {
+		return token
+	}
+	return ""
+}
+
+// setAssertionInContext adds the identity assertion forwarded to the upstream to the context
+func setAssertionInContext(ctx context.Context, assertion string) context.Context {
+	return context.WithValue(ctx, contextKeyAssertion, assertion)
+}
+
+// getAssertionFromContext retrieves the identity assertion forwarded to the upstream from the context
+func getAssertionFromContext(ctx context.Context) string {
+	if assertion, ok := ctx.Value(contextKeyAssertion).(string); ok {
+		return assertion
+	}
+	return ""
+}
+
+// setGatewayHeaderInContext adds the response header the gateway writes to to the context
+func setGatewayHeaderInContext(ctx context.Context, header http.Header) context.Context {
+	return context.WithValue(ctx, contextKeyGatewayHeader, header)
+}
+
+// getGatewayHeaderFromContext retrieves the response header the gateway writes to from the context
+func getGatewayHeaderFromContext(ctx context.Context) http.Header {
+	if header, ok := ctx.Value(contextKeyGatewayHeader).(http.Header); ok {
+		return header
+	}
+	return nil
+}
+
+// setCacheLookupInContext adds the cache lookup of a request to the context
+func setCacheLookupInContext(ctx context.Context, lookup *cacheLookup) context.Context {
+	return context.WithValue(ctx, contextKeyCacheLookup, lookup)
+}
+
+// getCacheLookupFromContext retrieves the cache lookup of a request from the context
+func getCacheLookupFromContext(ctx context.Context) *cacheLookup {
+	if lookup, ok := ctx.Value(contextKeyCacheLookup).(*cacheLookup); ok {
+		return lookup
+	}
+	return nil
+}
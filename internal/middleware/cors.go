@@ -0,0 +1,222 @@
+package middleware
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/ase-compas/compas-auth-proxy/internal/config"
+)
+
+// corsResponseHeaders are the CORS headers set by the gateway. Upstream values
+// are removed so the gateway policy is authoritative.
+var corsResponseHeaders = []string{
+	"Access-Control-Allow-Origin",
+	"Access-Control-Allow-Credentials",
+	"Access-Control-Allow-Methods",
+	"Access-Control-Allow-Headers",
+	"Access-Control-Expose-Headers",
+	"Access-Control-Max-Age",
+}
+
+// originPattern matches the origins allowed by a single configured entry
+type originPattern struct {
+	scheme   string // Empty matches any scheme
+	host     string // Domain of a wildcard pattern, host otherwise
+	port     string
+	wildcard bool // Whether any subdomain of host matches
+}
+
+// parseOriginPattern parses an allowed origin such as "https://*.example.com"
+func parseOriginPattern(origin string) originPattern {
+	var p originPattern
+	host := origin
+	if i := strings.Index(host, "://"); i >= 0 {
+		p.scheme = strings.ToLower(host[:i])
+		host = host[i+3:]
+	}
+	if i := strings.LastIndex(host, ":"); i >= 0 && !strings.HasSuffix(host, "]") {
+		p.port = host[i+1:]
+		host = host[:i]
+	}
+	if strings.HasPrefix(host, "*.") {
+		p.wildcard = true
+		host = host[2:]
+	}
+	p.host = strings.ToLower(strings.Trim(host, "[]"))
+	return p
+}
+
+// matches reports whether the parsed request origin matches the pattern
+func (p originPattern) matches(u *url.URL) bool {
+	if p.scheme != "" && p.scheme != strings.ToLower(u.Scheme) {
+		return false
+	}
+	if p.port != u.Port() {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	if p.wildcard {
+		return strings.HasSuffix(host, "."+p.host)
+	}
+	return host == p.host
+}
+
+// corsPolicy decides which cross-origin requests are allowed and sets the
+// corresponding response headers
+type corsPolicy struct {
+	anyOrigin   bool
+	origins     []originPattern
+	methods     []string
+	headers     []string
+	anyHeader   bool
+	exposed     string
+	credentials bool
+	maxAge      string
+}
+
+// newCORSPolicy creates a policy from its configuration
+func newCORSPolicy(cfg config.CORSConfig) *corsPolicy {
+	p := &corsPolicy{
+		methods: cfg.AllowedMethods,
+		exposed: strings.Join(cfg.ExposedHeaders, ", "),
+	}
+	for _, origin := range cfg.AllowedOrigins {
+		if origin == "*" {
+			p.anyOrigin = true
+			continue
+		}
+		p.origins = append(p.origins, parseOriginPattern(origin))
+	}
+	for _, header := range cfg.AllowedHeaders {
+		if header == "*" {
+			p.anyHeader = true
+			continue
+		}
+		p.headers = append(p.headers, header)
+	}
+	// Credentials are never allowed for any origin
+	p.credentials = !p.anyOrigin
+	if cfg.AllowCredentials != nil {
+		p.credentials = *cfg.AllowCredentials && !p.anyOrigin
+	}
+	if cfg.MaxAge > 0 {
+		p.maxAge = strconv.Itoa(int(cfg.MaxAge.Seconds()))
+	}
+	return p
+}
+
+// allowsOrigin reports whether requests from the origin are allowed
+func (p *corsPolicy) allowsOrigin(origin string) bool {
+	if p.anyOrigin {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return false
+	}
+	for _, pattern := range p.origins {
+		if pattern.matches(u) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsMethod reports whether the method may be used in cross-origin requests
+func (p *corsPolicy) allowsMethod(method string) bool {
+	for _, allowed := range p.methods {
+		if strings.EqualFold(allowed, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// setOrigin sets the headers shared by preflight and actual responses
+func (p *corsPolicy) setOrigin(header http.Header, origin string) {
+	if p.anyOrigin {
+		header.Set("Access-Control-Allow-Origin", "*")
+		return
+	}
+	header.Set("Access-Control-Allow-Origin", origin)
+	if p.credentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// apply adds the CORS headers for an actual request from the origin
+func (p *corsPolicy) apply(w http.ResponseWriter, origin string) {
+	if !p.anyOrigin {
+		w.Header().Add("Vary", "Origin")
+	}
+	if !p.allowsOrigin(origin) {
+		return
+	}
+	p.setOrigin(w.Header(), origin)
+	if p.exposed != "" {
+		w.Header().Set("Access-Control-Expose-Headers", p.exposed)
+	}
+}
+
+// preflight answers a preflight request. Requests from disallowed origins or
+// for disallowed methods are rejected without CORS headers.
+func (p *corsPolicy) preflight(w http.ResponseWriter, r *http.Request) {
+	origin := r.Header.Get("Origin")
+	w.Header().Add("Vary", "Origin")
+	w.Header().Add("Vary", "Access-Control-Request-Method")
+	w.Header().Add("Vary", "Access-Control-Request-Headers")
+
+	if !p.allowsOrigin(origin) || !p.allowsMethod(r.Header.Get("Access-Control-Request-Method")) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	p.setOrigin(w.Header(), origin)
+	w.Header().Set("Access-Control-Allow-Methods", strings.Join(p.methods, ", "))
+	if p.anyHeader {
+		if requested := r.Header.Get("Access-Control-Request-Headers"); requested != "" {
+			w.Header().Set("Access-Control-Allow-Headers", requested)
+		}
+	} else if len(p.headers) > 0 {
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(p.headers, ", "))
+	}
+	if p.maxAge != "" {
+		w.Header().Set("Access-Control-Max-Age", p.maxAge)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// CORS applies the CORS policy of the route matching the request, or the
+// global policy, and answers preflight requests. It runs before
+// authentication so preflight requests are never redirected to the login.
+func (m *MultiProxyMiddleware) CORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		requestMethod := r.Header.Get("Access-Control-Request-Method")
+		if r.Method == "OPTIONS" && requestMethod != "" {
+			// Match the route for the method of the actual request
+			actual := *r
+			actual.Method = requestMethod
+			m.corsPolicyFor(&actual).preflight(w, r)
+			return
+		}
+
+		m.corsPolicyFor(r).apply(w, origin)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// corsPolicyFor returns the policy of the route matching the request
+func (m *MultiProxyMiddleware) corsPolicyFor(r *http.Request) *corsPolicy {
+	if route := m.findRoute(r); route != nil {
+		return route.cors
+	}
+	return m.cors
+}
@@ -0,0 +1,193 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ase-compas/compas-auth-proxy/internal/config"
+)
+
+func TestCORSOriginMatching(t *testing.T) {
+	policy := newCORSPolicy(config.CORSConfig{
+		AllowedOrigins: []string{"https://*.example.com", "http://localhost:3000", "*.compas.org", "https://[::1]:8443"},
+	})
+
+	testCases := []struct {
+		origin  string
+		allowed bool
+	}{
+		{"https://app.example.com", true},
+		{"https://a.b.example.com", true},
+		{"https://example.com", false},
+		{"https://evilexample.com", false},
+		{"http://app.example.com", false},
+		{"https://app.example.com:8443", false},
+		{"https://APP.Example.com", true},
+		{"http://localhost:3000", true},
+		{"http://localhost:3001", false},
+		{"http://localhost", false},
+		{"https://ui.compas.org", true},
+		{"http://ui.compas.org", true},
+		{"https://compas.org.evil.net", false},
+		{"https://[::1]:8443", true},
+		{"null", false},
+		{"", false},
+	}
+
+	for _, tc := range testCases {
+		if got := policy.allowsOrigin(tc.origin); got != tc.allowed {
+			t.Errorf("Origin %q: expected allowed=%v, got %v", tc.origin, tc.allowed, got)
+		}
+	}
+}
+
+func TestCORSPolicy(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("X-Total-Count", "42")
+	}))
+	defer backend.Close()
+
+	allowCredentials := false
+	cfg := &config.Config{
+		AllowedOrigins:     []string{"https://app.example.com"},
+		CORSAllowedMethods: []string{"GET", "POST"},
+		CORSAllowedHeaders: []string{"Content-Type", "Authorization"},
+		CORSExposedHeaders: []string{"X-Total-Count"},
+		CORSMaxAge:         10 * time.Minute,
+		UpstreamRoutes: []config.UpstreamRoute{
+			{Path: "/api", UpstreamURL: backend.URL},
+			{
+				Path:        "/api/public",
+				UpstreamURL: backend.URL,
+				Match:       config.RouteMatchConfig{Methods: []string{"PUT"}},
+				CORS: config.CORSConfig{
+					AllowedOrigins:   []string{"*"},
+					AllowedMethods:   []string{"PUT"},
+					AllowedHeaders:   []string{"*"},
+					AllowCredentials: &allowCredentials,
+				},
+			},
+		},
+	}
+	middleware, err := NewMultiProxyMiddleware(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+
+	authenticated := false
+	handler := middleware.CORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authenticated = true
+		middleware.Handler().ServeHTTP(w, r)
+	}))
+
+	testCases := []struct {
+		name     string
+		method   string
+		path     string
+		headers  map[string]string
+		status   int
+		proxied  bool
+		expected map[string][]string
+	}{
+		{
+			name:    "preflight from allowed origin",
+			method:  "OPTIONS",
+			path:    "/api/data",
+			headers: map[string]string{"Origin": "https://app.example.com", "Access-Control-Request-Method": "POST"},
+			status:  http.StatusNoContent,
+			expected: map[string][]string{
+				"Access-Control-Allow-Origin":      {"https://app.example.com"},
+				"Access-Control-Allow-Credentials": {"true"},
+				"Access-Control-Allow-Methods":     {"GET, POST"},
+				"Access-Control-Allow-Headers":     {"Content-Type, Authorization"},
+				"Access-Control-Max-Age":           {"600"},
+				"Vary":                             {"Origin", "Access-Control-Request-Method", "Access-Control-Request-Headers"},
+			},
+		},
+		{
+			name:     "preflight from disallowed origin",
+			method:   "OPTIONS",
+			path:     "/api/data",
+			headers:  map[string]string{"Origin": "https://evilexample.com", "Access-Control-Request-Method": "POST"},
+			status:   http.StatusForbidden,
+			expected: map[string][]string{"Access-Control-Allow-Origin": nil},
+		},
+		{
+			name:     "preflight for disallowed method",
+			method:   "OPTIONS",
+			path:     "/api/data",
+			headers:  map[string]string{"Origin": "https://app.example.com", "Access-Control-Request-Method": "DELETE"},
+			status:   http.StatusForbidden,
+			expected: map[string][]string{"Access-Control-Allow-Origin": nil},
+		},
+		{
+			name:    "preflight matched on requested method",
+			method:  "OPTIONS",
+			path:    "/api/public",
+			headers: map[string]string{"Origin": "https://other.org", "Access-Control-Request-Method": "PUT", "Access-Control-Request-Headers": "X-Custom"},
+			status:  http.StatusNoContent,
+			expected: map[string][]string{
+				"Access-Control-Allow-Origin":      {"*"},
+				"Access-Control-Allow-Credentials": nil,
+				"Access-Control-Allow-Methods":     {"PUT"},
+				"Access-Control-Allow-Headers":     {"X-Custom"},
+			},
+		},
+		{
+			name:    "actual request from allowed origin",
+			method:  "GET",
+			path:    "/api/data",
+			headers: map[string]string{"Origin": "https://app.example.com"},
+			status:  http.StatusOK,
+			proxied: true,
+			expected: map[string][]string{
+				"Access-Control-Allow-Origin":   {"https://app.example.com"},
+				"Access-Control-Expose-Headers": {"X-Total-Count"},
+				"Vary":                          {"Origin"},
+			},
+		},
+		{
+			name:     "actual request from disallowed origin",
+			method:   "GET",
+			path:     "/api/data",
+			headers:  map[string]string{"Origin": "https://evil.example.com"},
+			status:   http.StatusOK,
+			proxied:  true,
+			expected: map[string][]string{"Access-Control-Allow-Origin": nil, "Vary": {"Origin"}},
+		},
+		{
+			name:     "options without preflight",
+			method:   "OPTIONS",
+			path:     "/api/data",
+			status:   http.StatusOK,
+			proxied:  true,
+			expected: map[string][]string{"Access-Control-Allow-Origin": nil},
+		},
+	}
+
+	for _, tc := range testCases {
+		req := httptest.NewRequest(tc.method, tc.path, nil)
+		for name, value := range tc.headers {
+			req.Header.Set(name, value)
+		}
+		authenticated = false
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != tc.status {
+			t.Errorf("%s: expected status %d, got %d", tc.name, tc.status, rec.Code)
+		}
+		if authenticated != tc.proxied {
+			t.Errorf("%s: expected request to reach authentication=%v", tc.name, tc.proxied)
+		}
+		for name, expected := range tc.expected {
+			if got := rec.Header()[name]; !reflect.DeepEqual(got, expected) {
+				t.Errorf("%s: header %s: expected %v, got %v", tc.name, name, expected, got)
+			}
+		}
+	}
+}
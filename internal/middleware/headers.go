@@ -0,0 +1,95 @@
+package middleware
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/ase-compas/compas-auth-proxy/internal/config"
+)
+
+// headerRules applies the configured header changes of a route
+type headerRules struct {
+	set    map[string]string
+	add    map[string]string
+	remove []string
+}
+
+// newHeaderRules creates header rules from their configuration
+func newHeaderRules(cfg config.HeaderRulesConfig) headerRules {
+	return headerRules{set: cfg.Set, add: cfg.Add, remove: cfg.Remove}
+}
+
+// empty reports whether the rules change nothing
+func (h headerRules) empty() bool {
+	return len(h.set) == 0 && len(h.add) == 0 && len(h.remove) == 0
+}
+
+// apply changes the header, expanding template variables with vars
+func (h headerRules) apply(header http.Header, vars templateVars) {
+	for _, name := range h.remove {
+		header.Del(name)
+	}
+	for name, template := range h.set {
+		if value := vars.expand(template); value != "" {
+			header.Set(name, value)
+		} else {
+			// Never forward a client-supplied value for a header the gateway owns
+			header.Del(name)
+		}
+	}
+	for name, template := range h.add {
+		if value := vars.expand(template); value != "" {
+			header.Add(name, value)
+		}
+	}
+}
+
+// templateVars resolves the variables of header templates for a request
+type templateVars struct {
+	r              *http.Request
+	trustedProxies *TrustedProxies
+}
+
+// expand replaces all ${...} variables of the template
+func (v templateVars) expand(template string) string {
+	if !strings.Contains(template, "${") {
+		return template
+	}
+	return config.HeaderTemplateVariable.ReplaceAllStringFunc(template, func(variable string) string {
+		return v.lookup(variable[2 : len(variable)-1])
+	})
+}
+
+// lookup returns the value of a single variable, or "" if it is not set
+func (v templateVars) lookup(name string) string {
+	ctx := v.r.Context()
+
+	if param := strings.TrimPrefix(name, "param."); param != name {
+		return GetRouteParamsFromContext(ctx)[param]
+	}
+
+	switch name {
+	case "client_ip":
+		return v.trustedProxies.ClientIP(v.r)
+	case "request_id":
+		return GetRequestIDFromContext(ctx)
+	}
+
+	userInfo := GetUserFromContext(ctx)
+	if userInfo == nil {
+		return ""
+	}
+	switch name {
+	case "user.sub":
+		return userInfo.Sub
+	case "user.email":
+		return userInfo.Email
+	case "user.name":
+		return userInfo.Name
+	case "user.username":
+		return userInfo.PreferredUsername
+	case "user.roles":
+		return strings.Join(userInfo.Roles, ",")
+	}
+	return ""
+}
@@ -0,0 +1,124 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/ase-compas/compas-auth-proxy/internal/config"
+)
+
+func TestRouteHeaderRules(t *testing.T) {
+	var received http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+		w.Header().Set("Server", "Apache/2.4.1")
+		w.Header().Set("X-Powered-By", "PHP/5.6")
+		w.Header().Set("Cache-Control", "no-cache")
+	}))
+	defer backend.Close()
+
+	middleware, err := NewMultiProxyMiddleware(&config.Config{
+		UpstreamRoutes: []config.UpstreamRoute{{
+			Path:        "/api/scl/{type}",
+			UpstreamURL: backend.URL,
+			RequestHeaders: config.HeaderRulesConfig{
+				Set: map[string]string{
+					"X-User-Roles": "${user.roles}",
+					"X-SCL-Type":   "${param.type}",
+					"X-Trace":      "${request_id}@${client_ip}",
+					"X-Tenant":     "${user.tenant_missing}",
+				},
+				Add:    map[string]string{"X-Via": "compas-gateway"},
+				Remove: []string{"X-Debug"},
+			},
+			ResponseHeaders: config.HeaderRulesConfig{
+				Set:    map[string]string{"X-Served-By": "compas-gateway"},
+				Add:    map[string]string{"Cache-Control": "private"},
+				Remove: []string{"Server", "X-Powered-By"},
+			},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "/api/scl/SSD/1", nil)
+	req.RemoteAddr = "192.0.2.10:40000"
+	req.Header.Set("X-Debug", "1")
+	req.Header.Set("X-Via", "client-proxy")
+	req.Header.Set("X-Tenant", "spoofed")
+	req.Header.Set(RequestIDHeader, "req-123")
+	req = req.WithContext(SetUserInContext(req.Context(), &UserInfo{Sub: "user-1", Roles: []string{"admin", "viewer"}}))
+
+	rec := httptest.NewRecorder()
+	RequestID(middleware.Handler()).ServeHTTP(rec, req)
+
+	expectedRequest := map[string][]string{
+		"X-User-Roles": {"admin,viewer"},
+		"X-Scl-Type":   {"SSD"},
+		"X-Trace":      {"req-123@192.0.2.10"},
+		"X-Via":        {"client-proxy", "compas-gateway"},
+		"X-Request-Id": {"req-123"},
+		"X-Debug":      nil,
+		"X-Tenant":     nil,
+	}
+	for name, expected := range expectedRequest {
+		if got := received[name]; !reflect.DeepEqual(got, expected) {
+			t.Errorf("Upstream header %s: expected %v, got %v", name, expected, got)
+		}
+	}
+
+	expectedResponse := map[string][]string{
+		"Server":        nil,
+		"X-Powered-By":  nil,
+		"X-Served-By":   {"compas-gateway"},
+		"Cache-Control": {"no-cache", "private"},
+		"X-Request-Id":  {"req-123"},
+	}
+	for name, expected := range expectedResponse {
+		if got := rec.Header()[name]; !reflect.DeepEqual(got, expected) {
+			t.Errorf("Response header %s: expected %v, got %v", name, expected, got)
+		}
+	}
+}
+
+func TestRequestIDGeneration(t *testing.T) {
+	var requestID string
+	handler := RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID = GetRequestIDFromContext(r.Context())
+	}))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(RequestIDHeader, "invalid id with spaces")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if requestID == "" || requestID == "invalid id with spaces" {
+		t.Fatalf("Expected a generated request ID, got %q", requestID)
+	}
+	if rec.Header().Get(RequestIDHeader) != requestID {
+		t.Errorf("Expected response to carry request ID %q, got %q", requestID, rec.Header().Get(RequestIDHeader))
+	}
+}
+
+func TestUserInfoRoles(t *testing.T) {
+	claims := map[string]interface{}{
+		"sub":                "user-1",
+		"preferred_username": "jdoe",
+		"realm_access":       map[string]interface{}{"roles": []interface{}{"admin", "viewer"}},
+	}
+
+	userInfo := newUserInfo(claims, "realm_access.roles")
+	if userInfo.Sub != "user-1" || userInfo.PreferredUsername != "jdoe" {
+		t.Errorf("Unexpected user info: %+v", userInfo)
+	}
+	if !reflect.DeepEqual(userInfo.Roles, []string{"admin", "viewer"}) {
+		t.Errorf("Expected roles from realm_access.roles, got %v", userInfo.Roles)
+	}
+
+	if roles := newUserInfo(claims, "groups").Roles; roles != nil {
+		t.Errorf("Expected no roles for a missing claim, got %v", roles)
+	}
+}
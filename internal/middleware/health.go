@@ -0,0 +1,225 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ase-compas/compas-auth-proxy/internal/config"
+)
+
+// targetHealth tracks the results of active health checks for a target
+type targetHealth struct {
+	unhealthy int32 // accessed atomically; targets start out healthy
+
+	mu          sync.Mutex
+	successes   int
+	failures    int
+	latency     time.Duration
+	lastChecked time.Time
+}
+
+// Healthy reports whether the target is in load-balancing rotation
+func (t *Target) Healthy() bool {
+	return atomic.LoadInt32(&t.health.unhealthy) == 0
+}
+
+// recordHealthCheck updates the health state of the target with the result of a
+// probe and reports whether the state changed
+func (t *Target) recordHealthCheck(err error, latency time.Duration, check config.HealthCheckConfig) (changed bool) {
+	h := &t.health
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.latency = latency
+	h.lastChecked = time.Now()
+
+	if err == nil {
+		h.successes++
+		h.failures = 0
+		if !t.Healthy() && h.successes >= check.HealthyThreshold {
+			atomic.StoreInt32(&h.unhealthy, 0)
+			return true
+		}
+		return false
+	}
+
+	h.failures++
+	h.successes = 0
+	if t.Healthy() && h.failures >= check.UnhealthyThreshold {
+		atomic.StoreInt32(&h.unhealthy, 1)
+		return true
+	}
+	return false
+}
+
+// UpstreamStatus describes the health of a single upstream target
+type UpstreamStatus struct {
+	Route             string     `json:"route"`
+	URL               string     `json:"url"`
+	Healthy           bool       `json:"healthy"`
+	LatencyMs         float64    `json:"latency_ms"`
+	LastChecked       *time.Time `json:"last_checked,omitempty"`
+	ActiveConnections int64      `json:"active_connections"`
+}
+
+// HealthChecker periodically probes all upstream targets and takes unhealthy
+// targets out of load-balancing rotation
+type HealthChecker struct {
+	routes []ProxyRoute
+	stop   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// NewHealthChecker creates a health checker for the routes of the proxy
+func NewHealthChecker(proxy *MultiProxyMiddleware) *HealthChecker {
+	// Static routes have no upstreams to probe
+	routes := make([]ProxyRoute, 0, len(proxy.routes))
+	for _, route := range proxy.routes {
+		if route.static == nil {
+			routes = append(routes, route)
+		}
+	}
+	return &HealthChecker{
+		routes: routes,
+		stop:   make(chan struct{}),
+	}
+}
+
+// Start begins probing all upstream targets in the background
+func (h *HealthChecker) Start() {
+	for i := range h.routes {
+		route := &h.routes[i]
+		client := &http.Client{
+			Transport: route.transport,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+
+		for _, target := range route.Upstreams.Targets() {
+			h.wg.Add(1)
+			go h.run(client, route, target)
+		}
+	}
+}
+
+// Stop terminates all background probes
+func (h *HealthChecker) Stop() {
+	close(h.stop)
+	h.wg.Wait()
+}
+
+// run probes a single target until the checker is stopped
+func (h *HealthChecker) run(client *http.Client, route *ProxyRoute, target *Target) {
+	defer h.wg.Done()
+
+	interval := route.HealthCheck.Interval
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		h.probe(client, route, target)
+
+		select {
+		case <-ticker.C:
+		case <-h.stop:
+			return
+		}
+	}
+}
+
+// probe performs a single health check request against a target
+func (h *HealthChecker) probe(client *http.Client, route *ProxyRoute, target *Target) {
+	check := route.HealthCheck
+
+	timeout := check.Timeout
+	if timeout <= 0 {
+		timeout = 2 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	probeURL := *target.URL
+	probeURL.Path = singleJoiningSlash(target.URL.Path, check.Path)
+	probeURL.RawPath = ""
+
+	start := time.Now()
+	err := func() error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, probeURL.String(), nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("User-Agent", "compas-auth-proxy-healthcheck")
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+		if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+			return fmt.Errorf("unexpected status %d", resp.StatusCode)
+		}
+		return nil
+	}()
+
+	if target.recordHealthCheck(err, time.Since(start), check) {
+		if target.Healthy() {
+			log.Printf("Upstream %s of route %s is healthy again", target.URL, route.PathPrefix)
+		} else {
+			log.Printf("Upstream %s of route %s is unhealthy, removing from rotation: %v", target.URL, route.PathPrefix, err)
+		}
+	}
+}
+
+// Status returns the health of all upstream targets
+func (h *HealthChecker) Status() []UpstreamStatus {
+	var statuses []UpstreamStatus
+	for _, route := range h.routes {
+		for _, target := range route.Upstreams.Targets() {
+			target.health.mu.Lock()
+			status := UpstreamStatus{
+				Route:             route.PathPrefix,
+				URL:               target.URL.String(),
+				Healthy:           target.Healthy(),
+				LatencyMs:         float64(target.health.latency) / float64(time.Millisecond),
+				ActiveConnections: target.ActiveConnections(),
+			}
+			if !target.health.lastChecked.IsZero() {
+				lastChecked := target.health.lastChecked
+				status.LastChecked = &lastChecked
+			}
+			target.health.mu.Unlock()
+
+			statuses = append(statuses, status)
+		}
+	}
+	return statuses
+}
+
+// Healthy reports whether every route has at least one healthy target
+func (h *HealthChecker) Healthy() bool {
+	for _, route := range h.routes {
+		available := false
+		for _, target := range route.Upstreams.Targets() {
+			if target.Healthy() {
+				available = true
+				break
+			}
+		}
+		if !available {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,94 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ase-compas/compas-auth-proxy/internal/config"
+)
+
+func TestHealthCheckThresholds(t *testing.T) {
+	target := &Target{}
+	check := config.HealthCheckConfig{HealthyThreshold: 2, UnhealthyThreshold: 3}
+	failure := errors.New("connection refused")
+
+	for i := 0; i < 2; i++ {
+		target.recordHealthCheck(failure, time.Millisecond, check)
+	}
+	if !target.Healthy() {
+		t.Fatal("Expected target to stay healthy below the unhealthy threshold")
+	}
+	if !target.recordHealthCheck(failure, time.Millisecond, check) || target.Healthy() {
+		t.Fatal("Expected target to become unhealthy at the threshold")
+	}
+
+	target.recordHealthCheck(nil, time.Millisecond, check)
+	if target.Healthy() {
+		t.Fatal("Expected target to stay unhealthy below the healthy threshold")
+	}
+	if !target.recordHealthCheck(nil, time.Millisecond, check) || !target.Healthy() {
+		t.Fatal("Expected target to recover at the healthy threshold")
+	}
+}
+
+func TestHealthCheckerRemovesUnhealthyTargets(t *testing.T) {
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/q/health" {
+			t.Errorf("Expected probe on /q/health, got %s", r.URL.Path)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer healthy.Close()
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer broken.Close()
+
+	cfg := &config.Config{
+		UpstreamRoutes: []config.UpstreamRoute{{
+			Path:        "/api/scl",
+			Upstreams:   []config.UpstreamTarget{{URL: healthy.URL}, {URL: broken.URL}},
+			HealthCheck: config.HealthCheckConfig{Path: "/q/health"},
+		}},
+		HealthCheck: config.HealthCheckConfig{
+			Interval:           10 * time.Millisecond,
+			Timeout:            time.Second,
+			HealthyThreshold:   1,
+			UnhealthyThreshold: 1,
+		},
+	}
+	middleware, err := NewMultiProxyMiddleware(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+
+	checker := NewHealthChecker(middleware)
+	checker.Start()
+	defer checker.Stop()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		statuses := checker.Status()
+		if len(statuses) == 2 && statuses[0].LastChecked != nil && !statuses[1].Healthy {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for health checks, status: %+v", statuses)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if !checker.Healthy() {
+		t.Error("Expected route with one healthy upstream to be available")
+	}
+
+	pool := middleware.routes[0].Upstreams
+	for i := 0; i < 5; i++ {
+		if target := pool.Pick(httptest.NewRequest("GET", "/", nil), nil); target.URL.String() != healthy.URL {
+			t.Errorf("Expected only the healthy upstream to be picked, got %s", target.URL)
+		}
+	}
+}
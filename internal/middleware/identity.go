@@ -0,0 +1,241 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ase-compas/compas-auth-proxy/internal/config"
+)
+
+// errTokenExchangeUnavailable is returned when a route forwards exchanged
+// tokens but no token exchanger has been configured
+var errTokenExchangeUnavailable = errors.New("token exchange is not configured")
+
+// TokenExchanger exchanges the access token of a user for a token issued for
+// a specific upstream audience
+type TokenExchanger interface {
+	ExchangeToken(ctx context.Context, subjectToken, audience string, scopes []string) (string, error)
+}
+
+// identityForwarder adds the identity of the authenticated user to upstream
+// requests according to the identity configuration of a route
+type identityForwarder struct {
+	headers     map[string]string // header name to UserInfo field
+	claims      map[string]string // header name to claim path
+	tokenMode   string
+	tokenHeader string
+	audience    string
+	scopes      []string
+
+	assertion         bool
+	assertionHeader   string
+	assertionAudience string
+	assertionClaims   map[string]string // JWT claim name to claim path
+}
+
+// defaultAssertionClaims are the user claims copied into identity assertions
+// when none are configured
+var defaultAssertionClaims = map[string]string{
+	"email":              "email",
+	"name":               "name",
+	"preferred_username": "preferred_username",
+}
+
+// defaultIdentityHeaders are the header names used when none are configured
+var defaultIdentityHeaders = map[string]string{
+	"user":     "X-Auth-User",
+	"email":    "X-Auth-Email",
+	"name":     "X-Auth-Name",
+	"username": "X-Auth-Username",
+}
+
+// newIdentityForwarder creates the identity forwarder of a route
+func newIdentityForwarder(cfg config.IdentityConfig) *identityForwarder {
+	f := &identityForwarder{
+		headers:     make(map[string]string),
+		claims:      make(map[string]string),
+		tokenMode:   cfg.Token,
+		tokenHeader: cfg.TokenHeader,
+		audience:    cfg.Audience,
+		scopes:      cfg.Scopes,
+
+		assertion:         cfg.Assertion.Enabled,
+		assertionHeader:   cfg.Assertion.Header,
+		assertionAudience: cfg.Assertion.Audience,
+		assertionClaims:   cfg.Assertion.Claims,
+	}
+	if f.tokenMode == "" {
+		f.tokenMode = config.TokenForwardAccessToken
+	}
+	if f.tokenHeader == "" {
+		f.tokenHeader = "Authorization"
+	}
+	if f.assertionHeader == "" {
+		f.assertionHeader = "X-Gateway-Assertion"
+	}
+	if len(f.assertionClaims) == 0 {
+		f.assertionClaims = defaultAssertionClaims
+	}
+
+	configured := map[string]string{
+		"user":     cfg.UserHeader,
+		"email":    cfg.EmailHeader,
+		"name":     cfg.NameHeader,
+		"username": cfg.UsernameHeader,
+	}
+	for field, header := range configured {
+		if header == "" {
+			header = defaultIdentityHeaders[field]
+		}
+		if header != "-" {
+			f.headers[http.CanonicalHeaderKey(header)] = field
+		}
+	}
+	for claim, header := range cfg.Claims {
+		f.claims[http.CanonicalHeaderKey(header)] = claim
+	}
+	return f
+}
+
+// token returns the token forwarded to the upstream for the request
+func (f *identityForwarder) token(r *http.Request, exchanger TokenExchanger, clientTokens ClientTokenSource) (string, error) {
+	ctx := r.Context()
+	switch f.tokenMode {
+	case config.TokenForwardNone:
+		return "", nil
+	case config.TokenForwardIDToken:
+		return GetIDTokenFromContext(ctx), nil
+	case config.TokenForwardExchanged:
+		accessToken := GetAccessTokenFromContext(ctx)
+		if accessToken == "" {
+			return "", nil
+		}
+		if exchanger == nil {
+			return "", errTokenExchangeUnavailable
+		}
+		return exchanger.ExchangeToken(ctx, accessToken, f.audience, f.scopes)
+	case config.TokenForwardClientCredentials:
+		if clientTokens == nil {
+			return "", errClientCredentialsUnavailable
+		}
+		return clientTokens.ClientToken(ctx, f.scopes)
+	default:
+		return GetAccessTokenFromContext(ctx), nil
+	}
+}
+
+// signedAssertion returns the identity assertion forwarded to the upstream for
+// the request, or "" if the route forwards none or the user is unknown
+func (f *identityForwarder) signedAssertion(r *http.Request, signer *AssertionSigner) (string, error) {
+	if !f.assertion {
+		return "", nil
+	}
+	userInfo := GetUserFromContext(r.Context())
+	if userInfo == nil {
+		return "", nil
+	}
+	if signer == nil {
+		return "", errAssertionSignerUnavailable
+	}
+
+	claims := map[string]interface{}{"sub": userInfo.Sub}
+	if f.assertionAudience != "" {
+		claims["aud"] = f.assertionAudience
+	}
+	for name, path := range f.assertionClaims {
+		if value := lookupClaim(userInfo.Claims, path); value != nil {
+			claims[name] = value
+		}
+	}
+	return signer.Sign(claims)
+}
+
+// apply sets the identity headers and the upstream token on the header. Values
+// sent by the client for any of these headers, including the token header, or
+// for the default X-Auth-* headers, are always removed. The token header stays
+// empty if there is no upstream token.
+func (f *identityForwarder) apply(header http.Header, r *http.Request) {
+	ctx := r.Context()
+	userInfo := GetUserFromContext(ctx)
+
+	for _, name := range defaultIdentityHeaders {
+		header.Del(name)
+	}
+
+	for name, field := range f.headers {
+		header.Del(name)
+		if userInfo == nil {
+			continue
+		}
+		var value string
+		switch field {
+		case "user":
+			value = userInfo.Sub
+		case "email":
+			value = userInfo.Email
+		case "name":
+			value = userInfo.Name
+		case "username":
+			value = userInfo.PreferredUsername
+		}
+		header.Set(name, value)
+	}
+
+	for name, claim := range f.claims {
+		header.Del(name)
+		if userInfo == nil {
+			continue
+		}
+		if value := claimString(lookupClaim(userInfo.Claims, claim)); value != "" {
+			header.Set(name, value)
+		}
+	}
+
+	if f.assertion {
+		header.Del(f.assertionHeader)
+		if assertion := getAssertionFromContext(ctx); assertion != "" {
+			header.Set(f.assertionHeader, assertion)
+		}
+	}
+
+	// Never forward the client's own credentials or a forged token
+	header.Del(f.tokenHeader)
+	if f.tokenMode == config.TokenForwardNone {
+		return
+	}
+	if token := getUpstreamTokenFromContext(ctx); token != "" {
+		if strings.EqualFold(f.tokenHeader, "Authorization") {
+			token = "Bearer " + token
+		}
+		header.Set(f.tokenHeader, token)
+	}
+}
+
+// claimString formats a claim value for a header: lists are joined with
+// commas, objects are encoded as JSON
+func claimString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			values = append(values, claimString(item))
+		}
+		return strings.Join(values, ",")
+	case map[string]interface{}:
+		data, _ := json.Marshal(v)
+		return string(data)
+	default:
+		return fmt.Sprint(v)
+	}
+}
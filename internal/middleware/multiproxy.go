@@ -1,12 +1,16 @@
 package middleware
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/ase-compas/compas-auth-proxy/internal/config"
 	"github.com/koding/websocketproxy"
@@ -14,79 +18,175 @@ import (
 
 // MultiProxyMiddleware handles reverse proxy functionality with multiple upstreams
 type MultiProxyMiddleware struct {
-	config *config.Config
-	routes []ProxyRoute
+	config          *config.Config
+	routes          []ProxyRoute
+	trustedProxies  *TrustedProxies
+	tokenExchanger  TokenExchanger
+	clientTokens    ClientTokenSource
+	signer          *AssertionSigner
+	cors            *corsPolicy      // Policy for requests that match no route
+	securityHeaders *securityHeaders // Headers of responses generated by the gateway
+	rateLimiter     RateLimiter
 }
 
 // ProxyRoute represents a configured proxy route
 type ProxyRoute struct {
 	PathPrefix      string
-	UpstreamURL     *url.URL
+	Upstreams       *UpstreamPool
 	Proxy           *httputil.ReverseProxy
 	WebSocketProxy  *websocketproxy.WebsocketProxy
 	StripPath       bool
 	EnableWebSocket bool
+	HealthCheck     config.HealthCheckConfig
+	Match           config.RouteMatchConfig
+	Priority        int
+	Public          bool          // Served without user authentication
+	Timeout         time.Duration // Overall timeout of proxied HTTP requests, 0 means no limit
+
+	transport http.RoundTripper // Transport used to reach the upstream targets
+	paths     *pathMatcher      // Matches and rewrites request paths
+	identity  *identityForwarder
+	cors      *corsPolicy
+	rateLimit *rateLimitPolicy // nil if the route is not rate limited
+	body      *bodyPolicy      // nil if the route accepts any request body
+	cache     *cachePolicy     // nil if responses of the route are not cached
+	static    *staticFiles     // Files served instead of an upstream, nil for proxied routes
+
+	securityHeaders *securityHeaders // Security headers of static responses
+
+	finishResponse func(*http.Response) error // Completes upstream and cached responses
 }
 
 // NewMultiProxyMiddleware creates a new multi-upstream proxy middleware
 func NewMultiProxyMiddleware(cfg *config.Config) (*MultiProxyMiddleware, error) {
+	trustedProxies, err := NewTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
 	middleware := &MultiProxyMiddleware{
-		config: cfg,
-		routes: make([]ProxyRoute, 0, len(cfg.UpstreamRoutes)),
+		config:          cfg,
+		routes:          make([]ProxyRoute, 0, len(cfg.UpstreamRoutes)),
+		trustedProxies:  trustedProxies,
+		cors:            newCORSPolicy(cfg.CORSFor(config.UpstreamRoute{})),
+		securityHeaders: newSecurityHeaders(cfg.SecurityHeaders, cfg.CSPReportPath),
+		rateLimiter:     NewMemoryRateLimiter(),
+	}
+
+	// Create the shared response cache if any route uses it
+	var cache cacheStore
+	for _, routeConfig := range cfg.UpstreamRoutes {
+		if routeConfig.Cache.Enabled {
+			if cache, err = newCacheStore(cfg.Cache); err != nil {
+				return nil, fmt.Errorf("failed to create response cache: %v", err)
+			}
+			break
+		}
 	}
 
 	// Create proxy routes from configuration
 	for _, routeConfig := range cfg.UpstreamRoutes {
-		upstreamURL, err := url.Parse(routeConfig.UpstreamURL)
+		routeConfig := routeConfig
+
+		if routeConfig.Static.Enabled() {
+			route, err := newStaticRoute(cfg, routeConfig)
+			if err != nil {
+				return nil, err
+			}
+			middleware.routes = append(middleware.routes, route)
+			continue
+		}
+
+		upstreams, err := NewUpstreamPool(routeConfig, trustedProxies)
+		if err != nil {
+			return nil, err
+		}
+
+		paths, err := newPathMatcher(routeConfig)
 		if err != nil {
-			return nil, fmt.Errorf("invalid upstream URL %s: %v", routeConfig.UpstreamURL, err)
+			return nil, fmt.Errorf("invalid path of route %s: %v", routeConfig.Path, err)
 		}
 
-		proxy := httputil.NewSingleHostReverseProxy(upstreamURL)
+		tlsConfig, err := newUpstreamTLSConfig(routeConfig, cfg.InsecureSkipVerify)
+		if err != nil {
+			return nil, err
+		}
+		identity := newIdentityForwarder(routeConfig.Identity)
+		requestHeaders := newHeaderRules(routeConfig.RequestHeaders)
+		responseHeaders := newHeaderRules(routeConfig.ResponseHeaders)
+
+		transport := newRouteTransport(routeConfig, tlsConfig)
+		proxy := &httputil.ReverseProxy{
+			Transport: &upstreamTransport{pool: upstreams, base: transport, retry: newRetryPolicy(routeConfig.Retry)},
+		}
+		securityHeaders := newSecurityHeaders(cfg.SecurityHeadersFor(routeConfig), cfg.CSPReportPath)
+		compression := newCompressionPolicy(routeConfig.Compression)
+		cachePolicy := newCachePolicy(routeConfig.Cache, cache, cfg.Cache.MaxEntrySize)
+		finishResponse := func(resp *http.Response) error {
+			// The gateway's CORS policy replaces the upstream's
+			for _, name := range corsResponseHeaders {
+				resp.Header.Del(name)
+			}
+			securityHeaders.applyToResponse(resp, trustedProxies)
+			if !responseHeaders.empty() {
+				responseHeaders.apply(resp.Header, templateVars{r: resp.Request, trustedProxies: trustedProxies})
+			}
+			// Compress last so the final headers decide whether the response qualifies
+			if compression != nil {
+				compression.apply(resp)
+			}
+			return nil
+		}
+		proxy.ModifyResponse = func(resp *http.Response) error {
+			// The cache keeps responses as sent by the upstream
+			if cachePolicy != nil {
+				cachePolicy.update(resp)
+			}
+			return finishResponse(resp)
+		}
 
 		// Create WebSocket proxy if enabled for this route
 		var wsProxy *websocketproxy.WebsocketProxy
 		if routeConfig.EnableWebSocket {
-			// Convert http(s) URL to ws(s) for WebSocket
-			wsURL := *upstreamURL
-			if wsURL.Scheme == "https" {
-				wsURL.Scheme = "wss"
-			} else {
-				wsURL.Scheme = "ws"
+			wsProxy = &websocketproxy.WebsocketProxy{
+				Dialer: newWebSocketDialer(routeConfig, tlsConfig),
+				// Connect to the target selected for this connection in Handler
+				Backend: func(r *http.Request) *url.URL {
+					target := getUpstreamTargetFromContext(r.Context())
+					if target == nil {
+						return nil
+					}
+					// Rewrites apply to WebSocket connections too, strip_path never did
+					u := *r.URL
+					paths.apply(&u, false)
+					return websocketURL(target.URL, &u)
+				},
 			}
-			wsProxy = websocketproxy.NewProxy(&wsURL)
 			// Customize WebSocket proxy director
 			wsProxy.Director = func(incoming *http.Request, out http.Header) {
-				// Add authentication headers to WebSocket upgrade request
-				if userInfo := GetUserFromContext(incoming.Context()); userInfo != nil {
-					out.Set("X-Auth-User", userInfo.Sub)
-					out.Set("X-Auth-Email", userInfo.Email)
-					out.Set("X-Auth-Name", userInfo.Name)
-					out.Set("X-Auth-Username", userInfo.PreferredUsername)
-				}
-				if accessToken := GetAccessTokenFromContext(incoming.Context()); accessToken != "" {
-					out.Set("Authorization", "Bearer "+accessToken)
-				}
+				// Add identity headers to WebSocket upgrade request
+				identity.apply(out, incoming)
+				requestHeaders.apply(out, templateVars{r: incoming, trustedProxies: trustedProxies})
 			}
 		}
 
-		// Customize the proxy director
-		originalDirector := proxy.Director
+		// Customize the proxy director; the upstream host is set by the
+		// transport once a target has been selected
 		proxy.Director = func(req *http.Request) {
-			// Call original director first
-			originalDirector(req)
-
-			// Add authentication headers
-			middleware.addAuthHeaders(req)
-
-			// Strip path prefix if configured
-			if routeConfig.StripPath && routeConfig.Path != "/" {
-				req.URL.Path = strings.TrimPrefix(req.URL.Path, strings.TrimSuffix(routeConfig.Path, "/"))
-				if req.URL.Path == "" {
-					req.URL.Path = "/"
-				}
+			if _, ok := req.Header["User-Agent"]; !ok {
+				// Explicitly disable the default User-Agent
+				req.Header.Set("User-Agent", "")
 			}
 
+			// Add identity headers
+			identity.apply(req.Header, req)
+
+			// Rewrite the path or strip the path prefix if configured
+			paths.apply(req.URL, routeConfig.StripPath)
+
+			// Apply the configured request header changes
+			requestHeaders.apply(req.Header, templateVars{r: req, trustedProxies: trustedProxies})
+
 			// Remove hop-by-hop headers (but preserve them for WebSocket routes)
 			isWebSocketUpgrade := strings.ToLower(req.Header.Get("Upgrade")) == "websocket"
 			if !isWebSocketUpgrade || !routeConfig.EnableWebSocket {
@@ -96,83 +196,248 @@ func NewMultiProxyMiddleware(cfg *config.Config) (*MultiProxyMiddleware, error)
 				req.Header.Del("Trailer")
 				req.Header.Del("Upgrade")
 			}
-
-			log.Printf("Proxying %s %s to %s%s", req.Method, req.URL.Path, upstreamURL.String(), req.URL.Path)
 		}
 
 		// Customize error handler
 		proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
-			log.Printf("Proxy error for %s: %v", routeConfig.UpstreamURL, err)
+			log.Printf("Proxy error for %s: %v", routeConfig.Path, err)
+			var circuitErr *CircuitOpenError
+			if errors.As(err, &circuitErr) {
+				w.Header().Set("Retry-After", strconv.Itoa(circuitErr.RetryAfterSeconds()))
+				http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			if err == errNoUpstreamAvailable {
+				http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				writeBodyTooLarge(w, config.ByteSize(maxBytesErr.Limit))
+				return
+			}
+			if isTimeout(err) {
+				http.Error(w, "Gateway Timeout", http.StatusGatewayTimeout)
+				return
+			}
 			http.Error(w, fmt.Sprintf("Proxy error: %v", err), http.StatusBadGateway)
 		}
 
 		route := ProxyRoute{
 			PathPrefix:      routeConfig.Path,
-			UpstreamURL:     upstreamURL,
+			Upstreams:       upstreams,
 			Proxy:           proxy,
 			WebSocketProxy:  wsProxy,
 			StripPath:       routeConfig.StripPath,
 			EnableWebSocket: routeConfig.EnableWebSocket,
+			HealthCheck:     cfg.HealthCheckFor(routeConfig),
+			rateLimit:       newRateLimitPolicy(routeConfig.Path, cfg.RateLimitFor(routeConfig)),
+			body:            newBodyPolicy(routeConfig),
+			cache:           cachePolicy,
+			finishResponse:  finishResponse,
+			Match:           routeConfig.Match,
+			Priority:        routeConfig.Priority,
+			Public:          routeConfig.Public,
+			Timeout:         routeConfig.Timeouts.Overall,
+			paths:           paths,
+			identity:        identity,
+			cors:            newCORSPolicy(cfg.CORSFor(routeConfig)),
+			transport:       transport,
 		}
 
 		middleware.routes = append(middleware.routes, route)
 	}
 
-	// Sort routes by path length (longest first) for proper matching
+	// Sort routes by priority and path length for proper matching
 	middleware.sortRoutes()
 
 	log.Printf("Configured %d proxy routes:", len(middleware.routes))
 	for _, route := range middleware.routes {
+		if route.static != nil {
+			log.Printf("  %s -> %s (static, spa: %v)", route.PathPrefix, route.static.source, route.static.spa)
+			continue
+		}
 		wsStatus := "no"
 		if route.EnableWebSocket {
 			wsStatus = "yes"
 		}
-		log.Printf("  %s -> %s (strip: %v, websocket: %s)", route.PathPrefix, route.UpstreamURL.String(), route.StripPath, wsStatus)
+		log.Printf("  %s -> %s (strip: %v, websocket: %s)", route.PathPrefix, route.Upstreams.String(), route.StripPath, wsStatus)
 	}
 
 	return middleware, nil
 }
 
+// SetTokenExchanger sets the exchanger used by routes that forward exchanged
+// tokens
+func (m *MultiProxyMiddleware) SetTokenExchanger(exchanger TokenExchanger) {
+	m.tokenExchanger = exchanger
+}
+
+// SetClientTokenSource sets the source of the gateway's own tokens used by
+// routes that forward client credentials tokens
+func (m *MultiProxyMiddleware) SetClientTokenSource(source ClientTokenSource) {
+	m.clientTokens = source
+}
+
+// SetRateLimiter replaces the in-memory rate limiter, e.g. with one backed by
+// a store shared between gateway replicas
+func (m *MultiProxyMiddleware) SetRateLimiter(limiter RateLimiter) {
+	m.rateLimiter = limiter
+}
+
+// SetAssertionSigner sets the signer used by routes that forward identity
+// assertions
+func (m *MultiProxyMiddleware) SetAssertionSigner(signer *AssertionSigner) {
+	m.signer = signer
+}
+
 // Handler returns the proxy handler
 func (m *MultiProxyMiddleware) Handler() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Add CORS headers if configured
-		m.addCORSHeaders(w, r)
-
-		// Handle preflight requests
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
-			return
-		}
-
 		// Find matching route
-		route := m.findRoute(r.URL.Path)
+		route := m.findRoute(r)
 		if route == nil {
 			log.Printf("No route found for path: %s", r.URL.Path)
 			http.Error(w, "Not Found", http.StatusNotFound)
 			return
 		}
 
+		// Enforce the rate limit of the route
+		if route.rateLimit != nil && !m.allowRequest(w, r, route.rateLimit) {
+			return
+		}
+
+		// Serve the files of static routes
+		if route.static != nil {
+			m.serveStatic(w, r, route)
+			return
+		}
+
+		// Enforce the request body policy of the route
+		if route.body != nil {
+			var ok bool
+			if r, ok = route.body.check(w, r); !ok {
+				return
+			}
+		}
+
+		// Make the path parameters available to header templates
+		if match, ok := route.paths.match(r.URL.Path); ok && len(match.params) > 0 {
+			r = r.WithContext(setRouteParamsInContext(r.Context(), match.params))
+		}
+
+		// Answer from the response cache of the route
+		if route.cache != nil && r.Header.Get("Upgrade") == "" {
+			var served bool
+			if r, served = route.cache.serve(w, r, route.finishResponse); served {
+				return
+			}
+		}
+
+		// Obtain the token forwarded to the upstream
+		token, err := route.identity.token(r, m.tokenExchanger, m.clientTokens)
+		if err != nil {
+			log.Printf("Failed to obtain upstream token for %s: %v", route.PathPrefix, err)
+			http.Error(w, "Bad Gateway", http.StatusBadGateway)
+			return
+		}
+		r = r.WithContext(setUpstreamTokenInContext(r.Context(), token))
+
+		// Issue the identity assertion forwarded to the upstream
+		assertion, err := route.identity.signedAssertion(r, m.signer)
+		if err != nil {
+			log.Printf("Failed to issue identity assertion for %s: %v", route.PathPrefix, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		r = r.WithContext(setAssertionInContext(r.Context(), assertion))
+
 		// Check if this is a WebSocket upgrade request
 		isWebSocketUpgrade := strings.ToLower(r.Header.Get("Upgrade")) == "websocket"
 
 		// Use WebSocket proxy if enabled and upgrade is requested
 		if isWebSocketUpgrade && route.EnableWebSocket && route.WebSocketProxy != nil {
-			log.Printf("WebSocket upgrade request for %s", r.URL.Path)
-			route.WebSocketProxy.ServeHTTP(w, r)
+			target := route.Upstreams.Pick(r, nil)
+			if target == nil {
+				log.Printf("No upstream available for WebSocket request %s", r.URL.Path)
+				http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+				return
+			}
+
+			log.Printf("WebSocket upgrade request for %s to %s", r.URL.Path, target.URL.String())
+			target.acquire()
+			defer target.release()
+			route.WebSocketProxy.ServeHTTP(w, r.WithContext(setUpstreamTargetInContext(r.Context(), target)))
 			return
 		}
 
 		// Proxy the regular HTTP request
+		if route.Timeout > 0 {
+			ctx, cancel := context.WithTimeout(r.Context(), route.Timeout)
+			defer cancel()
+			r = r.WithContext(ctx)
+		}
 		route.Proxy.ServeHTTP(w, r)
 	})
 }
 
-// findRoute finds the best matching route for a given path
-func (m *MultiProxyMiddleware) findRoute(path string) *ProxyRoute {
-	for _, route := range m.routes {
-		if m.pathMatches(path, route.PathPrefix) {
-			return &route
+// allowRequest takes a token for the request from its rate limit bucket. It
+// answers rejected requests with 429 Too Many Requests. Requests are allowed
+// if the rate limiter fails.
+func (m *MultiProxyMiddleware) allowRequest(w http.ResponseWriter, r *http.Request, policy *rateLimitPolicy) bool {
+	result, err := m.rateLimiter.Allow(r.Context(), policy.bucketKey(r, m.trustedProxies), policy.limit)
+	if err != nil {
+		log.Printf("Rate limiter failed for %s, allowing request: %v", policy.route, err)
+		return true
+	}
+
+	setRateLimitHeaders(w.Header(), policy.limit, result)
+	if !result.Allowed {
+		log.Printf("Rate limit exceeded for %s %s", r.Method, r.URL.Path)
+		http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
+
+// gatewayPaths are handled by the gateway itself, e.g. /auth/logout by the
+// OIDC middleware, and are never served by a public route
+var gatewayPaths = []string{"/auth", "/oidc", "/health"}
+
+// WithPublicRoutes returns a handler that proxies requests for public routes
+// directly and passes all other requests, including the gateway's own paths,
+// to the authenticated handler
+func (m *MultiProxyMiddleware) WithPublicRoutes(authenticated http.Handler) http.Handler {
+	proxy := m.Handler()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isGatewayPath(r.URL.Path) {
+			authenticated.ServeHTTP(w, r)
+			return
+		}
+		if route := m.findRoute(r); route != nil && route.Public {
+			proxy.ServeHTTP(w, r)
+			return
+		}
+		authenticated.ServeHTTP(w, r)
+	})
+}
+
+// isGatewayPath reports whether the path belongs to the gateway itself
+func isGatewayPath(path string) bool {
+	for _, prefix := range gatewayPaths {
+		if prefixMatches(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// findRoute finds the first route in matching order that matches the request
+func (m *MultiProxyMiddleware) findRoute(r *http.Request) *ProxyRoute {
+	for i := range m.routes {
+		route := &m.routes[i]
+		if _, ok := route.paths.match(r.URL.Path); ok && matchesRequest(route.Match, r) {
+			return route
 		}
 	}
 	return nil
@@ -180,6 +445,11 @@ func (m *MultiProxyMiddleware) findRoute(path string) *ProxyRoute {
 
 // pathMatches checks if a path matches a route prefix
 func (m *MultiProxyMiddleware) pathMatches(path, prefix string) bool {
+	return prefixMatches(path, prefix)
+}
+
+// prefixMatches checks if a path matches a route prefix
+func prefixMatches(path, prefix string) bool {
 	if prefix == "/" {
 		return true // Root path matches everything
 	}
@@ -197,72 +467,3 @@ func (m *MultiProxyMiddleware) pathMatches(path, prefix string) bool {
 
 	return strings.HasPrefix(pathForComparison, prefix) || path == strings.TrimSuffix(prefix, "/")
 }
-
-// sortRoutes sorts routes by path length (longest first) for proper matching
-func (m *MultiProxyMiddleware) sortRoutes() {
-	// Simple bubble sort by path length (longest first)
-	n := len(m.routes)
-	for i := 0; i < n-1; i++ {
-		for j := 0; j < n-i-1; j++ {
-			if len(m.routes[j].PathPrefix) < len(m.routes[j+1].PathPrefix) {
-				m.routes[j], m.routes[j+1] = m.routes[j+1], m.routes[j]
-			}
-		}
-	}
-}
-
-// addAuthHeaders adds authentication headers to the request
-func (m *MultiProxyMiddleware) addAuthHeaders(req *http.Request) {
-	// Add user information headers if available
-	if userInfo := GetUserFromContext(req.Context()); userInfo != nil {
-		req.Header.Set("X-Auth-User", userInfo.Sub)
-		req.Header.Set("X-Auth-Email", userInfo.Email)
-		req.Header.Set("X-Auth-Name", userInfo.Name)
-		req.Header.Set("X-Auth-Username", userInfo.PreferredUsername)
-	}
-
-	// Add access token header if available
-	if accessToken := GetAccessTokenFromContext(req.Context()); accessToken != "" {
-		req.Header.Set("Authorization", "Bearer "+accessToken)
-	}
-}
-
-// addCORSHeaders adds CORS headers to the response
-func (m *MultiProxyMiddleware) addCORSHeaders(w http.ResponseWriter, r *http.Request) {
-	origin := r.Header.Get("Origin")
-
-	// Check if origin is allowed
-	if m.isOriginAllowed(origin) {
-		w.Header().Set("Access-Control-Allow-Origin", origin)
-	} else if len(m.config.AllowedOrigins) == 1 && m.config.AllowedOrigins[0] == "*" {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-	}
-
-	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Requested-With")
-	w.Header().Set("Access-Control-Allow-Credentials", "true")
-	w.Header().Set("Access-Control-Max-Age", "86400")
-}
-
-// isOriginAllowed checks if the origin is in the allowed list
-func (m *MultiProxyMiddleware) isOriginAllowed(origin string) bool {
-	if origin == "" {
-		return false
-	}
-
-	for _, allowed := range m.config.AllowedOrigins {
-		if allowed == "*" || allowed == origin {
-			return true
-		}
-
-		// Support for wildcard subdomains (e.g., *.example.com)
-		if strings.HasPrefix(allowed, "*.") {
-			domain := strings.TrimPrefix(allowed, "*.")
-			if strings.HasSuffix(origin, domain) {
-				return true
-			}
-		}
-	}
-
-	return false
-}
@@ -1,7 +1,13 @@
 package middleware
 
 import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/ase-compas/compas-auth-proxy/internal/config"
 )
@@ -14,6 +20,12 @@ func TestMultiProxyRouting(t *testing.T) {
 			{Path: "/api/history", UpstreamURL: "http://history-service:8082", StripPath: true},
 			{Path: "/api", UpstreamURL: "http://api-service:8083", StripPath: false},
 			{Path: "/", UpstreamURL: "http://frontend:80", StripPath: false},
+			{Path: "/api/scl", UpstreamURL: "http://tenant-a-scl:8081", Match: config.RouteMatchConfig{Hosts: []string{"tenant-a.example.com"}}},
+			{Path: "/api", UpstreamURL: "http://tenants:8083", Match: config.RouteMatchConfig{Hosts: []string{"*.example.com"}}},
+			{Path: "/api/scl", UpstreamURL: "http://scl-writer:8081", Match: config.RouteMatchConfig{Methods: []string{"post", "PUT"}}},
+			{Path: "/api/scl", UpstreamURL: "http://scl-beta:8081", Match: config.RouteMatchConfig{Headers: map[string]string{"X-Beta": "true"}}},
+			{Path: "/api/history", UpstreamURL: "http://history-debug:8082", Match: config.RouteMatchConfig{Query: map[string]string{"debug": "*"}}},
+			{Path: "/", UpstreamURL: "http://maintenance:80", Priority: 10, Match: config.RouteMatchConfig{Headers: map[string]string{"X-Maintenance": "*"}}},
 		},
 	}
 
@@ -25,28 +37,144 @@ func TestMultiProxyRouting(t *testing.T) {
 
 	// Test cases
 	testCases := []struct {
+		method   string
+		host     string
 		path     string
+		header   http.Header
 		expected string
+		upstream string
 	}{
-		{"/api/scl/files", "/api/scl"},
-		{"/api/scl", "/api/scl"},
-		{"/api/history/recent", "/api/history"},
-		{"/api/other", "/api"},
-		{"/health", "/"},
-		{"/login", "/"},
-		{"", "/"},
+		{"GET", "gateway", "/api/scl/files", nil, "/api/scl", "http://scl-service:8081"},
+		{"GET", "gateway", "/api/scl", nil, "/api/scl", "http://scl-service:8081"},
+		{"GET", "gateway", "/api/history/recent", nil, "/api/history", "http://history-service:8082"},
+		{"GET", "gateway", "/api/other", nil, "/api", "http://api-service:8083"},
+		{"GET", "gateway", "/health", nil, "/", "http://frontend:80"},
+		{"GET", "gateway", "/login", nil, "/", "http://frontend:80"},
+		{"GET", "gateway", "", nil, "/", "http://frontend:80"},
+
+		// Host predicates, including wildcards and ports
+		{"GET", "tenant-a.example.com", "/api/scl/files", nil, "/api/scl", "http://tenant-a-scl:8081"},
+		{"GET", "TENANT-A.example.com:8443", "/api/scl", nil, "/api/scl", "http://tenant-a-scl:8081"},
+		{"GET", "tenant-b.example.com", "/api/other", nil, "/api", "http://tenants:8083"},
+		{"GET", "example.com", "/api/other", nil, "/api", "http://api-service:8083"},
+
+		// Method, header and query predicates
+		{"POST", "gateway", "/api/scl/files", nil, "/api/scl", "http://scl-writer:8081"},
+		{"GET", "gateway", "/api/scl", http.Header{"X-Beta": {"true"}}, "/api/scl", "http://scl-beta:8081"},
+		{"GET", "gateway", "/api/scl", http.Header{"X-Beta": {"false"}}, "/api/scl", "http://scl-service:8081"},
+		{"GET", "gateway", "/api/history/recent?debug=1", nil, "/api/history", "http://history-debug:8082"},
+
+		// A higher priority wins over longer paths
+		{"GET", "tenant-a.example.com", "/api/scl", http.Header{"X-Maintenance": {"1"}}, "/", "http://maintenance:80"},
 	}
 
 	for _, tc := range testCases {
-		route := middleware.findRoute(tc.path)
+		req := &http.Request{Method: tc.method, Host: tc.host, URL: &url.URL{}, Header: tc.header}
+		if req.Header == nil {
+			req.Header = http.Header{}
+		}
+		if parsed, err := url.Parse(tc.path); err == nil {
+			req.URL = parsed
+		}
+
+		route := middleware.findRoute(req)
 		if route == nil {
-			t.Errorf("No route found for path: %s", tc.path)
+			t.Errorf("No route found for %s %s%s", tc.method, tc.host, tc.path)
 			continue
 		}
 
 		if route.PathPrefix != tc.expected {
 			t.Errorf("Path %s: expected route %s, got %s", tc.path, tc.expected, route.PathPrefix)
 		}
+		if upstream := route.Upstreams.String(); upstream != tc.upstream {
+			t.Errorf("%s %s%s: expected upstream %s, got %s", tc.method, tc.host, tc.path, tc.upstream, upstream)
+		}
+	}
+}
+
+func TestPublicRoutes(t *testing.T) {
+	var received http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+	}))
+	defer backend.Close()
+
+	middleware, err := NewMultiProxyMiddleware(&config.Config{
+		UpstreamRoutes: []config.UpstreamRoute{
+			{
+				Path:        "/public/catalog",
+				UpstreamURL: backend.URL,
+				Public:      true,
+				Identity:    config.IdentityConfig{Token: config.TokenForwardClientCredentials, Scopes: []string{"catalog:read"}},
+			},
+			{Path: "/api", UpstreamURL: backend.URL},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+	middleware.SetClientTokenSource(fakeClientTokens{})
+
+	authenticate := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	})
+	handler := middleware.WithPublicRoutes(authenticate)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/public/catalog/items", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected public route to be proxied, got %d", rec.Code)
+	}
+	if got := received.Get("Authorization"); got != "Bearer client-catalog:read" {
+		t.Errorf("Expected client credentials token, got %q", got)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/api/data", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected protected route to require authentication, got %d", rec.Code)
+	}
+}
+
+func TestPublicStaticRootRoute(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "index.html"), []byte("<app-root></app-root>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	middleware, err := NewMultiProxyMiddleware(&config.Config{
+		UpstreamRoutes: []config.UpstreamRoute{
+			{Path: "/", Public: true, Static: config.StaticConfig{Dir: dir, SPA: true}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+
+	authenticated := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("gateway"))
+	})
+	handler := middleware.WithPublicRoutes(authenticated)
+
+	testCases := []struct {
+		path string
+		body string
+	}{
+		{"/", "<app-root></app-root>"},
+		{"/projects/42", "<app-root></app-root>"},
+		{"/authors", "<app-root></app-root>"},
+		{"/auth/logout", "gateway"},
+		{"/auth", "gateway"},
+		{"/oidc/callback", "gateway"},
+		{"/health", "gateway"},
+	}
+
+	for _, tc := range testCases {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", tc.path, nil))
+		if body := rec.Body.String(); body != tc.body {
+			t.Errorf("%s: expected %q, got %q", tc.path, tc.body, body)
+		}
 	}
 }
 
@@ -75,3 +203,44 @@ func TestPathMatching(t *testing.T) {
 		}
 	}
 }
+
+func TestProxyTimeouts(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Never answer before the test is done or the request is cancelled
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer backend.Close()
+	defer close(release)
+
+	testCases := []struct {
+		name     string
+		timeouts config.TimeoutConfig
+	}{
+		{"response header", config.TimeoutConfig{ResponseHeader: 50 * time.Millisecond}},
+		{"overall", config.TimeoutConfig{Overall: 50 * time.Millisecond}},
+	}
+
+	for _, tc := range testCases {
+		middleware, err := NewMultiProxyMiddleware(&config.Config{
+			UpstreamRoutes: []config.UpstreamRoute{{
+				Path:        "/api",
+				UpstreamURL: backend.URL,
+				StripPath:   true,
+				Timeouts:    tc.timeouts,
+			}},
+		})
+		if err != nil {
+			t.Fatalf("%s: failed to create middleware: %v", tc.name, err)
+		}
+
+		rec := httptest.NewRecorder()
+		middleware.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/api/slow", nil))
+		if rec.Code != http.StatusGatewayTimeout {
+			t.Errorf("%s: expected 504, got %d", tc.name, rec.Code)
+		}
+	}
+}
@@ -1,9 +1,11 @@
 package middleware
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -20,6 +22,7 @@ type OIDCMiddleware struct {
 	httpClient     *http.Client
 	providerConfig *ProviderConfig
 	sessionStore   SessionStore
+	trustedProxies *TrustedProxies
 }
 
 // ProviderConfig represents OpenID Connect provider configuration
@@ -42,33 +45,91 @@ type TokenResponse struct {
 
 // UserInfo represents user information from the provider
 type UserInfo struct {
-	Sub               string `json:"sub"`
-	Name              string `json:"name"`
-	Email             string `json:"email"`
-	PreferredUsername string `json:"preferred_username"`
+	Sub               string                 `json:"sub"`
+	Name              string                 `json:"name"`
+	Email             string                 `json:"email"`
+	PreferredUsername string                 `json:"preferred_username"`
+	Roles             []string               `json:"roles,omitempty"`
+	Claims            map[string]interface{} `json:"claims,omitempty"` // All claims of the userinfo response
+}
+
+// newUserInfo extracts the user information from the claims of a userinfo
+// response. Roles are read from the claim at the dot-separated rolesClaim path.
+func newUserInfo(claims map[string]interface{}, rolesClaim string) *UserInfo {
+	stringClaim := func(name string) string {
+		value, _ := claims[name].(string)
+		return value
+	}
+
+	userInfo := &UserInfo{
+		Sub:               stringClaim("sub"),
+		Name:              stringClaim("name"),
+		Email:             stringClaim("email"),
+		PreferredUsername: stringClaim("preferred_username"),
+		Claims:            claims,
+	}
+
+	if values, ok := lookupClaim(claims, rolesClaim).([]interface{}); ok {
+		for _, value := range values {
+			if role, ok := value.(string); ok {
+				userInfo.Roles = append(userInfo.Roles, role)
+			}
+		}
+	}
+	return userInfo
+}
+
+// lookupClaim returns the claim at a dot-separated path, e.g. realm_access.roles
+func lookupClaim(claims map[string]interface{}, path string) interface{} {
+	var value interface{} = claims
+	for _, name := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = object[name]
+	}
+	return value
 }
 
 // SessionStore interface for session management
 type SessionStore interface {
 	Get(sessionID string) (*SessionData, error)
 	Set(sessionID string, data *SessionData) error
+	SetWithLimit(sessionID string, data *SessionData, limit int, strategy string) ([]SessionEntry, error)
 	Delete(sessionID string) error
+	Touch(sessionID string, at time.Time) error
+	List() ([]SessionEntry, error)
+	ListByUser(sub string) ([]SessionEntry, error)
+	DeleteByUser(sub string) (int, error)
+	Rotate(oldID, newID string, data *SessionData) error
 }
 
 // SessionData represents session information
 type SessionData struct {
 	UserInfo    *UserInfo `json:"user_info"`
 	AccessToken string    `json:"access_token"`
+	IDToken     string    `json:"id_token"`
 	ExpiresAt   time.Time `json:"expires_at"`
 	State       string    `json:"state"`
+	CreatedAt   time.Time `json:"created_at"`
+	LastSeen    time.Time `json:"last_seen"`
+	IPAddress   string    `json:"ip_address"`
+	UserAgent   string    `json:"user_agent"`
 }
 
 // NewOIDCMiddleware creates a new OIDC middleware instance
 func NewOIDCMiddleware(cfg *config.Config, sessionStore SessionStore) (*OIDCMiddleware, error) {
+	trustedProxies, err := NewTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
 	middleware := &OIDCMiddleware{
-		config:       cfg,
-		httpClient:   &http.Client{Timeout: 30 * time.Second},
-		sessionStore: sessionStore,
+		config:         cfg,
+		httpClient:     &http.Client{Timeout: 30 * time.Second},
+		sessionStore:   sessionStore,
+		trustedProxies: trustedProxies,
 	}
 
 	// Discover provider configuration
@@ -135,9 +196,31 @@ func (m *OIDCMiddleware) Handler(next http.Handler) http.Handler {
 			return
 		}
 
+		// Verify the request comes from the client the session is bound to
+		if m.config.SessionBindingEnabled {
+			if mismatch := m.checkSessionBinding(sessionData, r); mismatch != "" {
+				log.Printf("AUDIT: session binding mismatch for user %s (session %s): %s",
+					sessionSubject(sessionData), publicSessionID(sessionID), mismatch)
+
+				if m.config.SessionBindingMode == config.SessionBindingReject {
+					http.Error(w, "Unauthorized", http.StatusUnauthorized)
+					return
+				}
+
+				m.sessionStore.Delete(sessionID)
+				m.redirectToLogin(w, r)
+				return
+			}
+		}
+
+		if err := m.sessionStore.Touch(sessionID, time.Now()); err != nil {
+			log.Printf("Failed to update last seen for session: %v", err)
+		}
+
 		// Add user information to request context
 		ctx := SetUserInContext(r.Context(), sessionData.UserInfo)
 		ctx = SetAccessTokenInContext(ctx, sessionData.AccessToken)
+		ctx = SetIDTokenInContext(ctx, sessionData.IDToken)
 
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
@@ -173,22 +256,61 @@ func (m *OIDCMiddleware) HandleCallback(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	// A session presented at login is never reused to prevent session fixation.
+	// If it belongs to the same user (re-authentication), it is rotated to a new
+	// ID together with the refreshed tokens; otherwise it is discarded.
+	previousID := m.getSessionID(r)
+	reauthenticated := false
+	if previousID != "" {
+		if previous, err := m.sessionStore.Get(previousID); err == nil && sessionSubject(previous) == userInfo.Sub {
+			reauthenticated = true
+		} else {
+			m.sessionStore.Delete(previousID)
+		}
+	}
+
 	// Create session
-	sessionID := m.generateSessionID()
+	sessionID, err := m.generateSessionID()
+	if err != nil {
+		log.Printf("Failed to generate session ID: %v", err)
+		http.Error(w, "Failed to create session", http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
 	sessionData := &SessionData{
 		UserInfo:    userInfo,
 		AccessToken: tokenResp.AccessToken,
-		ExpiresAt:   time.Now().Add(time.Duration(m.config.SessionMaxAge) * time.Second),
+		IDToken:     tokenResp.IDToken,
+		ExpiresAt:   now.Add(time.Duration(m.config.SessionMaxAge) * time.Second),
 		State:       state,
+		CreatedAt:   now,
+		LastSeen:    now,
+		IPAddress:   m.trustedProxies.ClientIP(r),
+		UserAgent:   r.UserAgent(),
 	}
 
-	if err := m.sessionStore.Set(sessionID, sessionData); err != nil {
+	// New sessions are subject to the concurrent session limit of the user
+	if reauthenticated {
+		err = m.sessionStore.Rotate(previousID, sessionID, sessionData)
+	} else {
+		var evicted []SessionEntry
+		evicted, err = m.sessionStore.SetWithLimit(sessionID, sessionData, m.config.SessionMaxPerUser, m.config.SessionLimitStrategy)
+		for _, session := range evicted {
+			log.Printf("Evicted oldest session of user %s created at %s", userInfo.Sub, session.Data.CreatedAt.Format(time.RFC3339))
+		}
+	}
+	if errors.Is(err, errSessionLimitReached) {
+		log.Printf("Login rejected for user %s: %v (limit %d)", userInfo.Sub, err, m.config.SessionMaxPerUser)
+		http.Error(w, "Maximum number of concurrent sessions reached", http.StatusForbidden)
+		return
+	}
+	if err != nil {
 		http.Error(w, "Failed to create session", http.StatusInternalServerError)
 		return
 	}
 
 	// Set session cookie
-	m.setSessionCookie(w, sessionID)
+	m.setSessionCookie(w, r, sessionID)
 
 	// Redirect to original URL or home
 	redirectURL := "/"
@@ -199,9 +321,30 @@ func (m *OIDCMiddleware) HandleCallback(w http.ResponseWriter, r *http.Request)
 	http.Redirect(w, r, redirectURL, http.StatusFound)
 }
 
+// checkSessionBinding compares the client of a request with the client recorded
+// at login and describes the mismatch, or returns an empty string if they match
+func (m *OIDCMiddleware) checkSessionBinding(sessionData *SessionData, r *http.Request) string {
+	clientIP := m.trustedProxies.ClientIP(r)
+	ipv4Prefix, ipv6Prefix := m.config.SessionBindingPrefixes()
+	if !sameNetwork(sessionData.IPAddress, clientIP, ipv4Prefix, ipv6Prefix) {
+		return fmt.Sprintf("client IP changed from %s to %s", sessionData.IPAddress, clientIP)
+	}
+
+	if m.config.SessionBindingCheckUserAgent && sessionData.UserAgent != r.UserAgent() {
+		return fmt.Sprintf("user agent changed from %q to %q", sessionData.UserAgent, r.UserAgent())
+	}
+
+	return ""
+}
+
 // redirectToLogin redirects the user to the OIDC provider for authentication
 func (m *OIDCMiddleware) redirectToLogin(w http.ResponseWriter, r *http.Request) {
-	state := m.generateState()
+	state, err := m.generateState()
+	if err != nil {
+		log.Printf("Failed to generate state parameter: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
 
 	authURL, _ := url.Parse(m.providerConfig.AuthorizationEndpoint)
 	query := authURL.Query()
@@ -249,6 +392,42 @@ func (m *OIDCMiddleware) exchangeCodeForToken(code string) (*TokenResponse, erro
 	return &tokenResp, nil
 }
 
+// requestToken posts a token request to the token endpoint and returns the
+// issued access token. OAuth error responses are included in the error.
+func requestToken(ctx context.Context, client *http.Client, endpoint string, data url.Values) (*TokenResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, strings.NewReader(data.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var oauthErr struct {
+			Error       string `json:"error"`
+			Description string `json:"error_description"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&oauthErr) == nil && oauthErr.Error != "" {
+			return nil, fmt.Errorf("status %d: %s %s", resp.StatusCode, oauthErr.Error, oauthErr.Description)
+		}
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+
+	var tokenResp TokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return nil, err
+	}
+	if tokenResp.AccessToken == "" {
+		return nil, fmt.Errorf("response contains no access token")
+	}
+	return &tokenResp, nil
+}
+
 // getUserInfo retrieves user information using the access token
 func (m *OIDCMiddleware) getUserInfo(accessToken string) (*UserInfo, error) {
 	req, err := http.NewRequest("GET", m.providerConfig.UserInfoEndpoint, nil)
@@ -268,12 +447,12 @@ func (m *OIDCMiddleware) getUserInfo(accessToken string) (*UserInfo, error) {
 		return nil, fmt.Errorf("userinfo request failed with status: %d", resp.StatusCode)
 	}
 
-	var userInfo UserInfo
-	if err := json.NewDecoder(resp.Body).Decode(&userInfo); err != nil {
+	var claims map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&claims); err != nil {
 		return nil, err
 	}
 
-	return &userInfo, nil
+	return newUserInfo(claims, m.config.OIDCRolesClaim), nil
 }
 
 // handleLogout handles user logout
@@ -285,23 +464,15 @@ func (m *OIDCMiddleware) handleLogout(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Clear session cookie
-	cookie := &http.Cookie{
-		Name:     m.config.SessionCookieName,
-		Value:    "",
-		Path:     "/",
-		MaxAge:   -1,
-		HttpOnly: true,
-		Secure:   r.TLS != nil,
-	}
-	http.SetCookie(w, cookie)
-	log.Printf("Session cookie %s cleared", m.config.SessionCookieName)
+	m.clearSessionCookie(w, r)
+	log.Printf("Session cookie %s cleared", m.sessionCookieName())
 
 	http.Redirect(w, r, "/", http.StatusFound)
 }
 
 // getSessionID extracts session ID from request cookie
 func (m *OIDCMiddleware) getSessionID(r *http.Request) string {
-	cookie, err := r.Cookie(m.config.SessionCookieName)
+	cookie, err := r.Cookie(m.sessionCookieName())
 	if err != nil {
 		return ""
 	}
@@ -309,29 +480,70 @@ func (m *OIDCMiddleware) getSessionID(r *http.Request) string {
 }
 
 // setSessionCookie sets the session cookie
-func (m *OIDCMiddleware) setSessionCookie(w http.ResponseWriter, sessionID string) {
+func (m *OIDCMiddleware) setSessionCookie(w http.ResponseWriter, r *http.Request, sessionID string) {
+	http.SetCookie(w, m.newSessionCookie(r, sessionID, m.config.SessionMaxAge))
+}
+
+// clearSessionCookie instructs the browser to remove the session cookie
+func (m *OIDCMiddleware) clearSessionCookie(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, m.newSessionCookie(r, "", -1))
+}
+
+// sessionCookieName returns the session cookie name including its prefix
+func (m *OIDCMiddleware) sessionCookieName() string {
+	return m.config.SessionCookiePrefix + m.config.SessionCookieName
+}
+
+// newSessionCookie builds the session cookie with the configured attributes
+func (m *OIDCMiddleware) newSessionCookie(r *http.Request, value string, maxAge int) *http.Cookie {
 	cookie := &http.Cookie{
-		Name:     m.config.SessionCookieName,
-		Value:    sessionID,
-		Path:     "/",
-		MaxAge:   m.config.SessionMaxAge,
+		Name:     m.sessionCookieName(),
+		Value:    value,
+		Path:     m.config.SessionCookiePath,
+		Domain:   m.config.SessionCookieDomain,
+		MaxAge:   maxAge,
 		HttpOnly: true,
-		Secure:   false, // Set to true in production with HTTPS
-		SameSite: http.SameSiteLaxMode,
 	}
-	http.SetCookie(w, cookie)
+	if cookie.Path == "" {
+		cookie.Path = "/"
+	}
+
+	switch m.config.SessionCookieSecure {
+	case config.CookieSecureTrue:
+		cookie.Secure = true
+	case config.CookieSecureFalse:
+		cookie.Secure = false
+	default:
+		cookie.Secure = m.trustedProxies.IsHTTPS(r)
+	}
+
+	switch m.config.SessionCookieSameSite {
+	case config.CookieSameSiteStrict:
+		cookie.SameSite = http.SameSiteStrictMode
+	case config.CookieSameSiteNone:
+		cookie.SameSite = http.SameSiteNoneMode
+	default:
+		cookie.SameSite = http.SameSiteLaxMode
+	}
+
+	return cookie
 }
 
 // generateState generates a random state parameter
-func (m *OIDCMiddleware) generateState() string {
-	b := make([]byte, 32)
-	rand.Read(b)
-	return base64.URLEncoding.EncodeToString(b)
+func (m *OIDCMiddleware) generateState() (string, error) {
+	return randomToken(32)
 }
 
 // generateSessionID generates a random session ID
-func (m *OIDCMiddleware) generateSessionID() string {
-	b := make([]byte, 32)
-	rand.Read(b)
-	return base64.URLEncoding.EncodeToString(b)
+func (m *OIDCMiddleware) generateSessionID() (string, error) {
+	return randomToken(32)
+}
+
+// randomToken returns n cryptographically random bytes encoded as URL-safe base64
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to read random bytes: %v", err)
+	}
+	return base64.URLEncoding.EncodeToString(b), nil
 }
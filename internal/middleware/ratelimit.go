@@ -0,0 +1,188 @@
+package middleware
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ase-compas/compas-auth-proxy/internal/config"
+)
+
+// RateLimit describes a token bucket: Burst tokens at most, refilled at
+// Requests tokens per Window
+type RateLimit struct {
+	Requests int
+	Window   time.Duration
+	Burst    int
+}
+
+// rate returns the number of tokens added per second
+func (l RateLimit) rate() float64 {
+	return float64(l.Requests) / l.Window.Seconds()
+}
+
+// RateLimitResult is the outcome of taking a token from a bucket
+type RateLimitResult struct {
+	Allowed    bool
+	Remaining  int           // Tokens left in the bucket
+	Reset      time.Duration // Time until the bucket is full again
+	RetryAfter time.Duration // Time until the next token is available if not allowed
+}
+
+// RateLimiter takes tokens from rate limit buckets. Implementations backed by
+// a shared store allow limits across multiple gateway replicas.
+type RateLimiter interface {
+	Allow(ctx context.Context, key string, limit RateLimit) (RateLimitResult, error)
+}
+
+// rateLimitSweepInterval is how often idle buckets are removed from memory
+const rateLimitSweepInterval = time.Minute
+
+// tokenBucket is the state of a single bucket
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+	full    time.Time // When the bucket is full again and can be forgotten
+}
+
+// MemoryRateLimiter keeps rate limit buckets in memory. Limits apply per
+// gateway instance.
+type MemoryRateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// NewMemoryRateLimiter creates a new in-memory rate limiter
+func NewMemoryRateLimiter() *MemoryRateLimiter {
+	return &MemoryRateLimiter{
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+		now:       time.Now,
+	}
+}
+
+// Allow takes a token from the bucket of the key
+func (l *MemoryRateLimiter) Allow(ctx context.Context, key string, limit RateLimit) (RateLimitResult, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweepLocked(now)
+
+	rate := limit.rate()
+	burst := float64(limit.Burst)
+	bucket := l.buckets[key]
+	if bucket == nil {
+		bucket = &tokenBucket{tokens: burst, updated: now}
+		l.buckets[key] = bucket
+	}
+
+	// Refill the tokens added since the last request
+	bucket.tokens = math.Min(burst, bucket.tokens+now.Sub(bucket.updated).Seconds()*rate)
+	bucket.updated = now
+
+	var result RateLimitResult
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = secondsDuration((1 - bucket.tokens) / rate)
+	}
+	result.Remaining = int(bucket.tokens)
+	result.Reset = secondsDuration((burst - bucket.tokens) / rate)
+	bucket.full = now.Add(result.Reset)
+	return result, nil
+}
+
+// sweepLocked removes buckets that have refilled completely, as they are
+// equivalent to new buckets
+func (l *MemoryRateLimiter) sweepLocked(now time.Time) {
+	if now.Sub(l.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for key, bucket := range l.buckets {
+		if !now.Before(bucket.full) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// secondsDuration converts fractional seconds to a duration
+func secondsDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// rateLimitPolicy limits the requests to a route
+type rateLimitPolicy struct {
+	route        string
+	limit        RateLimit
+	key          string
+	apiKeyHeader string
+}
+
+// newRateLimitPolicy creates the rate limit policy of a route, or nil if the
+// route is not limited
+func newRateLimitPolicy(route string, cfg config.RateLimitConfig) *rateLimitPolicy {
+	if cfg.Requests <= 0 {
+		return nil
+	}
+	p := &rateLimitPolicy{
+		route:        route,
+		limit:        RateLimit{Requests: cfg.Requests, Window: cfg.Window, Burst: cfg.Burst},
+		key:          cfg.Key,
+		apiKeyHeader: cfg.APIKeyHeader,
+	}
+	if p.limit.Window <= 0 {
+		p.limit.Window = time.Minute
+	}
+	if p.limit.Burst <= 0 {
+		p.limit.Burst = p.limit.Requests
+	}
+	if p.key == "" {
+		p.key = config.RateLimitKeyUser
+	}
+	if p.apiKeyHeader == "" {
+		p.apiKeyHeader = "X-API-Key"
+	}
+	return p
+}
+
+// bucketKey returns the key of the bucket the request takes a token from
+func (p *rateLimitPolicy) bucketKey(r *http.Request, trustedProxies *TrustedProxies) string {
+	switch p.key {
+	case config.RateLimitKeyUser:
+		if userInfo := GetUserFromContext(r.Context()); userInfo != nil && userInfo.Sub != "" {
+			return p.route + "|user|" + userInfo.Sub
+		}
+	case config.RateLimitKeyAPIKey:
+		if apiKey := r.Header.Get(p.apiKeyHeader); apiKey != "" {
+			// Never keep API keys themselves in memory
+			sum := sha256.Sum256([]byte(apiKey))
+			return p.route + "|api_key|" + hex.EncodeToString(sum[:])
+		}
+	}
+	return p.route + "|ip|" + trustedProxies.ClientIP(r)
+}
+
+// setRateLimitHeaders adds the RateLimit-* headers describing the bucket
+func setRateLimitHeaders(header http.Header, limit RateLimit, result RateLimitResult) {
+	header.Set("RateLimit-Limit", strconv.Itoa(limit.Burst))
+	header.Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	header.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+	if !result.Allowed {
+		header.Set("Retry-After", strconv.Itoa(ceilSeconds(result.RetryAfter)))
+	}
+}
+
+// ceilSeconds rounds a duration up to whole seconds
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
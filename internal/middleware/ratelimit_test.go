@@ -0,0 +1,127 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ase-compas/compas-auth-proxy/internal/config"
+)
+
+func TestMemoryRateLimiter(t *testing.T) {
+	limiter := NewMemoryRateLimiter()
+	now := time.Now()
+	limiter.now = func() time.Time { return now }
+	limit := RateLimit{Requests: 2, Window: 2 * time.Second, Burst: 3}
+
+	for i := 0; i < 3; i++ {
+		result, _ := limiter.Allow(context.Background(), "key", limit)
+		if !result.Allowed || result.Remaining != 2-i {
+			t.Fatalf("Request %d: expected allowed with %d remaining, got %+v", i+1, 2-i, result)
+		}
+	}
+
+	result, _ := limiter.Allow(context.Background(), "key", limit)
+	if result.Allowed || result.RetryAfter != time.Second || result.Reset != 3*time.Second {
+		t.Errorf("Expected rejection with retry after 1s and reset 3s, got %+v", result)
+	}
+
+	// Other keys have their own bucket
+	if result, _ := limiter.Allow(context.Background(), "other", limit); !result.Allowed {
+		t.Error("Expected a separate bucket for another key")
+	}
+
+	now = now.Add(time.Second)
+	if result, _ := limiter.Allow(context.Background(), "key", limit); !result.Allowed || result.Remaining != 0 {
+		t.Errorf("Expected one refilled token after 1s, got %+v", result)
+	}
+
+	// Full buckets are removed from memory
+	now = now.Add(time.Hour)
+	limiter.Allow(context.Background(), "key", limit)
+	if len(limiter.buckets) != 1 {
+		t.Errorf("Expected idle buckets to be removed, got %d buckets", len(limiter.buckets))
+	}
+}
+
+// failingRateLimiter simulates an unavailable shared backend
+type failingRateLimiter struct{}
+
+func (failingRateLimiter) Allow(ctx context.Context, key string, limit RateLimit) (RateLimitResult, error) {
+	return RateLimitResult{}, errors.New("connection refused")
+}
+
+func TestRouteRateLimits(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	newMiddleware := func() *MultiProxyMiddleware {
+		middleware, err := NewMultiProxyMiddleware(&config.Config{
+			RateLimit: config.RateLimitConfig{Requests: 2, Window: time.Minute},
+			UpstreamRoutes: []config.UpstreamRoute{
+				{Path: "/api", UpstreamURL: backend.URL},
+				{Path: "/partner", UpstreamURL: backend.URL, RateLimit: config.RateLimitConfig{Requests: 1, Key: config.RateLimitKeyAPIKey}},
+				{Path: "/static", UpstreamURL: backend.URL, RateLimit: config.RateLimitConfig{Disabled: true}},
+			},
+		})
+		if err != nil {
+			t.Fatalf("Failed to create middleware: %v", err)
+		}
+		return middleware
+	}
+
+	send := func(middleware *MultiProxyMiddleware, path, sub, apiKey string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = "192.0.2.10:40000"
+		if sub != "" {
+			req = req.WithContext(SetUserInContext(req.Context(), &UserInfo{Sub: sub}))
+		}
+		if apiKey != "" {
+			req.Header.Set("X-API-Key", apiKey)
+		}
+		rec := httptest.NewRecorder()
+		middleware.Handler().ServeHTTP(rec, req)
+		return rec
+	}
+
+	middleware := newMiddleware()
+	send(middleware, "/api/a", "alice", "")
+	if rec := send(middleware, "/api/a", "alice", ""); rec.Code != http.StatusOK || rec.Header().Get("RateLimit-Remaining") != "0" {
+		t.Errorf("Expected second request to pass with 0 remaining, got %d %v", rec.Code, rec.Header())
+	}
+	rec := send(middleware, "/api/a", "alice", "")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "30" || rec.Header().Get("RateLimit-Limit") != "2" {
+		t.Errorf("Expected 429 with Retry-After 30, got %d %v", rec.Code, rec.Header())
+	}
+	if rec := send(middleware, "/api/a", "bob", ""); rec.Code != http.StatusOK {
+		t.Errorf("Expected another user to have its own limit, got %d", rec.Code)
+	}
+
+	if rec := send(middleware, "/partner/x", "", "key-1"); rec.Code != http.StatusOK {
+		t.Errorf("Expected first API key request to pass, got %d", rec.Code)
+	}
+	if rec := send(middleware, "/partner/x", "", "key-1"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected API key limit to be enforced, got %d", rec.Code)
+	}
+	if rec := send(middleware, "/partner/x", "", "key-2"); rec.Code != http.StatusOK {
+		t.Errorf("Expected another API key to have its own limit, got %d", rec.Code)
+	}
+
+	for i := 0; i < 5; i++ {
+		if rec := send(middleware, "/static/app.js", "alice", ""); rec.Code != http.StatusOK || rec.Header().Get("RateLimit-Limit") != "" {
+			t.Fatalf("Expected unlimited route, got %d %v", rec.Code, rec.Header())
+		}
+	}
+
+	// A failing shared backend does not block requests
+	middleware = newMiddleware()
+	middleware.SetRateLimiter(failingRateLimiter{})
+	for i := 0; i < 3; i++ {
+		if rec := send(middleware, "/api/a", "alice", ""); rec.Code != http.StatusOK {
+			t.Fatalf("Expected requests to pass when the rate limiter fails, got %d", rec.Code)
+		}
+	}
+}
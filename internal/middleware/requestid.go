@@ -0,0 +1,46 @@
+package middleware
+
+import (
+	"net/http"
+)
+
+// RequestIDHeader carries the ID that correlates a request across the gateway
+// and the upstreams
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength limits the length of request IDs accepted from clients
+const maxRequestIDLength = 128
+
+// RequestID assigns every request an ID, reusing a well-formed ID sent by the
+// client. The ID is stored in the request context, forwarded to the upstream
+// and returned in the response.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(RequestIDHeader)
+		if !validRequestID(requestID) {
+			id, err := randomToken(16)
+			if err != nil {
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			requestID = id
+			r.Header.Set(RequestIDHeader, requestID)
+		}
+
+		w.Header().Set(RequestIDHeader, requestID)
+		next.ServeHTTP(w, r.WithContext(setRequestIDInContext(r.Context(), requestID)))
+	})
+}
+
+// validRequestID reports whether a client-provided request ID can be reused
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
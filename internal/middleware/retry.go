@@ -0,0 +1,165 @@
+package middleware
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ase-compas/compas-auth-proxy/internal/config"
+)
+
+// retryPolicy decides whether and when a failed upstream request is retried
+type retryPolicy struct {
+	attempts           int
+	backoff            time.Duration
+	maxBackoff         time.Duration
+	onConnectError     bool
+	onTimeout          bool
+	statuses           map[int]bool
+	allowNonIdempotent bool
+	maxBodySize        int64
+}
+
+// newRetryPolicy creates the retry policy of a route, or nil if retries are disabled
+func newRetryPolicy(cfg config.RetryConfig) *retryPolicy {
+	if cfg.Attempts <= 1 {
+		return nil
+	}
+
+	policy := &retryPolicy{
+		attempts:           cfg.Attempts,
+		backoff:            cfg.Backoff,
+		maxBackoff:         cfg.MaxBackoff,
+		statuses:           make(map[int]bool),
+		allowNonIdempotent: cfg.AllowNonIdempotent,
+		maxBodySize:        int64(cfg.MaxBodySize),
+	}
+	if policy.backoff == 0 {
+		policy.backoff = 100 * time.Millisecond
+	}
+	if policy.maxBackoff == 0 {
+		policy.maxBackoff = 2 * time.Second
+	}
+	if policy.maxBodySize == 0 {
+		policy.maxBodySize = int64(config.Megabyte)
+	}
+
+	retryOn := cfg.RetryOn
+	if len(retryOn) == 0 {
+		retryOn = []string{config.RetryOnConnectError, "502", "503", "504"}
+	}
+	for _, condition := range retryOn {
+		switch condition {
+		case config.RetryOnConnectError:
+			policy.onConnectError = true
+		case config.RetryOnTimeout:
+			policy.onTimeout = true
+		default:
+			if status, err := strconv.Atoi(condition); err == nil {
+				policy.statuses[status] = true
+			}
+		}
+	}
+
+	return policy
+}
+
+// appliesTo reports whether requests with the method of req may be retried
+func (p *retryPolicy) appliesTo(req *http.Request) bool {
+	if p == nil {
+		return false
+	}
+	if p.allowNonIdempotent {
+		return true
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// retryableError reports whether a transport error may be retried
+func (p *retryPolicy) retryableError(err error) bool {
+	var opErr *net.OpError
+	var dnsErr *net.DNSError
+	if errors.As(err, &opErr) && opErr.Op == "dial" || errors.As(err, &dnsErr) {
+		return p.onConnectError
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return p.onTimeout
+	}
+	return false
+}
+
+// retryableStatus reports whether an upstream response status may be retried
+func (p *retryPolicy) retryableStatus(status int) bool {
+	return p.statuses[status]
+}
+
+// delay returns the backoff before the given retry (starting at 1)
+func (p *retryPolicy) delay(retry int) time.Duration {
+	delay := p.backoff
+	for i := 1; i < retry && delay < p.maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > p.maxBackoff {
+		delay = p.maxBackoff
+	}
+	return delay
+}
+
+// replayableBody holds a buffered request body that can be sent several times
+type replayableBody struct {
+	data []byte
+}
+
+// bufferRequestBody reads the body of req so that it can be replayed. If the
+// body exceeds maxSize, the returned request streams the body once and the
+// replayable body is nil.
+func bufferRequestBody(req *http.Request, maxSize int64) (*http.Request, *replayableBody, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req, &replayableBody{}, nil
+	}
+	if req.ContentLength > maxSize {
+		return req, nil, nil
+	}
+
+	data, err := io.ReadAll(io.LimitReader(req.Body, maxSize+1))
+	if err != nil {
+		req.Body.Close()
+		return nil, nil, err
+	}
+
+	if int64(len(data)) > maxSize {
+		// Too large to buffer: stream what was read followed by the rest
+		streamed := req.WithContext(req.Context())
+		streamed.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(data), req.Body), req.Body}
+		return streamed, nil, nil
+	}
+
+	req.Body.Close()
+	return req, &replayableBody{data: data}, nil
+}
+
+// attach returns a copy of req that sends the buffered body from the start
+func (b *replayableBody) attach(req *http.Request) *http.Request {
+	attempt := req.WithContext(req.Context())
+	if b.data == nil {
+		return attempt
+	}
+	attempt.Body = io.NopCloser(bytes.NewReader(b.data))
+	attempt.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(b.data)), nil
+	}
+	return attempt
+}
@@ -0,0 +1,122 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ase-compas/compas-auth-proxy/internal/config"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := newRetryPolicy(config.RetryConfig{
+		Attempts:   5,
+		Backoff:    100 * time.Millisecond,
+		MaxBackoff: 300 * time.Millisecond,
+	})
+
+	expected := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 300 * time.Millisecond, 300 * time.Millisecond}
+	for i, want := range expected {
+		if got := policy.delay(i + 1); got != want {
+			t.Errorf("Retry %d: expected delay %v, got %v", i+1, want, got)
+		}
+	}
+
+	if newRetryPolicy(config.RetryConfig{Attempts: 1}) != nil {
+		t.Error("Expected a single attempt to disable retries")
+	}
+}
+
+func TestProxyRetries(t *testing.T) {
+	var failingHits, healthyHits int32
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&failingHits, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer failing.Close()
+
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&healthyHits, 1)
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer healthy.Close()
+
+	newMiddleware := func(retry config.RetryConfig) *MultiProxyMiddleware {
+		middleware, err := NewMultiProxyMiddleware(&config.Config{
+			UpstreamRoutes: []config.UpstreamRoute{{
+				Path: "/api",
+				Upstreams: []config.UpstreamTarget{
+					{URL: failing.URL},
+					{URL: healthy.URL},
+				},
+				Retry: retry,
+			}},
+		})
+		if err != nil {
+			t.Fatalf("Failed to create middleware: %v", err)
+		}
+		return middleware
+	}
+
+	serve := func(middleware *MultiProxyMiddleware, method, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		middleware.Handler().ServeHTTP(rec, httptest.NewRequest(method, "/api/data", strings.NewReader(body)))
+		return rec
+	}
+
+	retrying := newMiddleware(config.RetryConfig{Attempts: 2, Backoff: time.Millisecond})
+
+	// Whichever target is picked first, the request ends up at the healthy one
+	for i := 0; i < 4; i++ {
+		rec := serve(retrying, "PUT", "payload")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected retried PUT to succeed, got %d", rec.Code)
+		}
+		if rec.Body.String() != "payload" {
+			t.Errorf("Expected body to be replayed, got %q", rec.Body.String())
+		}
+	}
+	if hits := atomic.LoadInt32(&failingHits); hits != 2 {
+		t.Errorf("Expected failing target to be tried twice, got %d", hits)
+	}
+
+	// POST is not idempotent and is not retried by default
+	atomic.StoreInt32(&failingHits, 0)
+	atomic.StoreInt32(&healthyHits, 0)
+	failed := 0
+	for i := 0; i < 4; i++ {
+		if rec := serve(retrying, "POST", "payload"); rec.Code == http.StatusBadGateway {
+			failed++
+		}
+	}
+	if failed != 2 || atomic.LoadInt32(&failingHits)+atomic.LoadInt32(&healthyHits) != 4 {
+		t.Errorf("Expected POST requests not to be retried, got %d failures", failed)
+	}
+
+	allowPost := newMiddleware(config.RetryConfig{Attempts: 2, Backoff: time.Millisecond, AllowNonIdempotent: true})
+	for i := 0; i < 4; i++ {
+		if rec := serve(allowPost, "POST", "payload"); rec.Code != http.StatusOK {
+			t.Fatalf("Expected POST to be retried when allowed, got %d", rec.Code)
+		}
+	}
+
+	// Bodies larger than max_body_size are streamed once without retries
+	limited := newMiddleware(config.RetryConfig{Attempts: 2, Backoff: time.Millisecond, MaxBodySize: 4})
+	failed = 0
+	for i := 0; i < 4; i++ {
+		rec := serve(limited, "PUT", "too large")
+		if rec.Code == http.StatusBadGateway {
+			failed++
+		} else if rec.Body.String() != "too large" {
+			t.Errorf("Expected streamed body to be forwarded, got %q", rec.Body.String())
+		}
+	}
+	if failed != 2 {
+		t.Errorf("Expected large bodies not to be retried, got %d failures", failed)
+	}
+}
@@ -0,0 +1,150 @@
+package middleware
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/ase-compas/compas-auth-proxy/internal/config"
+)
+
+// pathMatcher matches request paths against the path of a route, which can be
+// a plain prefix, a template with {name} segments and/or a regular expression,
+// and rewrites matching paths for the upstream
+type pathMatcher struct {
+	prefix   string
+	segments []string // template segments, nil for plain prefixes
+	regex    *regexp.Regexp
+	rewrite  string
+	query    config.QueryRewriteConfig
+}
+
+// newPathMatcher creates the path matcher of a route
+func newPathMatcher(route config.UpstreamRoute) (*pathMatcher, error) {
+	matcher := &pathMatcher{
+		prefix:  route.Path,
+		rewrite: route.Rewrite,
+		query:   route.Query,
+	}
+	if strings.Contains(route.Path, "{") {
+		matcher.segments = strings.Split(strings.Trim(route.Path, "/"), "/")
+	}
+	if route.PathRegex != "" {
+		regex, err := regexp.Compile(route.PathRegex)
+		if err != nil {
+			return nil, err
+		}
+		matcher.regex = regex
+	}
+	return matcher, nil
+}
+
+// pathMatch is the result of matching a request path against a route
+type pathMatch struct {
+	params    map[string]string
+	prefixEnd int // end of the part matched by the path prefix or template
+	end       int // end of the part replaced by a rewrite
+}
+
+// match checks the path and returns the captured parameters
+func (p *pathMatcher) match(path string) (pathMatch, bool) {
+	m := pathMatch{params: make(map[string]string)}
+
+	if p.segments == nil {
+		if !prefixMatches(path, p.prefix) {
+			return m, false
+		}
+		if p.prefix != "/" {
+			m.prefixEnd = len(strings.TrimSuffix(p.prefix, "/"))
+		}
+	} else {
+		parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+		if len(parts) < len(p.segments) {
+			return m, false
+		}
+		for i, segment := range p.segments {
+			if name := placeholderName(segment); name != "" {
+				if parts[i] == "" {
+					return m, false
+				}
+				m.params[name] = parts[i]
+			} else if parts[i] != segment {
+				return m, false
+			}
+			m.prefixEnd += 1 + len(parts[i])
+		}
+	}
+	m.end = m.prefixEnd
+
+	if p.regex != nil {
+		loc := p.regex.FindStringSubmatchIndex(path)
+		if loc == nil {
+			return m, false
+		}
+		for i, name := range p.regex.SubexpNames() {
+			if name != "" && loc[2*i] >= 0 {
+				m.params[name] = path[loc[2*i]:loc[2*i+1]]
+			}
+		}
+		// A regex matching less than the prefix must not duplicate it
+		if loc[1] > m.end {
+			m.end = loc[1]
+		}
+	}
+
+	return m, true
+}
+
+// apply rewrites the path and query of u for the upstream. The matched part of
+// the path is replaced by the rewrite template if one is configured, or
+// removed if strip is set.
+func (p *pathMatcher) apply(u *url.URL, strip bool) {
+	m, ok := p.match(u.Path)
+	if !ok {
+		return
+	}
+
+	switch {
+	case p.rewrite != "":
+		rewritten := expandPlaceholders(p.rewrite, m.params)
+		rest := u.Path[m.end:]
+		if strings.HasSuffix(rewritten, "/") && strings.HasPrefix(rest, "/") {
+			rest = rest[1:]
+		}
+		u.Path = rewritten + rest
+		u.RawPath = ""
+	case strip && m.prefixEnd > 0:
+		u.Path = u.Path[m.prefixEnd:]
+		u.RawPath = ""
+		if u.Path == "" {
+			u.Path = "/"
+		}
+	}
+
+	if len(p.query.Add) > 0 || len(p.query.Remove) > 0 {
+		query := u.Query()
+		for _, name := range p.query.Remove {
+			query.Del(name)
+		}
+		for name, value := range p.query.Add {
+			query.Set(name, expandPlaceholders(value, m.params))
+		}
+		u.RawQuery = query.Encode()
+	}
+}
+
+// placeholderName returns the parameter name of a {name} segment, or "" for
+// literal segments
+func placeholderName(segment string) string {
+	if match := config.PathPlaceholder.FindStringSubmatch(segment); match != nil && match[0] == segment {
+		return match[1]
+	}
+	return ""
+}
+
+// expandPlaceholders replaces {name} placeholders with parameter values
+func expandPlaceholders(template string, params map[string]string) string {
+	return config.PathPlaceholder.ReplaceAllStringFunc(template, func(placeholder string) string {
+		return params[placeholder[1:len(placeholder)-1]]
+	})
+}
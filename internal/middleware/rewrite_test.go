@@ -0,0 +1,144 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/ase-compas/compas-auth-proxy/internal/config"
+)
+
+func TestPathRewrite(t *testing.T) {
+	testCases := []struct {
+		name     string
+		route    config.UpstreamRoute
+		request  string
+		strip    bool
+		expected string // empty if the route must not match
+	}{
+		{
+			name:     "template rewrite",
+			route:    config.UpstreamRoute{Path: "/api/v1/scl/{type}/{id}", Rewrite: "/scl/v2/{type}/{id}"},
+			request:  "/api/v1/scl/SSD/42",
+			expected: "/scl/v2/SSD/42",
+		},
+		{
+			name:     "template keeps remaining path",
+			route:    config.UpstreamRoute{Path: "/api/v1/scl/{type}/{id}", Rewrite: "/scl/v2/{type}/{id}"},
+			request:  "/api/v1/scl/SSD/42/versions/1",
+			expected: "/scl/v2/SSD/42/versions/1",
+		},
+		{
+			name:    "template requires all segments",
+			route:   config.UpstreamRoute{Path: "/api/v1/scl/{type}/{id}", Rewrite: "/scl/v2/{type}/{id}"},
+			request: "/api/v1/scl/SSD",
+		},
+		{
+			name:     "template with strip path",
+			route:    config.UpstreamRoute{Path: "/tenants/{tenant}"},
+			request:  "/tenants/a/files",
+			strip:    true,
+			expected: "/files",
+		},
+		{
+			name:     "regex rewrite",
+			route:    config.UpstreamRoute{Path: "/api", PathRegex: `^/api/(?P<service>history|location)/(?P<id>\d+)`, Rewrite: "/{service}/items/{id}"},
+			request:  "/api/history/7/details",
+			expected: "/history/items/7/details",
+		},
+		{
+			name:     "regex matching less than the prefix",
+			route:    config.UpstreamRoute{Path: "/api", PathRegex: `^(?P<version>/v\d+)?`, Rewrite: "/svc"},
+			request:  "/api/items",
+			expected: "/svc/items",
+		},
+		{
+			name:    "regex must match",
+			route:   config.UpstreamRoute{Path: "/api", PathRegex: `^/api/(?P<service>history|location)/(?P<id>\d+)`},
+			request: "/api/history/latest",
+		},
+		{
+			name:     "prefix rewrite",
+			route:    config.UpstreamRoute{Path: "/legacy", Rewrite: "/v2"},
+			request:  "/legacy/files",
+			expected: "/v2/files",
+		},
+		{
+			name:     "legacy strip path",
+			route:    config.UpstreamRoute{Path: "/api/scl"},
+			request:  "/api/scl",
+			strip:    true,
+			expected: "/",
+		},
+		{
+			name: "query add and remove",
+			route: config.UpstreamRoute{
+				Path:  "/api/scl/{type}",
+				Query: config.QueryRewriteConfig{Add: map[string]string{"type": "{type}", "format": "json"}, Remove: []string{"debug"}},
+			},
+			request:  "/api/scl/ICD?debug=1&page=2",
+			expected: "/api/scl/ICD?format=json&page=2&type=ICD",
+		},
+	}
+
+	for _, tc := range testCases {
+		matcher, err := newPathMatcher(tc.route)
+		if err != nil {
+			t.Fatalf("%s: failed to create matcher: %v", tc.name, err)
+		}
+
+		u, _ := url.Parse(tc.request)
+		_, ok := matcher.match(u.Path)
+		if tc.expected == "" {
+			if ok {
+				t.Errorf("%s: expected %s not to match", tc.name, tc.request)
+			}
+			continue
+		}
+		if !ok {
+			t.Errorf("%s: expected %s to match", tc.name, tc.request)
+			continue
+		}
+
+		matcher.apply(u, tc.strip)
+		if got := u.RequestURI(); got != tc.expected {
+			t.Errorf("%s: expected %s, got %s", tc.name, tc.expected, got)
+		}
+	}
+}
+
+func TestProxyRewrite(t *testing.T) {
+	var received string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.URL.RequestURI()
+	}))
+	defer backend.Close()
+
+	middleware, err := NewMultiProxyMiddleware(&config.Config{
+		UpstreamRoutes: []config.UpstreamRoute{
+			{Path: "/api/v1/scl/{type}/{id}", UpstreamURL: backend.URL + "/base", Rewrite: "/scl/v2/{type}/{id}"},
+			{Path: "/api", UpstreamURL: backend.URL, StripPath: true},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+
+	testCases := []struct {
+		request  string
+		expected string
+	}{
+		{"/api/v1/scl/SSD/42?x=1", "/base/scl/v2/SSD/42?x=1"},
+		{"/api/v1/scl/SSD", "/v1/scl/SSD"},
+	}
+
+	for _, tc := range testCases {
+		received = ""
+		rec := httptest.NewRecorder()
+		middleware.Handler().ServeHTTP(rec, httptest.NewRequest("GET", tc.request, nil))
+		if received != tc.expected {
+			t.Errorf("Request %s: expected upstream request %s, got %s", tc.request, tc.expected, received)
+		}
+	}
+}
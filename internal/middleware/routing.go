@@ -0,0 +1,118 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/ase-compas/compas-auth-proxy/internal/config"
+)
+
+// matchesRequest checks the host, method, header and query predicates of a
+// route. The path is matched separately.
+func matchesRequest(match config.RouteMatchConfig, r *http.Request) bool {
+	if len(match.Hosts) > 0 && !hostMatches(match.Hosts, requestHost(r)) {
+		return false
+	}
+
+	if len(match.Methods) > 0 {
+		found := false
+		for _, method := range match.Methods {
+			if strings.EqualFold(method, r.Method) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	for name, expected := range match.Headers {
+		values, ok := r.Header[http.CanonicalHeaderKey(name)]
+		if !ok || !valueMatches(values, expected) {
+			return false
+		}
+	}
+
+	if len(match.Query) > 0 {
+		query := r.URL.Query()
+		for name, expected := range match.Query {
+			values, ok := query[name]
+			if !ok || !valueMatches(values, expected) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// valueMatches reports whether one of the values equals expected; "*" accepts
+// any value
+func valueMatches(values []string, expected string) bool {
+	if expected == "*" {
+		return true
+	}
+	for _, value := range values {
+		if value == expected {
+			return true
+		}
+	}
+	return false
+}
+
+// requestHost returns the lower-cased host name of the request without port
+func requestHost(r *http.Request) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// hostMatches reports whether host matches one of the patterns. A pattern of
+// the form *.example.com matches any subdomain of example.com.
+func hostMatches(patterns []string, host string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if strings.HasPrefix(pattern, "*.") {
+			if strings.HasSuffix(host, pattern[1:]) {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// matchSpecificity counts the predicates of a route, used to order routes
+// that are otherwise equal
+func matchSpecificity(match config.RouteMatchConfig) int {
+	specificity := len(match.Headers) + len(match.Query)
+	if len(match.Hosts) > 0 {
+		specificity++
+	}
+	if len(match.Methods) > 0 {
+		specificity++
+	}
+	return specificity
+}
+
+// sortRoutes orders routes for matching: higher priority first, then longer
+// path prefixes, then routes with more predicates. Routes that are equal in all
+// of these keep their configuration order.
+func (m *MultiProxyMiddleware) sortRoutes() {
+	sort.SliceStable(m.routes, func(i, j int) bool {
+		a, b := &m.routes[i], &m.routes[j]
+		if a.Priority != b.Priority {
+			return a.Priority > b.Priority
+		}
+		if len(a.PathPrefix) != len(b.PathPrefix) {
+			return len(a.PathPrefix) > len(b.PathPrefix)
+		}
+		return matchSpecificity(a.Match) > matchSpecificity(b.Match)
+	})
+}
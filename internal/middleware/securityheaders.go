@@ -0,0 +1,136 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/ase-compas/compas-auth-proxy/internal/config"
+)
+
+// maxCSPReportSize limits the size of accepted CSP violation reports
+const maxCSPReportSize = 64 * 1024
+
+// securityHeaderNames are all headers managed by security header policies
+var securityHeaderNames = []string{
+	"Strict-Transport-Security",
+	"Content-Security-Policy",
+	"Content-Security-Policy-Report-Only",
+	"X-Frame-Options",
+	"X-Content-Type-Options",
+	"Referrer-Policy",
+	"Permissions-Policy",
+	"Cross-Origin-Opener-Policy",
+	"Cross-Origin-Embedder-Policy",
+}
+
+// securityHeaders adds security headers to responses. Headers without a value
+// are removed; headers that are not configured are left untouched.
+type securityHeaders struct {
+	values map[string]string
+	hsts   string // Strict-Transport-Security, only sent on HTTPS requests
+}
+
+// newSecurityHeaders creates security headers from their configuration. A CSP
+// report path is added to the policy as report-uri.
+func newSecurityHeaders(cfg config.SecurityHeadersConfig, reportPath string) *securityHeaders {
+	s := &securityHeaders{values: make(map[string]string)}
+
+	set := func(name, value string) {
+		switch value {
+		case "":
+		case "-":
+			s.values[name] = ""
+		default:
+			s.values[name] = value
+		}
+	}
+
+	csp := cfg.ContentSecurityPolicy
+	if csp != "" && csp != "-" && reportPath != "" && !strings.Contains(csp, "report-uri") {
+		csp = strings.TrimSuffix(strings.TrimSpace(csp), ";") + "; report-uri " + reportPath
+	}
+	if cfg.CSPReportOnly != nil && *cfg.CSPReportOnly {
+		set("Content-Security-Policy-Report-Only", csp)
+	} else {
+		set("Content-Security-Policy", csp)
+	}
+	set("X-Frame-Options", cfg.FrameOptions)
+	set("X-Content-Type-Options", cfg.ContentTypeOptions)
+	set("Referrer-Policy", cfg.ReferrerPolicy)
+	set("Permissions-Policy", cfg.PermissionsPolicy)
+	set("Cross-Origin-Opener-Policy", cfg.CrossOriginOpenerPolicy)
+	set("Cross-Origin-Embedder-Policy", cfg.CrossOriginEmbedderPolicy)
+
+	if cfg.StrictTransportSecurity != "-" {
+		s.hsts = cfg.StrictTransportSecurity
+	}
+	return s
+}
+
+// apply sets the security headers of a response to the request
+func (s *securityHeaders) apply(header http.Header, r *http.Request, trustedProxies *TrustedProxies) {
+	for name, value := range s.values {
+		if value == "" {
+			header.Del(name)
+		} else {
+			header.Set(name, value)
+		}
+	}
+	if s.hsts != "" && trustedProxies.IsHTTPS(r) {
+		header.Set("Strict-Transport-Security", s.hsts)
+	}
+}
+
+// SecurityHeaders adds the global security headers to all responses. Proxied
+// responses use the security headers of their route instead.
+func (m *MultiProxyMiddleware) SecurityHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.securityHeaders.apply(w.Header(), r, m.trustedProxies)
+		next.ServeHTTP(w, r.WithContext(setGatewayHeaderInContext(r.Context(), w.Header())))
+	})
+}
+
+// applyToResponse replaces the global security headers set by the gateway
+// with these headers for a proxied response
+func (s *securityHeaders) applyToResponse(resp *http.Response, trustedProxies *TrustedProxies) {
+	if gatewayHeader := getGatewayHeaderFromContext(resp.Request.Context()); gatewayHeader != nil {
+		for _, name := range securityHeaderNames {
+			gatewayHeader.Del(name)
+		}
+	}
+	s.apply(resp.Header, resp.Request, trustedProxies)
+}
+
+// CSPReportHandler logs Content Security Policy violation reports sent by
+// browsers
+func (m *MultiProxyMiddleware) CSPReportHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxCSPReportSize+1))
+		if err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		if len(body) > maxCSPReportSize {
+			http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		var report bytes.Buffer
+		if err := json.Compact(&report, body); err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		log.Printf("CSP violation report from %s: %s", m.trustedProxies.ClientIP(r), report.String())
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
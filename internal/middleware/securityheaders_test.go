@@ -0,0 +1,134 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ase-compas/compas-auth-proxy/internal/config"
+)
+
+func TestSecurityHeaders(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Frame-Options", "ALLOW-FROM https://legacy.example.com")
+		w.Header().Set("Permissions-Policy", "camera=()")
+	}))
+	defer backend.Close()
+
+	reportOnly := true
+	cfg := &config.Config{
+		TrustedProxies: []string{"192.0.2.1"},
+		SecurityHeaders: config.SecurityHeadersConfig{
+			StrictTransportSecurity: "max-age=31536000",
+			ContentSecurityPolicy:   "default-src 'self'; frame-ancestors 'none'",
+			FrameOptions:            "DENY",
+			ContentTypeOptions:      "nosniff",
+			CrossOriginOpenerPolicy: "same-origin",
+		},
+		CSPReportPath: "/csp-report",
+		UpstreamRoutes: []config.UpstreamRoute{
+			{Path: "/api", UpstreamURL: backend.URL},
+			{
+				Path:        "/viewer",
+				UpstreamURL: backend.URL,
+				SecurityHeaders: config.SecurityHeadersConfig{
+					ContentSecurityPolicy: "default-src 'self' blob:",
+					CSPReportOnly:         &reportOnly,
+					FrameOptions:          "-",
+				},
+			},
+		},
+	}
+	middleware, err := NewMultiProxyMiddleware(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/csp-report", middleware.CSPReportHandler())
+	mux.Handle("/", middleware.Handler())
+	handler := middleware.SecurityHeaders(mux)
+
+	testCases := []struct {
+		name     string
+		method   string
+		path     string
+		body     string
+		https    bool
+		status   int
+		expected map[string][]string
+	}{
+		{
+			name:   "proxied response with global headers",
+			method: "GET",
+			path:   "/api/data",
+			https:  true,
+			status: http.StatusOK,
+			expected: map[string][]string{
+				"Strict-Transport-Security": {"max-age=31536000"},
+				"Content-Security-Policy":   {"default-src 'self'; frame-ancestors 'none'; report-uri /csp-report"},
+				"X-Frame-Options":           {"DENY"},
+				"X-Content-Type-Options":    {"nosniff"},
+				"Permissions-Policy":        {"camera=()"},
+			},
+		},
+		{
+			name:   "route overrides",
+			method: "GET",
+			path:   "/viewer/index.html",
+			status: http.StatusOK,
+			expected: map[string][]string{
+				"Strict-Transport-Security":           nil,
+				"Content-Security-Policy":             nil,
+				"Content-Security-Policy-Report-Only": {"default-src 'self' blob:; report-uri /csp-report"},
+				"X-Frame-Options":                     nil,
+				"Cross-Origin-Opener-Policy":          {"same-origin"},
+			},
+		},
+		{
+			name:   "gateway generated response",
+			method: "GET",
+			path:   "/unknown",
+			status: http.StatusNotFound,
+			expected: map[string][]string{
+				"X-Frame-Options":        {"DENY"},
+				"X-Content-Type-Options": {"nosniff"},
+			},
+		},
+		{
+			name:   "violation report",
+			method: "POST",
+			path:   "/csp-report",
+			body:   `{"csp-report": {"blocked-uri": "https://evil.example.com/x.js"}}`,
+			status: http.StatusNoContent,
+		},
+		{
+			name:   "malformed violation report",
+			method: "POST",
+			path:   "/csp-report",
+			body:   `not json`,
+			status: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testCases {
+		req := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+		if tc.https {
+			req.RemoteAddr = "192.0.2.1:50000"
+			req.Header.Set("X-Forwarded-Proto", "https")
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != tc.status {
+			t.Errorf("%s: expected status %d, got %d", tc.name, tc.status, rec.Code)
+		}
+		for name, expected := range tc.expected {
+			if got := rec.Header()[name]; !reflect.DeepEqual(got, expected) {
+				t.Errorf("%s: header %s: expected %v, got %v", tc.name, name, expected, got)
+			}
+		}
+	}
+}
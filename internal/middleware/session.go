@@ -1,15 +1,30 @@
 package middleware
 
 import (
+	"errors"
 	"fmt"
+	"sort"
 	"sync"
 	"time"
+
+	"github.com/ase-compas/compas-auth-proxy/internal/config"
 )
 
+// errSessionLimitReached is returned when a user already has the maximum number
+// of sessions and the limit strategy rejects new logins
+var errSessionLimitReached = errors.New("maximum number of concurrent sessions reached")
+
+// SessionEntry pairs a session ID with a snapshot of its data
+type SessionEntry struct {
+	ID   string
+	Data SessionData
+}
+
 // MemorySessionStore implements SessionStore interface using in-memory storage
 type MemorySessionStore struct {
 	mu       sync.RWMutex
 	sessions map[string]*SessionData
+	byUser   map[string]map[string]struct{} // sub -> set of session IDs
 	cleanup  *time.Ticker
 	done     chan bool
 }
@@ -18,6 +33,7 @@ type MemorySessionStore struct {
 func NewMemorySessionStore() *MemorySessionStore {
 	store := &MemorySessionStore{
 		sessions: make(map[string]*SessionData),
+		byUser:   make(map[string]map[string]struct{}),
 		cleanup:  time.NewTicker(5 * time.Minute), // Cleanup every 5 minutes
 		done:     make(chan bool),
 	}
@@ -44,7 +60,7 @@ func (s *MemorySessionStore) Get(sessionID string) (*SessionData, error) {
 		go func() {
 			s.mu.Lock()
 			defer s.mu.Unlock()
-			delete(s.sessions, sessionID)
+			s.deleteLocked(sessionID)
 		}()
 		return nil, fmt.Errorf("session expired")
 	}
@@ -57,19 +73,121 @@ func (s *MemorySessionStore) Set(sessionID string, data *SessionData) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	s.sessions[sessionID] = data
+	s.setLocked(sessionID, data)
 	return nil
 }
 
+// SetWithLimit stores a new session unless its user already has limit active
+// sessions. Depending on the strategy the oldest sessions are evicted to make
+// room, or the session is rejected with errSessionLimitReached. Counting,
+// eviction and insertion happen atomically. The evicted sessions are returned.
+func (s *MemorySessionStore) SetWithLimit(sessionID string, data *SessionData, limit int, strategy string) ([]SessionEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sub := sessionSubject(data)
+	if limit <= 0 || sub == "" {
+		s.setLocked(sessionID, data)
+		return nil, nil
+	}
+
+	sessions := s.userSessionsLocked(sub, time.Now())
+	if len(sessions) < limit {
+		s.setLocked(sessionID, data)
+		return nil, nil
+	}
+	if strategy == config.SessionLimitReject {
+		return nil, errSessionLimitReached
+	}
+
+	// Sessions are ordered oldest first
+	evicted := sessions[:len(sessions)-limit+1]
+	for _, session := range evicted {
+		s.deleteLocked(session.ID)
+	}
+	s.setLocked(sessionID, data)
+	return evicted, nil
+}
+
 // Delete removes session data by session ID
 func (s *MemorySessionStore) Delete(sessionID string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	delete(s.sessions, sessionID)
+	s.deleteLocked(sessionID)
 	return nil
 }
 
+// Rotate atomically moves a session to a new ID with the given data. The old
+// ID is invalid once Rotate returns.
+func (s *MemorySessionStore) Rotate(oldID, newID string, data *SessionData) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, exists := s.sessions[oldID]
+	if !exists || session.ExpiresAt.Before(time.Now()) {
+		return fmt.Errorf("session not found")
+	}
+	if _, taken := s.sessions[newID]; taken {
+		return fmt.Errorf("session ID already in use")
+	}
+
+	s.deleteLocked(oldID)
+	s.setLocked(newID, data)
+	return nil
+}
+
+// Touch records activity on a session
+func (s *MemorySessionStore) Touch(sessionID string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, exists := s.sessions[sessionID]
+	if !exists {
+		return fmt.Errorf("session not found")
+	}
+	session.LastSeen = at
+	return nil
+}
+
+// List returns all active sessions ordered by creation time
+func (s *MemorySessionStore) List() ([]SessionEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := time.Now()
+	entries := make([]SessionEntry, 0, len(s.sessions))
+	for sessionID, session := range s.sessions {
+		if session.ExpiresAt.Before(now) {
+			continue
+		}
+		entries = append(entries, SessionEntry{ID: sessionID, Data: *session})
+	}
+	sortSessionEntries(entries)
+	return entries, nil
+}
+
+// ListByUser returns the active sessions of a user ordered by creation time
+func (s *MemorySessionStore) ListByUser(sub string) ([]SessionEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.userSessionsLocked(sub, time.Now()), nil
+}
+
+// DeleteByUser removes all sessions of a user and returns how many were removed
+func (s *MemorySessionStore) DeleteByUser(sub string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count := 0
+	for sessionID := range s.byUser[sub] {
+		s.deleteLocked(sessionID)
+		count++
+	}
+	return count, nil
+}
+
 // Close stops the cleanup goroutine
 func (s *MemorySessionStore) Close() {
 	s.cleanup.Stop()
@@ -85,7 +203,7 @@ func (s *MemorySessionStore) cleanupExpiredSessions() {
 			now := time.Now()
 			for sessionID, session := range s.sessions {
 				if session.ExpiresAt.Before(now) {
-					delete(s.sessions, sessionID)
+					s.deleteLocked(sessionID)
 				}
 			}
 			s.mu.Unlock()
@@ -95,9 +213,69 @@ func (s *MemorySessionStore) cleanupExpiredSessions() {
 	}
 }
 
+// userSessionsLocked returns the active sessions of a user ordered by creation
+// time; the caller must hold the lock
+func (s *MemorySessionStore) userSessionsLocked(sub string, now time.Time) []SessionEntry {
+	entries := make([]SessionEntry, 0, len(s.byUser[sub]))
+	for sessionID := range s.byUser[sub] {
+		session := s.sessions[sessionID]
+		if session == nil || session.ExpiresAt.Before(now) {
+			continue
+		}
+		entries = append(entries, SessionEntry{ID: sessionID, Data: *session})
+	}
+	sortSessionEntries(entries)
+	return entries
+}
+
+// setLocked stores a session and indexes it by subject; the caller must hold the write lock
+func (s *MemorySessionStore) setLocked(sessionID string, data *SessionData) {
+	// Drop a stale index entry if the session changes owner
+	s.deleteLocked(sessionID)
+
+	s.sessions[sessionID] = data
+	if sub := sessionSubject(data); sub != "" {
+		if s.byUser[sub] == nil {
+			s.byUser[sub] = make(map[string]struct{})
+		}
+		s.byUser[sub][sessionID] = struct{}{}
+	}
+}
+
+// deleteLocked removes a session and its index entry; the caller must hold the write lock
+func (s *MemorySessionStore) deleteLocked(sessionID string) {
+	session, exists := s.sessions[sessionID]
+	if !exists {
+		return
+	}
+	delete(s.sessions, sessionID)
+
+	if sub := sessionSubject(session); sub != "" {
+		delete(s.byUser[sub], sessionID)
+		if len(s.byUser[sub]) == 0 {
+			delete(s.byUser, sub)
+		}
+	}
+}
+
 // Size returns the number of active sessions
 func (s *MemorySessionStore) Size() int {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	return len(s.sessions)
 }
+
+// sessionSubject returns the subject a session belongs to
+func sessionSubject(data *SessionData) string {
+	if data == nil || data.UserInfo == nil {
+		return ""
+	}
+	return data.UserInfo.Sub
+}
+
+// sortSessionEntries orders sessions from oldest to newest
+func sortSessionEntries(entries []SessionEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Data.CreatedAt.Before(entries[j].Data.CreatedAt)
+	})
+}
@@ -0,0 +1,353 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ase-compas/compas-auth-proxy/internal/config"
+)
+
+func newTestSession(sub string, createdAt time.Time) *SessionData {
+	return &SessionData{
+		UserInfo:  &UserInfo{Sub: sub},
+		CreatedAt: createdAt,
+		LastSeen:  createdAt,
+		ExpiresAt: createdAt.Add(time.Hour),
+	}
+}
+
+func TestMemorySessionStoreUserIndex(t *testing.T) {
+	store := NewMemorySessionStore()
+	defer store.Close()
+
+	now := time.Now()
+	store.Set("alice-2", newTestSession("alice", now.Add(-time.Minute)))
+	store.Set("alice-1", newTestSession("alice", now.Add(-2*time.Minute)))
+	store.Set("bob-1", newTestSession("bob", now))
+
+	entries, err := store.ListByUser("alice")
+	if err != nil {
+		t.Fatalf("ListByUser failed: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 sessions for alice, got %d", len(entries))
+	}
+	if entries[0].ID != "alice-1" || entries[1].ID != "alice-2" {
+		t.Errorf("Expected sessions ordered oldest first, got %s, %s", entries[0].ID, entries[1].ID)
+	}
+
+	// Reassigning a session to another user must update the index
+	store.Set("alice-2", newTestSession("bob", now))
+	if entries, _ := store.ListByUser("bob"); len(entries) != 2 {
+		t.Errorf("Expected 2 sessions for bob after reassignment, got %d", len(entries))
+	}
+
+	count, err := store.DeleteByUser("bob")
+	if err != nil {
+		t.Fatalf("DeleteByUser failed: %v", err)
+	}
+	if count != 2 {
+		t.Errorf("Expected 2 sessions revoked, got %d", count)
+	}
+	if store.Size() != 1 {
+		t.Errorf("Expected 1 remaining session, got %d", store.Size())
+	}
+	if _, err := store.Get("bob-1"); err == nil {
+		t.Error("Expected revoked session to be gone")
+	}
+}
+
+func TestMemorySessionStoreTouch(t *testing.T) {
+	store := NewMemorySessionStore()
+	defer store.Close()
+
+	created := time.Now().Add(-time.Minute)
+	store.Set("session", newTestSession("alice", created))
+
+	seen := time.Now()
+	if err := store.Touch("session", seen); err != nil {
+		t.Fatalf("Touch failed: %v", err)
+	}
+
+	entries, _ := store.List()
+	if len(entries) != 1 || !entries[0].Data.LastSeen.Equal(seen) {
+		t.Errorf("Expected last seen to be updated")
+	}
+
+	if err := store.Touch("missing", seen); err == nil {
+		t.Error("Expected Touch on unknown session to fail")
+	}
+}
+
+func TestMemorySessionStoreRotate(t *testing.T) {
+	store := NewMemorySessionStore()
+	defer store.Close()
+
+	store.Set("old", newTestSession("alice", time.Now()))
+
+	refreshed := newTestSession("alice", time.Now())
+	refreshed.AccessToken = "refreshed"
+	if err := store.Rotate("old", "new", refreshed); err != nil {
+		t.Fatalf("Rotate failed: %v", err)
+	}
+	if _, err := store.Get("old"); err == nil {
+		t.Error("Expected old session ID to be invalid after rotation")
+	}
+	if session, err := store.Get("new"); err != nil || session.AccessToken != "refreshed" {
+		t.Errorf("Expected new session ID to hold the refreshed session, got %v", err)
+	}
+	if entries, _ := store.ListByUser("alice"); len(entries) != 1 || entries[0].ID != "new" {
+		t.Errorf("Expected user index to reference the rotated session")
+	}
+
+	if err := store.Rotate("old", "newer", refreshed); err == nil {
+		t.Error("Expected rotating an unknown session to fail")
+	}
+}
+
+func TestSessionLimitStrategies(t *testing.T) {
+	store := NewMemorySessionStore()
+	defer store.Close()
+
+	now := time.Now()
+	store.Set("oldest", newTestSession("alice", now.Add(-2*time.Minute)))
+	store.Set("newer", newTestSession("alice", now.Add(-time.Minute)))
+
+	if _, err := store.SetWithLimit("rejected", newTestSession("alice", now), 2, config.SessionLimitReject); err != errSessionLimitReached {
+		t.Errorf("Expected login to be rejected when the limit is reached, got %v", err)
+	}
+	if _, err := store.Get("rejected"); err == nil {
+		t.Error("Expected rejected session not to be stored")
+	}
+	if _, err := store.SetWithLimit("bob", newTestSession("bob", now), 2, config.SessionLimitReject); err != nil {
+		t.Errorf("Expected login of other user to pass, got %v", err)
+	}
+
+	evicted, err := store.SetWithLimit("newest", newTestSession("alice", now), 2, config.SessionLimitEvictOldest)
+	if err != nil {
+		t.Fatalf("Expected oldest session to be evicted, got %v", err)
+	}
+	if len(evicted) != 1 || evicted[0].ID != "oldest" {
+		t.Errorf("Expected the oldest session to be reported as evicted, got %v", evicted)
+	}
+	if _, err := store.Get("oldest"); err == nil {
+		t.Error("Expected oldest session to be evicted")
+	}
+	for _, id := range []string{"newer", "newest"} {
+		if _, err := store.Get(id); err != nil {
+			t.Errorf("Expected session %s to be kept", id)
+		}
+	}
+
+	// Without a limit every session is stored
+	if _, err := store.SetWithLimit("unlimited", newTestSession("alice", now), 0, config.SessionLimitReject); err != nil {
+		t.Errorf("Expected session without limit to be stored, got %v", err)
+	}
+}
+
+func TestSessionLimitConcurrentLogins(t *testing.T) {
+	for _, strategy := range []string{config.SessionLimitReject, config.SessionLimitEvictOldest} {
+		store := NewMemorySessionStore()
+
+		var wg sync.WaitGroup
+		now := time.Now()
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				store.SetWithLimit(fmt.Sprintf("session-%d", i), newTestSession("alice", now.Add(time.Duration(i))), 3, strategy)
+			}(i)
+		}
+		wg.Wait()
+
+		if entries, _ := store.ListByUser("alice"); len(entries) != 3 {
+			t.Errorf("%s: expected the limit of 3 sessions to hold, got %d", strategy, len(entries))
+		}
+		store.Close()
+	}
+}
+
+func TestSessionCookieAttributes(t *testing.T) {
+	trusted, _ := NewTrustedProxies([]string{"10.0.0.0/8"})
+	m := &OIDCMiddleware{
+		config: &config.Config{
+			SessionCookieName:     "compas-session",
+			SessionCookiePrefix:   config.CookiePrefixHost,
+			SessionCookieSecure:   config.CookieSecureAuto,
+			SessionCookieSameSite: config.CookieSameSiteStrict,
+			SessionCookiePath:     "/",
+		},
+		trustedProxies: trusted,
+	}
+
+	// Behind a trusted TLS-terminating proxy the cookie is secure
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.5:4321"
+	req.Header.Set("X-Forwarded-Proto", "https")
+
+	cookie := m.newSessionCookie(req, "value", 3600)
+	if cookie.Name != "__Host-compas-session" {
+		t.Errorf("Expected prefixed cookie name, got %s", cookie.Name)
+	}
+	if !cookie.Secure {
+		t.Error("Expected cookie to be secure behind trusted HTTPS proxy")
+	}
+	if cookie.SameSite != http.SameSiteStrictMode {
+		t.Errorf("Expected SameSite=Strict, got %v", cookie.SameSite)
+	}
+
+	// The same header from an untrusted client is ignored
+	req.RemoteAddr = "203.0.113.7:4321"
+	if m.newSessionCookie(req, "value", 3600).Secure {
+		t.Error("Expected X-Forwarded-Proto from untrusted client to be ignored")
+	}
+}
+
+func TestSessionBinding(t *testing.T) {
+	ignoreAddress := 0
+	testCases := []struct {
+		name       string
+		mode       string
+		ipv4Prefix *int
+		remoteAddr string
+		userAgent  string
+		status     int
+		kept       bool
+	}{
+		{"same network", config.SessionBindingReject, nil, "198.51.100.20:1234", "Browser/1", http.StatusOK, true},
+		{"reject other network", config.SessionBindingReject, nil, "203.0.113.7:1234", "Browser/1", http.StatusUnauthorized, true},
+		{"reject other user agent", config.SessionBindingReject, nil, "198.51.100.1:1234", "Browser/2", http.StatusUnauthorized, true},
+		{"reauthenticate other network", config.SessionBindingReauthenticate, nil, "203.0.113.7:1234", "Browser/1", http.StatusFound, false},
+		{"reauthenticate other user agent", config.SessionBindingReauthenticate, nil, "198.51.100.1:1234", "Browser/2", http.StatusFound, false},
+		{"address ignored", config.SessionBindingReject, &ignoreAddress, "203.0.113.7:1234", "Browser/1", http.StatusOK, true},
+		{"address ignored, user agent checked", config.SessionBindingReject, &ignoreAddress, "203.0.113.7:1234", "Browser/2", http.StatusUnauthorized, true},
+	}
+
+	for _, tc := range testCases {
+		store := NewMemorySessionStore()
+		session := newTestSession("alice", time.Now())
+		session.IPAddress = "198.51.100.1"
+		session.UserAgent = "Browser/1"
+		store.Set("session", session)
+
+		trusted, _ := NewTrustedProxies(nil)
+		m := &OIDCMiddleware{
+			config: &config.Config{
+				SessionCookieName:            "compas-session",
+				SessionBindingEnabled:        true,
+				SessionBindingMode:           tc.mode,
+				SessionBindingIPv4Prefix:     tc.ipv4Prefix,
+				SessionBindingCheckUserAgent: true,
+			},
+			providerConfig: &ProviderConfig{AuthorizationEndpoint: "http://idp/auth"},
+			sessionStore:   store,
+			trustedProxies: trusted,
+		}
+		handler := m.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+
+		req := httptest.NewRequest("GET", "/app", nil)
+		req.RemoteAddr = tc.remoteAddr
+		req.Header.Set("User-Agent", tc.userAgent)
+		req.AddCookie(&http.Cookie{Name: "compas-session", Value: "session"})
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != tc.status {
+			t.Errorf("%s: expected status %d, got %d", tc.name, tc.status, rec.Code)
+		}
+		if tc.status == http.StatusFound && !strings.HasPrefix(rec.Header().Get("Location"), "http://idp/auth") {
+			t.Errorf("%s: expected redirect to login, got %q", tc.name, rec.Header().Get("Location"))
+		}
+		if _, err := store.Get("session"); (err == nil) != tc.kept {
+			t.Errorf("%s: expected session kept=%v, got error %v", tc.name, tc.kept, err)
+		}
+		store.Close()
+	}
+}
+
+func TestSessionRotationOnReauthentication(t *testing.T) {
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/token":
+			w.Write([]byte(`{"access_token":"new-access-token","id_token":"new-id-token"}`))
+		case "/userinfo":
+			w.Write([]byte(`{"sub":"alice","realm_access":{"roles":["admin"]}}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer idp.Close()
+
+	store := NewMemorySessionStore()
+	defer store.Close()
+	store.Set("old-session", newTestSession("alice", time.Now()))
+
+	trusted, _ := NewTrustedProxies(nil)
+	m := &OIDCMiddleware{
+		config: &config.Config{
+			SessionCookieName: "compas-session",
+			SessionMaxAge:     3600,
+			OIDCRolesClaim:    "realm_access.roles",
+		},
+		httpClient: idp.Client(),
+		providerConfig: &ProviderConfig{
+			AuthorizationEndpoint: idp.URL + "/auth",
+			TokenEndpoint:         idp.URL + "/token",
+			UserInfoEndpoint:      idp.URL + "/userinfo",
+		},
+		sessionStore:   store,
+		trustedProxies: trusted,
+	}
+
+	// Re-authenticating with an existing session rotates its ID
+	req := httptest.NewRequest("GET", "/oidc/callback?state=state&code=code", nil)
+	req.AddCookie(&http.Cookie{Name: "compas-session", Value: "old-session"})
+	rec := httptest.NewRecorder()
+	m.HandleCallback(rec, req)
+	if rec.Code != http.StatusFound {
+		t.Fatalf("Expected redirect after login, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var newID string
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == "compas-session" {
+			newID = cookie.Value
+		}
+	}
+	if newID == "" || newID == "old-session" {
+		t.Fatalf("Expected a new session ID, got %q", newID)
+	}
+	if entries, _ := store.ListByUser("alice"); len(entries) != 1 {
+		t.Errorf("Expected the session to be replaced, got %d sessions", len(entries))
+	}
+
+	handler := m.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if roles := GetUserFromContext(r.Context()).Roles; len(roles) != 1 || roles[0] != "admin" {
+			t.Errorf("Expected refreshed roles, got %v", roles)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	send := func(sessionID string) int {
+		req := httptest.NewRequest("GET", "/app", nil)
+		req.AddCookie(&http.Cookie{Name: "compas-session", Value: sessionID})
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// The old cookie no longer authenticates, the new one does
+	if status := send("old-session"); status != http.StatusFound {
+		t.Errorf("Expected old session cookie to require login, got %d", status)
+	}
+	if status := send(newID); status != http.StatusOK {
+		t.Errorf("Expected new session cookie to be accepted, got %d", status)
+	}
+}
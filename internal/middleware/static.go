@@ -0,0 +1,317 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/ase-compas/compas-auth-proxy/internal/config"
+	"github.com/ase-compas/compas-auth-proxy/web"
+)
+
+// immutableCacheControl is sent for files whose name changes with their content
+const immutableCacheControl = "public, max-age=31536000, immutable"
+
+// defaultHashedAssets matches file names with a hex content hash as produced
+// by common frontend bundlers, e.g. main.3f2a1b4c5d6e7f80.js. The hash must
+// also contain a letter so that dates and numbered files such as
+// report-20240101.pdf are not taken for hashes.
+var defaultHashedAssets = regexp.MustCompile(`[.-]([0-9a-f]{8,})\.[^/]+$`)
+
+// precompressedCodings are the codings of precompressed files in order of
+// preference, and precompressedSuffixes the suffixes of their file names
+var (
+	precompressedCodings  = []string{config.CompressionBrotli, config.CompressionZstd, config.CompressionGzip}
+	precompressedSuffixes = map[string]string{
+		config.CompressionBrotli: ".br",
+		config.CompressionZstd:   ".zst",
+		config.CompressionGzip:   ".gz",
+	}
+)
+
+// staticContentTypes complements the media types known to the mime package,
+// which depend on the system the gateway runs on
+var staticContentTypes = map[string]string{
+	".css":         "text/css; charset=utf-8",
+	".html":        "text/html; charset=utf-8",
+	".ico":         "image/x-icon",
+	".js":          "text/javascript; charset=utf-8",
+	".json":        "application/json",
+	".map":         "application/json",
+	".mjs":         "text/javascript; charset=utf-8",
+	".otf":         "font/otf",
+	".svg":         "image/svg+xml",
+	".ttf":         "font/ttf",
+	".wasm":        "application/wasm",
+	".webmanifest": "application/manifest+json",
+	".woff":        "font/woff",
+	".woff2":       "font/woff2",
+	".xml":         "application/xml",
+	".xsd":         "application/xml",
+	// SCL files (IEC 61850-6)
+	".scd": "application/xml",
+	".icd": "application/xml",
+	".cid": "application/xml",
+	".iid": "application/xml",
+	".ssd": "application/xml",
+	".sed": "application/xml",
+}
+
+// embeddedBundle returns the frontend bundle embedded in the binary
+var embeddedBundle = web.Bundle
+
+// staticFiles serves the files of a static route
+type staticFiles struct {
+	files        fs.FS
+	source       string // Directory or bundle served, for logging
+	index        string
+	spa          bool
+	hashedAssets *regexp.Regexp // nil for the default pattern
+	cacheControl string
+	etags        sync.Map // ETags of files without modification time by name; such files never change
+}
+
+// newStaticFiles creates the file server of a static route
+func newStaticFiles(cfg config.StaticConfig) (*staticFiles, error) {
+	s := &staticFiles{
+		index:        cfg.Index,
+		spa:          cfg.SPA,
+		cacheControl: cfg.CacheControl,
+	}
+	if cfg.Embedded {
+		s.files = embeddedBundle()
+		s.source = "embedded bundle"
+	} else {
+		info, err := os.Stat(cfg.Dir)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			return nil, fmt.Errorf("%s is not a directory", cfg.Dir)
+		}
+		s.files = os.DirFS(cfg.Dir)
+		s.source = cfg.Dir
+	}
+
+	if s.index == "" {
+		s.index = "index.html"
+	}
+	if s.cacheControl == "" {
+		s.cacheControl = "no-cache"
+	}
+	if cfg.HashedAssets != "" {
+		re, err := regexp.Compile(cfg.HashedAssets)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hashed_assets: %v", err)
+		}
+		s.hashedAssets = re
+	}
+	if s.spa {
+		if _, err := fs.Stat(s.files, s.index); err != nil {
+			return nil, fmt.Errorf("index file %s not found in %s", s.index, s.source)
+		}
+	}
+	return s, nil
+}
+
+// newStaticRoute creates a route serving static files instead of proxying to
+// an upstream
+func newStaticRoute(cfg *config.Config, routeConfig config.UpstreamRoute) (ProxyRoute, error) {
+	paths, err := newPathMatcher(routeConfig)
+	if err != nil {
+		return ProxyRoute{}, fmt.Errorf("invalid path of route %s: %v", routeConfig.Path, err)
+	}
+	static, err := newStaticFiles(routeConfig.Static)
+	if err != nil {
+		return ProxyRoute{}, fmt.Errorf("invalid static route %s: %v", routeConfig.Path, err)
+	}
+	return ProxyRoute{
+		PathPrefix:      routeConfig.Path,
+		StripPath:       true,
+		Match:           routeConfig.Match,
+		Priority:        routeConfig.Priority,
+		Public:          routeConfig.Public,
+		paths:           paths,
+		cors:            newCORSPolicy(cfg.CORSFor(routeConfig)),
+		rateLimit:       newRateLimitPolicy(routeConfig.Path, cfg.RateLimitFor(routeConfig)),
+		securityHeaders: newSecurityHeaders(cfg.SecurityHeadersFor(routeConfig), cfg.CSPReportPath),
+		static:          static,
+	}, nil
+}
+
+// serveStatic answers a request to a static route
+func (m *MultiProxyMiddleware) serveStatic(w http.ResponseWriter, r *http.Request, route *ProxyRoute) {
+	// The security headers of the route replace the global ones
+	for _, name := range securityHeaderNames {
+		w.Header().Del(name)
+	}
+	route.securityHeaders.apply(w.Header(), r, m.trustedProxies)
+
+	// Files are looked up relative to the route path or its rewrite
+	u := *r.URL
+	route.paths.apply(&u, true)
+	route.static.serve(w, r, u.Path)
+}
+
+// serve writes the file for the URL path. Unknown paths without a file
+// extension get the index in SPA mode so client-side routes can be reloaded.
+func (s *staticFiles) serve(w http.ResponseWriter, r *http.Request, urlPath string) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name, ok := s.resolve(urlPath)
+	if !ok {
+		if !s.spa || path.Ext(urlPath) != "" {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+		name = s.index
+	}
+	s.serveFile(w, r, name)
+}
+
+// resolve maps a URL path to the name of a file, using the index file for
+// directories. Hidden files are never served.
+func (s *staticFiles) resolve(urlPath string) (string, bool) {
+	name := strings.TrimPrefix(path.Clean("/"+urlPath), "/")
+	if name == "" {
+		name = "."
+	}
+	for _, segment := range strings.Split(name, "/") {
+		if strings.HasPrefix(segment, ".") && segment != "." {
+			return "", false
+		}
+	}
+
+	info, err := fs.Stat(s.files, name)
+	if err != nil {
+		return "", false
+	}
+	if info.IsDir() {
+		name = path.Join(name, s.index)
+		if info, err = fs.Stat(s.files, name); err != nil || info.IsDir() {
+			return "", false
+		}
+	}
+	return name, true
+}
+
+// serveFile writes a file, or its precompressed variant if the client
+// accepts it
+func (s *staticFiles) serveFile(w http.ResponseWriter, r *http.Request, name string) {
+	header := w.Header()
+	if contentType := contentTypeFor(name); contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	if s.hashedAsset(path.Base(name)) {
+		header.Set("Cache-Control", immutableCacheControl)
+	} else {
+		header.Set("Cache-Control", s.cacheControl)
+	}
+
+	served := name
+	if coding := s.precompressed(name, r.Header.Get("Accept-Encoding")); coding != "" {
+		served = name + precompressedSuffixes[coding]
+		header.Set("Content-Encoding", coding)
+	}
+	header.Add("Vary", "Accept-Encoding")
+
+	file, err := s.files.Open(served)
+	if err != nil {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	content, ok := file.(io.ReadSeeker)
+	if !ok {
+		data, err := io.ReadAll(file)
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		content = bytes.NewReader(data)
+	}
+
+	// Embedded files have no modification time to validate against
+	if info.ModTime().IsZero() {
+		etag, err := s.etag(served, content)
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		header.Set("ETag", etag)
+	}
+	http.ServeContent(w, r, name, info.ModTime(), content)
+}
+
+// hashedAsset reports whether the file name contains a content hash, so the
+// file never changes under that name
+func (s *staticFiles) hashedAsset(name string) bool {
+	if s.hashedAssets != nil {
+		return s.hashedAssets.MatchString(name)
+	}
+	match := defaultHashedAssets.FindStringSubmatch(name)
+	return match != nil && strings.ContainsAny(match[1], "abcdef")
+}
+
+// precompressed returns the coding of the preferred precompressed variant of
+// the file accepted by the client, or "" to serve the file itself
+func (s *staticFiles) precompressed(name, acceptEncoding string) string {
+	if acceptEncoding == "" {
+		return ""
+	}
+	var available []string
+	for _, coding := range precompressedCodings {
+		if info, err := fs.Stat(s.files, name+precompressedSuffixes[coding]); err == nil && !info.IsDir() {
+			available = append(available, coding)
+		}
+	}
+	if len(available) == 0 {
+		return ""
+	}
+	return negotiateEncoding(acceptEncoding, available)
+}
+
+// etag returns the entity tag of a file derived from its content
+func (s *staticFiles) etag(name string, content io.ReadSeeker) (string, error) {
+	if etag, ok := s.etags.Load(name); ok {
+		return etag.(string), nil
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(hash, content); err != nil {
+		return "", err
+	}
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	etag := `"` + hex.EncodeToString(hash.Sum(nil)[:16]) + `"`
+	s.etags.Store(name, etag)
+	return etag, nil
+}
+
+// contentTypeFor returns the media type of a file by its extension
+func contentTypeFor(name string) string {
+	ext := strings.ToLower(path.Ext(name))
+	if contentType, ok := staticContentTypes[ext]; ok {
+		return contentType
+	}
+	return mime.TypeByExtension(ext)
+}
@@ -0,0 +1,218 @@
+package middleware
+
+import (
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/ase-compas/compas-auth-proxy/internal/config"
+)
+
+func TestStaticRoute(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"index.html":                   "<app-root></app-root>",
+		"main.3f2a1b4c5d6e7f80.js":     "console.log('app')",
+		"main.3f2a1b4c5d6e7f80.js.br":  "brotli",
+		"main.3f2a1b4c5d6e7f80.js.gz":  "gzip",
+		"styles.css":                   "body {}",
+		"report-20240101.pdf":          "report",
+		"assets/logo.svg":              "<svg/>",
+		"assets/fonts/roboto.woff2":    "font",
+		"docs/index.html":              "<h1>Docs</h1>",
+		".env":                         "SECRET=1",
+		"schemas/SCL.2007B4.xsd":       "<xs:schema/>",
+		"schemas/example.scd":          "<SCL/>",
+		"schemas/example.scd.gz":       "gzip scd",
+		"schemas/unknown.ext":          "data",
+		"schemas/nested/.hidden/a.txt": "hidden",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream"))
+	}))
+	defer backend.Close()
+
+	middleware, err := NewMultiProxyMiddleware(&config.Config{
+		UpstreamRoutes: []config.UpstreamRoute{
+			{Path: "/api", UpstreamURL: backend.URL},
+			{Path: "/files", Static: config.StaticConfig{Dir: dir + "/schemas", CacheControl: "max-age=300"}},
+			{Path: "/", Static: config.StaticConfig{Dir: dir, SPA: true}, SecurityHeaders: config.SecurityHeadersConfig{ContentSecurityPolicy: "default-src 'self'"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+
+	testCases := []struct {
+		name           string
+		method         string
+		path           string
+		acceptEncoding string
+		status         int
+		body           string
+		contentType    string
+		encoding       string
+		cacheControl   string
+	}{
+		{"index", "GET", "/", "", http.StatusOK, "<app-root></app-root>", "text/html; charset=utf-8", "", "no-cache"},
+		{"client-side route", "GET", "/projects/42/edit", "", http.StatusOK, "<app-root></app-root>", "text/html; charset=utf-8", "", "no-cache"},
+		{"hashed asset brotli", "GET", "/main.3f2a1b4c5d6e7f80.js", "gzip, br", http.StatusOK, "brotli", "text/javascript; charset=utf-8", "br", immutableCacheControl},
+		{"hashed asset gzip", "GET", "/main.3f2a1b4c5d6e7f80.js", "gzip", http.StatusOK, "gzip", "text/javascript; charset=utf-8", "gzip", immutableCacheControl},
+		{"hashed asset uncompressed", "GET", "/main.3f2a1b4c5d6e7f80.js", "", http.StatusOK, "console.log('app')", "text/javascript; charset=utf-8", "", immutableCacheControl},
+		{"brotli not accepted", "GET", "/main.3f2a1b4c5d6e7f80.js", "br;q=0, identity", http.StatusOK, "console.log('app')", "text/javascript; charset=utf-8", "", immutableCacheControl},
+		{"asset without hash", "GET", "/styles.css", "br", http.StatusOK, "body {}", "text/css; charset=utf-8", "", "no-cache"},
+		{"date stamped file", "GET", "/report-20240101.pdf", "", http.StatusOK, "report", "application/pdf", "", "no-cache"},
+		{"nested asset", "GET", "/assets/logo.svg", "", http.StatusOK, "<svg/>", "image/svg+xml", "", "no-cache"},
+		{"font", "GET", "/assets/fonts/roboto.woff2", "", http.StatusOK, "font", "font/woff2", "", "no-cache"},
+		{"directory index", "GET", "/docs/", "", http.StatusOK, "<h1>Docs</h1>", "text/html; charset=utf-8", "", "no-cache"},
+		{"missing asset", "GET", "/assets/missing.js", "", http.StatusNotFound, "Not Found", "", "", ""},
+		{"hidden file", "GET", "/.env", "", http.StatusNotFound, "Not Found", "", "", ""},
+		{"path traversal", "GET", "/../../etc/passwd", "", http.StatusOK, "<app-root></app-root>", "text/html; charset=utf-8", "", "no-cache"},
+		{"HEAD", "HEAD", "/styles.css", "", http.StatusOK, "", "text/css; charset=utf-8", "", "no-cache"},
+		{"POST", "POST", "/styles.css", "", http.StatusMethodNotAllowed, "Method Not Allowed", "", "", ""},
+		{"upstream route", "GET", "/api/data", "", http.StatusOK, "upstream", "", "", ""},
+		{"route prefix stripped", "GET", "/files/SCL.2007B4.xsd", "", http.StatusOK, "<xs:schema/>", "application/xml", "", "max-age=300"},
+		{"SCL file", "GET", "/files/example.scd", "gzip", http.StatusOK, "gzip scd", "application/xml", "gzip", "max-age=300"},
+		{"unknown extension", "GET", "/files/unknown.ext", "", http.StatusOK, "data", "text/plain; charset=utf-8", "", "max-age=300"},
+		{"no SPA fallback", "GET", "/files/missing", "", http.StatusNotFound, "Not Found", "", "", ""},
+		{"hidden directory", "GET", "/files/nested/.hidden/a.txt", "", http.StatusNotFound, "Not Found", "", "", ""},
+	}
+
+	for _, tc := range testCases {
+		req := httptest.NewRequest(tc.method, "/", nil)
+		req.URL.Path = tc.path
+		if tc.acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", tc.acceptEncoding)
+		}
+		rec := httptest.NewRecorder()
+		middleware.Handler().ServeHTTP(rec, req)
+
+		if rec.Code != tc.status {
+			t.Errorf("%s: expected status %d, got %d", tc.name, tc.status, rec.Code)
+			continue
+		}
+		if body := strings.TrimSpace(rec.Body.String()); body != tc.body {
+			t.Errorf("%s: expected body %q, got %q", tc.name, tc.body, body)
+		}
+		if tc.contentType != "" && rec.Header().Get("Content-Type") != tc.contentType {
+			t.Errorf("%s: expected Content-Type %q, got %q", tc.name, tc.contentType, rec.Header().Get("Content-Type"))
+		}
+		if encoding := rec.Header().Get("Content-Encoding"); encoding != tc.encoding {
+			t.Errorf("%s: expected Content-Encoding %q, got %q", tc.name, tc.encoding, encoding)
+		}
+		if tc.cacheControl != "" && rec.Header().Get("Cache-Control") != tc.cacheControl {
+			t.Errorf("%s: expected Cache-Control %q, got %q", tc.name, tc.cacheControl, rec.Header().Get("Cache-Control"))
+		}
+	}
+
+	// The security headers of the route are applied to static responses
+	req := httptest.NewRequest("GET", "/", nil)
+	rec := httptest.NewRecorder()
+	middleware.Handler().ServeHTTP(rec, req)
+	if csp := rec.Header().Get("Content-Security-Policy"); csp != "default-src 'self'" {
+		t.Errorf("Expected route CSP on static response, got %q", csp)
+	}
+
+	// Files on disk are validated by their modification time
+	req = httptest.NewRequest("GET", "/styles.css", nil)
+	req.Header.Set("If-Modified-Since", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	rec = httptest.NewRecorder()
+	middleware.Handler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("Expected 304 for unmodified file, got %d", rec.Code)
+	}
+
+	// Static routes are not health checked
+	if checker := NewHealthChecker(middleware); len(checker.routes) != 1 {
+		t.Errorf("Expected only the upstream route to be health checked, got %d routes", len(checker.routes))
+	}
+}
+
+func TestEmbeddedStaticRoute(t *testing.T) {
+	original := embeddedBundle
+	defer func() { embeddedBundle = original }()
+	embeddedBundle = func() fs.FS {
+		return fstest.MapFS{
+			"index.html":         {Data: []byte("<app-root></app-root>")},
+			"app.1a2b3c4d.js":    {Data: []byte("app")},
+			"app.1a2b3c4d.js.gz": {Data: []byte("gzip")},
+		}
+	}
+
+	middleware, err := NewMultiProxyMiddleware(&config.Config{
+		UpstreamRoutes: []config.UpstreamRoute{
+			{Path: "/", Static: config.StaticConfig{Embedded: true, SPA: true}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+
+	send := func(path, acceptEncoding, ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		rec := httptest.NewRecorder()
+		middleware.Handler().ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := send("/settings", "", "")
+	etag := rec.Header().Get("ETag")
+	if rec.Code != http.StatusOK || rec.Body.String() != "<app-root></app-root>" || etag == "" {
+		t.Fatalf("Expected index with ETag, got %d %q (ETag %q)", rec.Code, rec.Body.String(), etag)
+	}
+	if rec := send("/", "", etag); rec.Code != http.StatusNotModified {
+		t.Errorf("Expected 304 for matching ETag, got %d", rec.Code)
+	}
+
+	plain := send("/app.1a2b3c4d.js", "", "")
+	compressed := send("/app.1a2b3c4d.js", "gzip", "")
+	if compressed.Body.String() != "gzip" || compressed.Header().Get("Content-Encoding") != "gzip" {
+		t.Errorf("Expected precompressed variant, got %q", compressed.Body.String())
+	}
+	if plain.Header().Get("ETag") == compressed.Header().Get("ETag") {
+		t.Error("Expected different ETags for the precompressed variant")
+	}
+}
+
+func TestStaticRouteErrors(t *testing.T) {
+	dir := t.TempDir()
+	testCases := []struct {
+		name   string
+		static config.StaticConfig
+	}{
+		{"missing directory", config.StaticConfig{Dir: filepath.Join(dir, "missing")}},
+		{"SPA without index", config.StaticConfig{Dir: dir, SPA: true}},
+		{"invalid hashed assets pattern", config.StaticConfig{Dir: dir, HashedAssets: "("}},
+	}
+
+	for _, tc := range testCases {
+		_, err := NewMultiProxyMiddleware(&config.Config{
+			UpstreamRoutes: []config.UpstreamRoute{{Path: "/", Static: tc.static}},
+		})
+		if err == nil {
+			t.Errorf("%s: expected error", tc.name)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package middleware
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Token type identifiers defined by RFC 8693
+const (
+	tokenExchangeGrantType = "urn:ietf:params:oauth:grant-type:token-exchange"
+	tokenTypeAccessToken   = "urn:ietf:params:oauth:token-type:access_token"
+)
+
+// exchangedTokenRenewal is how long before expiry a cached exchanged token is
+// replaced by a new one
+const exchangedTokenRenewal = 30 * time.Second
+
+// maxExchangedTokens bounds the number of cached exchanged tokens
+const maxExchangedTokens = 1024
+
+// exchangedToken is a cached result of a token exchange
+type exchangedToken struct {
+	token     string
+	expiresAt time.Time
+}
+
+// TokenExchangeClient exchanges user access tokens at the token endpoint of the
+// OIDC provider (RFC 8693). Exchanged tokens are cached per subject token,
+// audience and scopes until shortly before they expire.
+type TokenExchangeClient struct {
+	httpClient    *http.Client
+	tokenEndpoint string
+	clientID      string
+	clientSecret  string
+	now           func() time.Time
+
+	mu    sync.Mutex
+	cache map[string]exchangedToken
+}
+
+// TokenExchanger returns a token exchanger using the provider and client
+// credentials of the middleware
+func (m *OIDCMiddleware) TokenExchanger() *TokenExchangeClient {
+	return &TokenExchangeClient{
+		httpClient:    m.httpClient,
+		tokenEndpoint: m.providerConfig.TokenEndpoint,
+		clientID:      m.config.OIDCClientID,
+		clientSecret:  m.config.OIDCClientSecret,
+		now:           time.Now,
+		cache:         make(map[string]exchangedToken),
+	}
+}
+
+// ExchangeToken returns a token for the audience and scopes on behalf of the
+// subject token
+func (c *TokenExchangeClient) ExchangeToken(ctx context.Context, subjectToken, audience string, scopes []string) (string, error) {
+	key := exchangeCacheKey(subjectToken, audience, scopes)
+
+	c.mu.Lock()
+	cached, ok := c.cache[key]
+	c.mu.Unlock()
+	if ok && c.now().Before(cached.expiresAt) {
+		return cached.token, nil
+	}
+
+	tokenResp, err := c.exchange(ctx, subjectToken, audience, scopes)
+	if err != nil {
+		return "", err
+	}
+
+	if tokenResp.ExpiresIn > 0 {
+		expiresAt := c.now().Add(time.Duration(tokenResp.ExpiresIn)*time.Second - exchangedTokenRenewal)
+		c.store(key, exchangedToken{token: tokenResp.AccessToken, expiresAt: expiresAt})
+	}
+	return tokenResp.AccessToken, nil
+}
+
+// exchange performs the token exchange request
+func (c *TokenExchangeClient) exchange(ctx context.Context, subjectToken, audience string, scopes []string) (*TokenResponse, error) {
+	data := url.Values{}
+	data.Set("grant_type", tokenExchangeGrantType)
+	data.Set("subject_token", subjectToken)
+	data.Set("subject_token_type", tokenTypeAccessToken)
+	data.Set("requested_token_type", tokenTypeAccessToken)
+	data.Set("client_id", c.clientID)
+	data.Set("client_secret", c.clientSecret)
+	if audience != "" {
+		data.Set("audience", audience)
+	}
+	if len(scopes) > 0 {
+		data.Set("scope", strings.Join(scopes, " "))
+	}
+
+	tokenResp, err := requestToken(ctx, c.httpClient, c.tokenEndpoint, data)
+	if err != nil {
+		return nil, fmt.Errorf("token exchange failed: %w", err)
+	}
+	return tokenResp, nil
+}
+
+// store caches an exchanged token. When the cache is full, expired entries are
+// removed first and then the tokens expiring soonest.
+func (c *TokenExchangeClient) store(key string, token exchangedToken) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, exists := c.cache[key]; !exists && len(c.cache) >= maxExchangedTokens {
+		now := c.now()
+		for k, cached := range c.cache {
+			if !now.Before(cached.expiresAt) {
+				delete(c.cache, k)
+			}
+		}
+		for len(c.cache) >= maxExchangedTokens {
+			c.evictSoonestExpiring()
+		}
+	}
+	c.cache[key] = token
+}
+
+// evictSoonestExpiring removes the cached token that expires first; the caller
+// must hold the lock
+func (c *TokenExchangeClient) evictSoonestExpiring() {
+	var soonest string
+	var soonestExpiry time.Time
+	for k, cached := range c.cache {
+		if soonest == "" || cached.expiresAt.Before(soonestExpiry) {
+			soonest, soonestExpiry = k, cached.expiresAt
+		}
+	}
+	delete(c.cache, soonest)
+}
+
+// exchangeCacheKey identifies an exchanged token without keeping the subject
+// token itself in memory
+func exchangeCacheKey(subjectToken, audience string, scopes []string) string {
+	sum := sha256.Sum256([]byte(subjectToken + "\x00" + audience + "\x00" + strings.Join(scopes, " ")))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,100 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ase-compas/compas-auth-proxy/internal/config"
+)
+
+func TestTokenExchange(t *testing.T) {
+	var requests int
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		r.ParseForm()
+		if r.Form.Get("grant_type") != tokenExchangeGrantType || r.Form.Get("subject_token") != "user-token" || r.Form.Get("client_id") != "gateway" {
+			t.Errorf("Unexpected token exchange request: %v", r.Form)
+		}
+		if r.Form.Get("audience") == "unknown-service" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_target"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "token-for-" + r.Form.Get("audience") + "-" + r.Form.Get("scope"),
+			"token_type":   "Bearer",
+			"expires_in":   300,
+		})
+	}))
+	defer provider.Close()
+
+	oidc := &OIDCMiddleware{
+		config:         &config.Config{OIDCClientID: "gateway", OIDCClientSecret: "secret"},
+		httpClient:     provider.Client(),
+		providerConfig: &ProviderConfig{TokenEndpoint: provider.URL},
+	}
+	exchanger := oidc.TokenExchanger()
+	now := time.Now()
+	exchanger.now = func() time.Time { return now }
+
+	token, err := exchanger.ExchangeToken(context.Background(), "user-token", "scl-service", []string{"scl:read"})
+	if err != nil || token != "token-for-scl-service-scl:read" {
+		t.Fatalf("Expected exchanged token, got %q (%v)", token, err)
+	}
+
+	// Cached until shortly before expiry
+	now = now.Add(4 * time.Minute)
+	if token, _ := exchanger.ExchangeToken(context.Background(), "user-token", "scl-service", []string{"scl:read"}); token != "token-for-scl-service-scl:read" || requests != 1 {
+		t.Errorf("Expected cached token, got %q after %d requests", token, requests)
+	}
+
+	// Another audience requires its own exchange
+	if token, _ := exchanger.ExchangeToken(context.Background(), "user-token", "location-service", nil); token != "token-for-location-service-" || requests != 2 {
+		t.Errorf("Expected token for second audience, got %q after %d requests", token, requests)
+	}
+
+	// Renewed within the renewal window
+	now = now.Add(40 * time.Second)
+	if _, err := exchanger.ExchangeToken(context.Background(), "user-token", "scl-service", []string{"scl:read"}); err != nil || requests != 3 {
+		t.Errorf("Expected renewal near expiry, got %d requests (%v)", requests, err)
+	}
+
+	if _, err := exchanger.ExchangeToken(context.Background(), "user-token", "unknown-service", nil); err == nil {
+		t.Error("Expected error for rejected token exchange")
+	}
+}
+
+func TestTokenExchangeCacheBound(t *testing.T) {
+	now := time.Now()
+	exchanger := &TokenExchangeClient{
+		now:   func() time.Time { return now },
+		cache: make(map[string]exchangedToken),
+	}
+
+	// None of the cached tokens has expired when the cache is full
+	for i := 0; i < maxExchangedTokens+10; i++ {
+		exchanger.store(fmt.Sprintf("token-%d", i), exchangedToken{token: "token", expiresAt: now.Add(time.Hour + time.Duration(i)*time.Second)})
+	}
+	if len(exchanger.cache) != maxExchangedTokens {
+		t.Errorf("Expected the cache to hold %d tokens, got %d", maxExchangedTokens, len(exchanger.cache))
+	}
+	for i := 0; i < 10; i++ {
+		if _, ok := exchanger.cache[fmt.Sprintf("token-%d", i)]; ok {
+			t.Errorf("Expected token-%d expiring soonest to be evicted", i)
+		}
+	}
+	if _, ok := exchanger.cache[fmt.Sprintf("token-%d", maxExchangedTokens+9)]; !ok {
+		t.Error("Expected the newest token to be cached")
+	}
+
+	// Replacing a cached token does not evict another one
+	exchanger.store("token-10", exchangedToken{token: "renewed", expiresAt: now.Add(2 * time.Hour)})
+	if len(exchanger.cache) != maxExchangedTokens || exchanger.cache["token-10"].token != "renewed" {
+		t.Errorf("Expected token to be replaced in place, got %d tokens", len(exchanger.cache))
+	}
+}
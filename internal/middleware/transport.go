@@ -0,0 +1,305 @@
+package middleware
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ase-compas/compas-auth-proxy/internal/config"
+	"github.com/gorilla/websocket"
+)
+
+// errNoUpstreamAvailable is returned when no target of a route can serve a request
+var errNoUpstreamAvailable = errors.New("no upstream target available")
+
+// routeTimeouts returns the upstream timeouts of a route with defaults applied
+func routeTimeouts(route config.UpstreamRoute) config.TimeoutConfig {
+	timeouts := route.Timeouts
+	if timeouts.Dial == 0 {
+		timeouts.Dial = 10 * time.Second
+	}
+	if timeouts.TLSHandshake == 0 {
+		timeouts.TLSHandshake = 10 * time.Second
+	}
+	if timeouts.Idle == 0 {
+		timeouts.Idle = 90 * time.Second
+	}
+	return timeouts
+}
+
+// newRouteTransport creates the HTTP transport used for the upstreams of a
+// route, applying the route's timeouts and TLS settings
+func newRouteTransport(route config.UpstreamRoute, tlsConfig *tls.Config) *http.Transport {
+	timeouts := routeTimeouts(route)
+	dialer := &net.Dialer{
+		Timeout:   timeouts.Dial,
+		KeepAlive: 30 * time.Second,
+	}
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsConfig,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       timeouts.Idle,
+		TLSHandshakeTimeout:   timeouts.TLSHandshake,
+		ResponseHeaderTimeout: timeouts.ResponseHeader,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+// newWebSocketDialer creates the dialer used for WebSocket connections to the
+// upstreams of a route, with the same timeouts and TLS settings as HTTP
+func newWebSocketDialer(route config.UpstreamRoute, tlsConfig *tls.Config) *websocket.Dialer {
+	timeouts := routeTimeouts(route)
+	dialer := &net.Dialer{
+		Timeout:   timeouts.Dial,
+		KeepAlive: 30 * time.Second,
+	}
+	return &websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		NetDialContext:   dialer.DialContext,
+		TLSClientConfig:  tlsConfig,
+		HandshakeTimeout: timeouts.Dial + timeouts.TLSHandshake,
+	}
+}
+
+// tlsVersions maps the configurable minimum TLS versions to their constants
+var tlsVersions = map[string]uint16{
+	config.TLSVersion10: tls.VersionTLS10,
+	config.TLSVersion11: tls.VersionTLS11,
+	config.TLSVersion12: tls.VersionTLS12,
+	config.TLSVersion13: tls.VersionTLS13,
+}
+
+// newUpstreamTLSConfig creates the TLS configuration for the upstreams of a
+// route. The global insecureSkipVerify setting applies to every route.
+func newUpstreamTLSConfig(route config.UpstreamRoute, insecureSkipVerify bool) (*tls.Config, error) {
+	settings := route.TLS
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         settings.ServerName,
+		InsecureSkipVerify: insecureSkipVerify || settings.InsecureSkipVerify,
+	}
+	if version, ok := tlsVersions[settings.MinVersion]; ok {
+		tlsConfig.MinVersion = version
+	}
+
+	if settings.CAFile != "" {
+		pem, err := os.ReadFile(settings.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file for route %s: %v", route.Path, err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s for route %s", settings.CAFile, route.Path)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if settings.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(settings.CertFile, settings.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate for route %s: %v", route.Path, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if tlsConfig.InsecureSkipVerify {
+		log.Printf("WARNING: TLS certificate verification of upstreams is disabled for route %s", route.Path)
+	}
+	return tlsConfig, nil
+}
+
+// isTimeout reports whether err was caused by a timeout
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// upstreamTransport sends each proxied request to a target selected from the
+// route's upstream pool, retrying failed attempts according to the route's
+// retry policy
+type upstreamTransport struct {
+	pool  *UpstreamPool
+	base  http.RoundTripper
+	retry *retryPolicy
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	attempts := 1
+	var body *replayableBody
+	if t.retry.appliesTo(req) {
+		var err error
+		req, body, err = bufferRequestBody(req, t.retry.maxBodySize)
+		if err != nil {
+			return nil, err
+		}
+		if body != nil {
+			attempts = t.retry.attempts
+		}
+	}
+
+	var tried []*Target
+	for attempt := 1; ; attempt++ {
+		target, generation, err := t.pool.Acquire(req, tried)
+		if err != nil && len(tried) > 0 {
+			// No untried target is left, try the previous ones again
+			target, generation, err = t.pool.Acquire(req, nil)
+		}
+		if err != nil {
+			return nil, err
+		}
+		tried = append(tried, target)
+
+		outreq := req
+		if body != nil {
+			outreq = body.attach(req)
+		}
+		resp, err := t.roundTripTarget(outreq, target, generation)
+
+		last := attempt >= attempts || req.Context().Err() != nil
+		if err != nil {
+			if last || !t.retry.retryableError(err) {
+				return nil, err
+			}
+			log.Printf("Attempt %d/%d for %s %s to %s failed, retrying: %v", attempt, attempts, req.Method, req.URL.Path, target.URL, err)
+		} else {
+			if last || !t.retry.retryableStatus(resp.StatusCode) {
+				return resp, nil
+			}
+			log.Printf("Attempt %d/%d for %s %s to %s returned %d, retrying", attempt, attempts, req.Method, req.URL.Path, target.URL, resp.StatusCode)
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+			resp.Body.Close()
+		}
+
+		select {
+		case <-time.After(t.retry.delay(attempt)):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// roundTripTarget sends the request to the given target, tracking it as
+// active until the response body is closed and reporting the outcome to the
+// target's circuit breaker
+func (t *upstreamTransport) roundTripTarget(req *http.Request, target *Target, generation uint64) (*http.Response, error) {
+	outreq := req.Clone(req.Context())
+	rewriteRequestURL(outreq.URL, target.URL)
+
+	log.Printf("Proxying %s %s to %s", req.Method, req.URL.Path, outreq.URL.String())
+
+	target.acquire()
+	resp, err := t.base.RoundTrip(outreq)
+	if err != nil {
+		target.release()
+		if req.Context().Err() != nil {
+			// The client went away, this says nothing about the upstream
+			target.breaker.ignore(generation)
+		} else {
+			target.breaker.record(generation, false)
+		}
+		return nil, err
+	}
+	target.breaker.record(generation, resp.StatusCode < 500)
+
+	resp.Body = &releaseOnClose{ReadCloser: resp.Body, release: target.release}
+	return resp, nil
+}
+
+// releaseOnClose releases a target once the response body is closed
+type releaseOnClose struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (b *releaseOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// Write forwards writes for bidirectional (101 Switching Protocols) bodies
+func (b *releaseOnClose) Write(p []byte) (int, error) {
+	if w, ok := b.ReadCloser.(io.Writer); ok {
+		return w.Write(p)
+	}
+	return 0, errors.New("response body is not writable")
+}
+
+// rewriteRequestURL points the request URL at the target, joining the target's
+// base path and query with those of the request
+func rewriteRequestURL(u *url.URL, target *url.URL) {
+	u.Scheme = target.Scheme
+	u.Host = target.Host
+	u.Path, u.RawPath = joinURLPath(target, u)
+	if target.RawQuery == "" || u.RawQuery == "" {
+		u.RawQuery = target.RawQuery + u.RawQuery
+	} else {
+		u.RawQuery = target.RawQuery + "&" + u.RawQuery
+	}
+}
+
+// joinURLPath joins the paths of two URLs, preserving their escaped forms
+func joinURLPath(a, b *url.URL) (path, rawpath string) {
+	if a.RawPath == "" && b.RawPath == "" {
+		return singleJoiningSlash(a.Path, b.Path), ""
+	}
+
+	apath := a.EscapedPath()
+	bpath := b.EscapedPath()
+
+	aslash := strings.HasSuffix(apath, "/")
+	bslash := strings.HasPrefix(bpath, "/")
+
+	switch {
+	case aslash && bslash:
+		return a.Path + b.Path[1:], apath + bpath[1:]
+	case !aslash && !bslash:
+		return a.Path + "/" + b.Path, apath + "/" + bpath
+	}
+	return a.Path + b.Path, apath + bpath
+}
+
+// singleJoiningSlash joins two paths with exactly one slash between them
+func singleJoiningSlash(a, b string) string {
+	aslash := strings.HasSuffix(a, "/")
+	bslash := strings.HasPrefix(b, "/")
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+	return a + b
+}
+
+// websocketURL returns the WebSocket URL of a target for the given request URL
+func websocketURL(target *url.URL, requestURL *url.URL) *url.URL {
+	u := *requestURL
+	rewriteRequestURL(&u, target)
+	if target.Scheme == "https" {
+		u.Scheme = "wss"
+	} else {
+		u.Scheme = "ws"
+	}
+	u.Fragment = ""
+	return &u
+}
@@ -0,0 +1,78 @@
+package middleware
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ase-compas/compas-auth-proxy/internal/config"
+)
+
+func TestUpstreamTLS(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: backend.Certificate().Raw})
+	if err := os.WriteFile(caFile, caPEM, 0600); err != nil {
+		t.Fatalf("Failed to write CA file: %v", err)
+	}
+
+	testCases := []struct {
+		name     string
+		tls      config.UpstreamTLSConfig
+		global   bool
+		expected int
+	}{
+		{"untrusted certificate", config.UpstreamTLSConfig{}, false, http.StatusBadGateway},
+		{"custom CA", config.UpstreamTLSConfig{CAFile: caFile}, false, http.StatusOK},
+		{"server name mismatch", config.UpstreamTLSConfig{CAFile: caFile, ServerName: "other.internal"}, false, http.StatusBadGateway},
+		{"route skip verify", config.UpstreamTLSConfig{InsecureSkipVerify: true}, false, http.StatusOK},
+		{"global skip verify", config.UpstreamTLSConfig{}, true, http.StatusOK},
+	}
+
+	for _, tc := range testCases {
+		middleware, err := NewMultiProxyMiddleware(&config.Config{
+			InsecureSkipVerify: tc.global,
+			UpstreamRoutes: []config.UpstreamRoute{{
+				Path:        "/api",
+				UpstreamURL: backend.URL,
+				TLS:         tc.tls,
+			}},
+		})
+		if err != nil {
+			t.Fatalf("%s: failed to create middleware: %v", tc.name, err)
+		}
+
+		rec := httptest.NewRecorder()
+		middleware.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/api/data", nil))
+		if rec.Code != tc.expected {
+			t.Errorf("%s: expected %d, got %d", tc.name, tc.expected, rec.Code)
+		}
+	}
+}
+
+func TestUpstreamTLSConfigErrors(t *testing.T) {
+	emptyFile := filepath.Join(t.TempDir(), "empty.pem")
+	os.WriteFile(emptyFile, nil, 0600)
+
+	testCases := []struct {
+		name string
+		tls  config.UpstreamTLSConfig
+	}{
+		{"missing CA file", config.UpstreamTLSConfig{CAFile: "/nonexistent/ca.pem"}},
+		{"CA file without certificates", config.UpstreamTLSConfig{CAFile: emptyFile}},
+		{"missing client certificate", config.UpstreamTLSConfig{CertFile: "/nonexistent/cert.pem", KeyFile: "/nonexistent/key.pem"}},
+	}
+
+	for _, tc := range testCases {
+		if _, err := newUpstreamTLSConfig(config.UpstreamRoute{Path: "/api", TLS: tc.tls}, false); err == nil {
+			t.Errorf("%s: expected an error", tc.name)
+		}
+	}
+}
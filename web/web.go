@@ -0,0 +1,21 @@
+// Package web embeds the frontend bundle served by static routes with
+// embedded: true. Copy the built frontend into web/dist before building the
+// gateway to embed it.
+package web
+
+import (
+	"embed"
+	"io/fs"
+)
+
+//go:embed all:dist
+var dist embed.FS
+
+// Bundle returns the embedded frontend bundle
+func Bundle() fs.FS {
+	bundle, err := fs.Sub(dist, "dist")
+	if err != nil {
+		panic(err)
+	}
+	return bundle
+}